@@ -0,0 +1,172 @@
+// Command migrate recomputes the checksums of a shard dump under the current
+// record digest scheme.
+//
+// Dumps written before records were digested properly hold a JSON encoding of
+// the database (or of a single shard's state), with checksums that are sums
+// of ScalarBaseMult(sha256.New().Sum(json)) on P-521.  migrate checks each
+// shard's recorded checksum against its records under that legacy scheme,
+// then prints the checksum the same records have now.  A single shard's
+// state doesn't say which shard it is, so -shard must name it.
+//
+//  go run ./cmd/migrate -in dump.json -algorithm ecmh-p521 -hash sha256
+package main
+
+import (
+	"crypto"
+	"crypto/elliptic"
+	"crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"os"
+	"sort"
+
+	"github.com/rfielding/bc/shards"
+)
+
+type legacyState struct {
+	Data      map[shards.Id]*shards.DataRecord `json:"data,omitempty"`
+	Checksum  *shards.Point                    `json:"checksum,omitempty"`
+	HighestId shards.Id                        `json:"highestid,omitempty"`
+}
+
+type legacyDb struct {
+	State map[shards.Shard]*legacyState `json:"state,omitempty"`
+}
+
+var hashes = map[string]crypto.Hash{
+	"sha256":     crypto.SHA256,
+	"sha384":     crypto.SHA384,
+	"sha512":     crypto.SHA512,
+	"sha512/256": crypto.SHA512_256,
+}
+
+// legacyChecksum is how checksums were computed before record digests:
+// the JSON with an empty SHA-256 appended, used as a scalar on P-521.
+func legacyChecksum(records map[shards.Id]*shards.DataRecord) shards.Point {
+	curve := elliptic.P521()
+	x, y := new(big.Int), new(big.Int)
+	for _, v := range records {
+		h := sha256.New().Sum([]byte(shards.AsJson(v)))
+		x1, y1 := curve.ScalarBaseMult(h)
+		x, y = curve.Add(x, y, x1, y1)
+	}
+	return shards.Point{X: x, Y: y}
+}
+
+func formatLegacy(shard shards.Shard, p shards.Point) string {
+	return fmt.Sprintf(
+		"%d:%s,%s",
+		shard,
+		hex.EncodeToString(p.X.Bytes()),
+		hex.EncodeToString(p.Y.Bytes()),
+	)
+}
+
+// readDump reads a dump from in.  A dump of a single shard's state doesn't
+// say which shard it is, so it needs hasShard.
+func readDump(in string, shard shards.Shard, hasShard bool) (map[shards.Shard]*legacyState, error) {
+	var j []byte
+	var err error
+	if in == "-" {
+		j, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		j, err = ioutil.ReadFile(in)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var db legacyDb
+	if err := json.Unmarshal(j, &db); err != nil {
+		return nil, err
+	}
+	if len(db.State) > 0 {
+		return db.State, nil
+	}
+	// not a whole database, so it must be the state of one shard
+	if !hasShard {
+		return nil, errors.New("the dump is of a single shard, so -shard is required")
+	}
+	var st legacyState
+	if err := json.Unmarshal(j, &st); err != nil {
+		return nil, err
+	}
+	return map[shards.Shard]*legacyState{shard: &st}, nil
+}
+
+// report writes the legacy and migrated checksums of each shard to w, and
+// returns false if any legacy checksum doesn't match its dump.
+func report(w io.Writer, states map[shards.Shard]*legacyState, alg shards.Algorithm, h crypto.Hash) (bool, error) {
+	ids := make([]shards.Shard, 0, len(states))
+	for shard := range states {
+		ids = append(ids, shard)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	ok := true
+	for _, shard := range ids {
+		st := states[shard]
+		records := make([]*shards.DataRecord, 0, len(st.Data))
+		for _, v := range st.Data {
+			records = append(records, v)
+		}
+
+		legacy := legacyChecksum(st.Data)
+		verdict := "no checksum in dump"
+		if st.Checksum != nil && st.Checksum.X != nil && st.Checksum.Y != nil {
+			if st.Checksum.X.Cmp(legacy.X) == 0 && st.Checksum.Y.Cmp(legacy.Y) == 0 {
+				verdict = "matches dump"
+			} else {
+				verdict = "DOES NOT match dump"
+				ok = false
+			}
+		}
+		ck, err := shards.ChecksumOf(alg, shards.Digester{Hash: h}, records)
+		if err != nil {
+			return false, err
+		}
+		fmt.Fprintf(w, "shard %d: %d records, highest id %d\n", shard, len(records), st.HighestId)
+		fmt.Fprintf(w, "  legacy:   %s (%s)\n", formatLegacy(shard, legacy), verdict)
+		fmt.Fprintf(w, "  migrated: %s\n", shards.FormatChecksum(shard, ck))
+	}
+	return ok, nil
+}
+
+func main() {
+	in := flag.String("in", "-", "shard dump to read, or - for stdin")
+	shardFlag := flag.Int64("shard", 0, "shard id, required when the dump is a single shard's state")
+	algFlag := flag.String("algorithm", shards.ECMHP521.String(), "multiset hash for the migrated checksum")
+	hashFlag := flag.String("hash", "sha256", "record digest hash")
+	flag.Parse()
+	hasShard := false
+	flag.Visit(func(f *flag.Flag) {
+		hasShard = hasShard || f.Name == "shard"
+	})
+
+	alg, err := shards.ParseAlgorithm(*algFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	h, ok := hashes[*hashFlag]
+	if !ok {
+		log.Fatalf("unknown hash %q", *hashFlag)
+	}
+	states, err := readDump(*in, shards.Shard(*shardFlag), hasShard)
+	if err != nil {
+		log.Fatalf("cannot read dump %s: %v", *in, err)
+	}
+	ok, err = report(os.Stdout, states, alg, h)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"strings"
+	"testing"
+
+	"github.com/rfielding/bc/shards"
+)
+
+// migrated is the checksum of testdata/shard.json's records as shard 3,
+// under ecmh-p521 and sha256.
+const migrated = "3:ecmh-p521:000970127444d569aa81277165e9a0f03db44b93571571edef4394de580d77fc35b2af43a4696572a9f1ae70d5930bc39d5b8a3cbce31ad4aacc33e624d97cb7cc9f00f1061fc22057028f48decbdfcb52737dd1b88aa4794634a7e75fc215f1b84b65d077ec06525ebf3f1ec562c968f910e9f7cf915dc99682a4ca3a7b148e3e648724"
+
+func TestMigrateShard(t *testing.T) {
+	if _, err := readDump("testdata/shard.json", 0, false); err == nil || !strings.Contains(err.Error(), "-shard") {
+		t.Fatalf("got %v", err)
+	}
+	states, err := readDump("testdata/shard.json", 3, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	ok, err := report(&out, states, shards.ECMHP521, crypto.SHA256)
+	if err != nil || !ok {
+		t.Fatalf("%v %v:\n%s", ok, err, out.String())
+	}
+	if !strings.Contains(out.String(), "(matches dump)") {
+		t.Fatalf("the legacy checksum doesn't match:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "  migrated: "+migrated+"\n") {
+		t.Fatalf("expected %s:\n%s", migrated, out.String())
+	}
+}
+
+func TestMigrateDatabase(t *testing.T) {
+	// shard 5 of the dump has shard 3's legacy checksum
+	states, err := readDump("testdata/db.json", 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	ok, err := report(&out, states, shards.ECMHP521, crypto.SHA256)
+	if err != nil || ok {
+		t.Fatalf("%v %v:\n%s", ok, err, out.String())
+	}
+	lines := strings.Split(out.String(), "\n")
+	if len(lines) != 7 || !strings.HasSuffix(lines[1], "(matches dump)") || !strings.HasSuffix(lines[4], "(DOES NOT match dump)") {
+		t.Fatalf("got\n%s", out.String())
+	}
+	if lines[2] != "  migrated: "+migrated {
+		t.Fatalf("expected %s:\n%s", migrated, out.String())
+	}
+}
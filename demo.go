@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/rfielding/bc/shards"
+)
+
+// demo drives an in-memory database through inserts, removes, a signature
+// and an expiring lease, printing the checksum after each.
+func demo(args []string) error {
+	dbShard := shards.Shard(22)
+	clock := &shards.LogicalClock{}
+	db, err := shards.NewDB(
+		dbShard,
+		shards.WithClock(clock),
+		shards.WithLogger(log.New(os.Stderr, "", log.LstdFlags)),
+	)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("initial checksum: %s\n\n", db.Checksum(dbShard))
+
+	dbShard_1, _ := db.Do(shards.Command{
+		Action: shards.ActionInsert,
+		Record: &shards.DataRecord{
+			Shard: dbShard,
+			TTL:   20,
+		},
+	})
+	fmt.Printf("id1: %s\n\n", db.Checksum(dbShard))
+	sig, err := db.Sign(dbShard)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("sign %d: %s\n\n", dbShard, shards.AsJson(sig))
+
+	dbShard_2, _ := db.Do(shards.Command{
+		Action: shards.ActionInsert,
+		Record: &shards.DataRecord{
+			Shard: dbShard,
+			TTL:   21,
+		},
+	})
+	fmt.Printf("id1+id2: %s\n\n", db.Checksum(dbShard))
+
+	db.Do(shards.Command{
+		Action: shards.ActionRemove,
+		Record: db.Get(dbShard, dbShard_2.Id),
+	})
+	fmt.Printf("id1: %s\n\n", db.Checksum(dbShard))
+
+	dbShard2 := shards.Shard(202)
+	db.Do(shards.Command{
+		Action: shards.ActionInsert,
+		Record: &shards.DataRecord{
+			Shard: dbShard2,
+			TTL:   50,
+		},
+	})
+
+	verified := db.Verify(dbShard, sig)
+	fmt.Printf("verify: %t\n\n", verified)
+
+	db.Do(shards.Command{Action: shards.ActionRemove, Record: db.Get(dbShard, 1)})
+	fmt.Printf("empty checksum: %s\n\n", db.Checksum(dbShard))
+
+	// empty out the other shard
+	db.Do(shards.Command{
+		Action: shards.ActionRemove,
+		Record: db.Get(dbShard2, dbShard_1.Id),
+	})
+	fmt.Printf("shard %d, id1: %s\n\n", dbShard2, db.Checksum(dbShard2))
+
+	// leased records go away on their own
+	db.Do(shards.Command{
+		Action: shards.ActionInsert,
+		Record: &shards.DataRecord{
+			Shard: dbShard,
+			TTL:   clock.Advance(10),
+		},
+	})
+	fmt.Printf("leased until %d: %s\n\n", clock.Now(), db.Checksum(dbShard))
+	expired, err := db.Expire(dbShard)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("expired %d at %d: %s\n\n", len(expired), clock.Now(), db.Checksum(dbShard))
+	return nil
+}
@@ -1,289 +1,535 @@
+// Command bc operates a shard store on disk: a database with its write-ahead
+// log, the keys of the shards it writes and the public keys it trusts.
+//
+//  bc init -shard 22                   create a store that writes shard 22
+//  echo '{"shard":22}' | bc insert     insert records, from files or stdin
+//  bc get -shard 22 -id 1              print a record
+//  bc ls -shard 22                     list a shard's records
+//  bc remove -shard 22 -id 1           remove a record
+//  bc checksum -shard 22               print a shard's checksum
+//  bc sign -shard 22 > s.json          sign a statement of its checksum
+//  bc verify s.json                    verify a statement against the store
+//  bc export -shard 22 > 22.snap       write a snapshot of a shard
+//  bc import -statement s.json 22.snap load a snapshot of a shard
+//  bc trust keys.pem                   trust the public keys in a file
+//  bc keys                             print the public keys the store trusts
+//  bc serve -addr :8080                serve the store over HTTP
+//  bc sync -peer http://host:8080      sync the shards it doesn't write
+//  bc demo                             run the in-memory demo
+//
+// Every command takes -dir, the store's directory.  Records are JSON, one
+// object, a list of them, or a stream of objects.
 package main
 
 import (
 	"bytes"
-	"crypto/ecdsa"
-	"crypto/elliptic"
-	"crypto/rand"
-	"crypto/sha256"
-	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
-	"math/big"
-	"sync"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/rfielding/bc/server"
+	"github.com/rfielding/bc/shards"
 )
 
-type Action int
-
-const ActionInsert = Action(0)
-const ActionRemove = Action(1)
-
-type Id int64
-type Shard int64
-
-type Reference struct {
-	Shard Shard `json:"shard,omitempty"`
-	Id    Id    `json:"id,omitempty"`
+type command struct {
+	usage string
+	run   func(args []string) error
 }
 
-type Command struct {
-	Action Action      `json:"action,omitempty"`
-	Record *DataRecord `json:"record,omitempty"`
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"init":     {"-shard N[,N...]", cmdInit},
+		"insert":   {"[file ...]", cmdInsert},
+		"remove":   {"[-cascade] [-shard N -id N | file ...]", cmdRemove},
+		"get":      {"-shard N -id N", cmdGet},
+		"ls":       {"-shard N [-after id] [-limit n]", cmdList},
+		"checksum": {"-shard N", cmdChecksum},
+		"sign":     {"-shard N", cmdSign},
+		"verify":   {"[file]", cmdVerify},
+		"export":   {"-shard N [-o file]", cmdExport},
+		"import":   {"[-statement file] [file]", cmdImport},
+		"trust":    {"[file]", cmdTrust},
+		"keys":     {"", cmdKeys},
+		"serve":    {"[-addr :8080]", cmdServe},
+		"sync":     {"-peer url", cmdSync},
+		"demo":     {"", demo},
+	}
 }
 
-type DataRecord struct {
-	Shard   Shard                `json:"shard,omitempty"`
-	Id      Id                   `json:"id,omitempty"`
-	TTL     int64                `json:"ttl,omitempty"`
-	Refs    map[string]Reference `json:"refs,omitempty"`
-	Ints    map[string]int64     `json:"ints,omitempty"`
-	Strings map[string]string    `json:"strings,omitempty"`
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: bc <command> [-dir store] [flags]\n\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-9s %s\n", name, commands[name].usage)
+	}
 }
 
-type State struct {
-	Data      map[Id]*DataRecord `json:"data,omitempty"`
-	KeyPair   *ecdsa.PrivateKey  `json:"keypair,omitempty"`
-	Checksum  Point              `json:"checksum,omitempty"`
-	PublicKey *Point             `json:"publickey,omitempty"`
-	HighestId Id                 `json:"highestid,omitempty"`
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	c, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+	if err := c.run(os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "bc %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
 }
 
-type Point struct {
-	X *big.Int `json:"x,omitempty"`
-	Y *big.Int `json:"y,omitempty"`
+// flags are the ones every command that uses the store has.
+type flags struct {
+	*flag.FlagSet
+	dir   *string
+	shard *int64
+	id    *int64
+	// files is set if the command reads records from files instead, when
+	// it is given neither -shard nor -id
+	files bool
 }
 
-type Db struct {
-	State map[Shard]*State `json:"state,omitempty"`
-	Lock  sync.Mutex       `json:-`
+func newFlags(name string, shard, id bool) *flags {
+	f := &flags{FlagSet: flag.NewFlagSet("bc "+name, flag.ContinueOnError)}
+	f.dir = f.String("dir", "bc-store", "store directory")
+	if shard {
+		f.shard = f.Int64("shard", 0, "shard")
+	}
+	if id {
+		f.id = f.Int64("id", 0, "record id")
+	}
+	return f
 }
 
-var Curve = elliptic.P521()
-var zPoint = zeroPoint(Curve)
+// given reports whether a flag was set on the command line.
+func (f *flags) given(name string) bool {
+	given := false
+	f.Visit(func(fl *flag.Flag) {
+		given = given || fl.Name == name
+	})
+	return given
+}
 
-func AsJson(v interface{}) string {
-	s, err := json.Marshal(v)
-	if err != nil {
-		panic(fmt.Sprintf("cannot marshal data: %v", err))
+// open opens the store, once the flags are parsed.  A command with -shard or
+// -id needs them, unless it reads files and is given neither.
+func (f *flags) open() (*store, error) {
+	if f.files && !f.given("shard") && !f.given("id") {
+		return openStore(*f.dir)
+	}
+	if f.shard != nil && !f.given("shard") {
+		return nil, fmt.Errorf("-shard is required: %w", shards.ErrUnknownShard)
 	}
-	return string(s)
+	if f.id != nil && !f.given("id") {
+		return nil, errors.New("-id is required")
+	}
+	return openStore(*f.dir)
 }
 
-func newState() *State {
-	return &State{
-		Data:     make(map[Id]*DataRecord),
-		Checksum: zPoint,
+// input opens the files named, or stdin if there are none.
+func input(names []string) (io.Reader, error) {
+	if len(names) == 0 {
+		return os.Stdin, nil
+	}
+	var readers []io.Reader
+	for _, name := range names {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		readers = append(readers, bytes.NewReader(b))
 	}
+	return io.MultiReader(readers...), nil
 }
 
-func zeroPoint(curve elliptic.Curve) Point {
-	xInit, yInit := curve.ScalarBaseMult(nil)
-	return Point{
-		X: xInit,
-		Y: yInit,
+// readRecords reads JSON records: objects, or lists of them.
+func readRecords(r io.Reader) ([]*shards.DataRecord, error) {
+	var records []*shards.DataRecord
+	d := json.NewDecoder(r)
+	for {
+		var raw json.RawMessage
+		if err := d.Decode(&raw); err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if b := bytes.TrimSpace(raw); len(b) > 0 && b[0] == '[' {
+			var list []*shards.DataRecord
+			if err := json.Unmarshal(raw, &list); err != nil {
+				return nil, err
+			}
+			records = append(records, list...)
+			continue
+		}
+		v := &shards.DataRecord{}
+		if err := json.Unmarshal(raw, v); err != nil {
+			return nil, err
+		}
+		records = append(records, v)
 	}
 }
 
-func newKeyPair(curve elliptic.Curve) (*ecdsa.PrivateKey, error) {
-	return ecdsa.GenerateKey(Curve, rand.Reader)
+func printJSON(v interface{}) error {
+	e := json.NewEncoder(os.Stdout)
+	e.SetIndent("", "  ")
+	return e.Encode(v)
 }
 
-func NewDB(shard Shard) (*Db, error) {
-	kp, err := newKeyPair(Curve)
-	if err != nil {
-		return nil, err
+func cmdInit(args []string) error {
+	f := newFlags("init", false, false)
+	list := f.String("shard", "", "comma separated shards the store writes")
+	if err := f.Parse(args); err != nil {
+		return err
 	}
-	db := &Db{
-		State: make(map[Shard]*State),
+	var ids []shards.Shard
+	for _, s := range strings.Split(*list, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		var n int64
+		if _, err := fmt.Sscan(s, &n); err != nil || n == 0 {
+			return fmt.Errorf("shard %q: %w", s, shards.ErrUnknownShard)
+		}
+		ids = append(ids, shards.Shard(n))
 	}
-	db.State[shard] = newState()
-	db.State[shard].KeyPair = kp
-	return db, nil
+	if err := initStore(*f.dir, ids); err != nil {
+		return err
+	}
+	fmt.Printf("initialized %s\n", *f.dir)
+	return nil
 }
 
-func (state *State) sum(h []byte, neg bool) {
-	x1, y1 := Curve.ScalarBaseMult(h)
-	if neg {
-		y1 = new(big.Int).Neg(y1)
-	}
-	ck := state.Checksum
-	x2, y2 := Curve.Add(ck.X, ck.Y, x1, y1)
-	ck.X = x2
-	ck.Y = y2
-	state.Checksum = ck
+// do applies one command per record as a batch, and prints the results.
+func do(s *store, action shards.Action, cascade bool, records []*shards.DataRecord) error {
+	if len(records) == 0 {
+		return shards.ErrNoRecord
+	}
+	b := shards.Batch{}
+	for _, v := range records {
+		b.Commands = append(b.Commands, shards.Command{Action: action, Record: v, Cascade: cascade})
+	}
+	results, err := s.db.DoBatch(b)
+	if err != nil {
+		return err
+	}
+	return printJSON(results)
 }
 
-// Insert the object only if it does not already exist
-func (db *Db) Insert(v *DataRecord) (*DataRecord, error) {
-	db.Lock.Lock()
-	defer db.Lock.Unlock()
-
-	shard := v.Shard
-	if db.State[shard] == nil {
-		db.State[shard] = newState()
+func cmdInsert(args []string) error {
+	f := newFlags("insert", false, false)
+	if err := f.Parse(args); err != nil {
+		return err
 	}
-	st := db.State[shard]
-	if v.Id == 0 {
-		st.HighestId++
-		v.Id = st.HighestId
+	r, err := input(f.Args())
+	if err != nil {
+		return err
 	}
-	id := v.Id
-	if st.HighestId < v.Id {
-		st.HighestId = v.Id
+	records, err := readRecords(r)
+	if err != nil {
+		return err
 	}
-
-	_, ok := st.Data[id]
-	if ok {
-		return nil, fmt.Errorf("object %d already exists", id)
-	}
-	j := AsJson(v)
-	h := sha256.New().Sum([]byte(j))
-	st.sum(h, false)
-	st.Data[id] = v
-	return v, nil
+	s, err := f.open()
+	if err != nil {
+		return err
+	}
+	defer s.close()
+	return do(s, shards.ActionInsert, false, records)
 }
 
-// Remove the record only if it is there
-func (db *Db) Remove(vToRemove *DataRecord) (*DataRecord, error) {
-	db.Lock.Lock()
-	defer db.Lock.Unlock()
+func cmdRemove(args []string) error {
+	f := newFlags("remove", true, true)
+	f.files = true
+	cascade := f.Bool("cascade", false, "also remove what refers to the records")
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	s, err := f.open()
+	if err != nil {
+		return err
+	}
+	defer s.close()
+	var records []*shards.DataRecord
+	if f.given("id") {
+		v := s.db.Get(shards.Shard(*f.shard), shards.Id(*f.id))
+		if v == nil {
+			return fmt.Errorf("object %d:%d: %w", *f.shard, *f.id, shards.ErrNotFound)
+		}
+		records = append(records, v)
+	} else {
+		r, err := input(f.Args())
+		if err != nil {
+			return err
+		}
+		if records, err = readRecords(r); err != nil {
+			return err
+		}
+	}
+	return do(s, shards.ActionRemove, *cascade, records)
+}
 
-	shard := vToRemove.Shard
+func cmdGet(args []string) error {
+	f := newFlags("get", true, true)
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	s, err := f.open()
+	if err != nil {
+		return err
+	}
+	defer s.close()
+	v := s.db.Get(shards.Shard(*f.shard), shards.Id(*f.id))
+	if v == nil {
+		return fmt.Errorf("object %d:%d: %w", *f.shard, *f.id, shards.ErrNotFound)
+	}
+	return printJSON(v)
+}
 
-	if db.State[shard] == nil {
-		db.State[shard] = newState()
+func cmdList(args []string) error {
+	f := newFlags("ls", true, false)
+	after := f.Int64("after", 0, "list ids after this one")
+	limit := f.Int("limit", 1000, "list at most this many")
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	s, err := f.open()
+	if err != nil {
+		return err
 	}
-	st := db.State[shard]
-	id := vToRemove.Id
+	defer s.close()
+	e := json.NewEncoder(os.Stdout)
+	for _, v := range s.db.List(shards.Shard(*f.shard), shards.Id(*after), *limit) {
+		if err := e.Encode(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	v, ok := st.Data[id]
-	if !ok {
-		return nil, fmt.Errorf(
-			"object %d:%d cannot be removed, because it does not exist",
-			shard, id,
-		)
-	}
-	jToRemove := AsJson(vToRemove)
-	hToRemove := sha256.New().Sum([]byte(jToRemove))
-	j := AsJson(v)
-	h := sha256.New().Sum([]byte(j))
-	if bytes.Compare(hToRemove, h) != 0 {
-		return nil, fmt.Errorf(
-			"we are not removing the object %d:%d we think we are removing",
-			shard, id,
-		)
-	}
-	st.sum(h, true)
-	delete(st.Data, id)
-	return v, nil
+func cmdChecksum(args []string) error {
+	f := newFlags("checksum", true, false)
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	s, err := f.open()
+	if err != nil {
+		return err
+	}
+	defer s.close()
+	fmt.Println(s.db.Checksum(shards.Shard(*f.shard)))
+	return nil
 }
 
-func (db *Db) Do(cmd Command) (*DataRecord, error) {
-	var r *DataRecord
-	var err error
-	if cmd.Action == ActionInsert {
-		r, err = db.Insert(cmd.Record)
+func cmdSign(args []string) error {
+	f := newFlags("sign", true, false)
+	if err := f.Parse(args); err != nil {
+		return err
 	}
-	if cmd.Action == ActionRemove {
-		r, err = db.Remove(cmd.Record)
+	s, err := f.open()
+	if err != nil {
+		return err
 	}
+	defer s.close()
+	st, err := s.db.SignChecksum(shards.Shard(*f.shard))
 	if err != nil {
-		log.Printf("error! %v", err)
-		return nil, err
+		return err
 	}
-	log.Printf("%s", AsJson(cmd))
-	return r, err
+	return printJSON(st)
 }
 
-func (db *Db) Checksum(shard Shard) string {
-	db.Lock.Lock()
-	defer db.Lock.Unlock()
-	st, ok := db.State[shard]
-	if !ok {
-		return fmt.Sprintf("%d:,", shard)
-	}
-	return fmt.Sprintf(
-		"%d:%s,%s",
-		shard,
-		hex.EncodeToString(st.Checksum.X.Bytes()),
-		hex.EncodeToString(st.Checksum.Y.Bytes()),
-	)
+// cmdVerify checks a statement's signature, then that the store's replica
+// of the shard is what it states.
+func cmdVerify(args []string) error {
+	f := newFlags("verify", false, false)
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	r, err := input(f.Args())
+	if err != nil {
+		return err
+	}
+	st := &shards.SignedChecksum{}
+	if err := json.NewDecoder(r).Decode(st); err != nil {
+		return err
+	}
+	s, err := f.open()
+	if err != nil {
+		return err
+	}
+	defer s.close()
+	if err := s.db.VerifyChecksum(st); err != nil {
+		return err
+	}
+	if err := s.saveAccepted(); err != nil {
+		return err
+	}
+	local, err := s.db.Statement(st.Shard)
+	if err != nil {
+		return err
+	}
+	if local.Seq != st.Seq || !bytes.Equal(local.Checksum, st.Checksum) {
+		return fmt.Errorf("shard %d is at %d %s, not %d %s: %w", st.Shard, local.Seq, local, st.Seq, st, shards.ErrMismatch)
+	}
+	fmt.Printf("verified %s at %d\n", st, st.Seq)
+	return nil
 }
 
-func (db *Db) Sign(shard Shard) (Point, error) {
-	h := sha256.New().Sum([]byte(db.Checksum(shard)))
-	r, s, err := ecdsa.Sign(rand.Reader, db.State[shard].KeyPair, h)
-	return Point{X: r, Y: s}, err
+func cmdExport(args []string) error {
+	f := newFlags("export", true, false)
+	out := f.String("o", "", "write the snapshot to this file instead of stdout")
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	s, err := f.open()
+	if err != nil {
+		return err
+	}
+	defer s.close()
+	var b bytes.Buffer
+	if err := s.db.WriteSnapshot(shards.Shard(*f.shard), &b); err != nil {
+		return err
+	}
+	if *out == "" {
+		_, err = os.Stdout.Write(b.Bytes())
+		return err
+	}
+	return ioutil.WriteFile(*out, b.Bytes(), 0600)
 }
 
-func (db *Db) Verify(shard Shard, sig Point) bool {
-	h := sha256.New().Sum([]byte(db.Checksum(shard)))
-	r := sig.X
-	s := sig.Y
-	return ecdsa.Verify(&db.State[shard].KeyPair.PublicKey, h, r, s)
+// cmdImport loads a snapshot into the store, and compacts it into the log so
+// that it stays.  The statement in the snapshot must verify against the
+// shard's public key, if the store has it, and not be older than the last
+// one the store accepted; -statement also checks it against the one given.
+func cmdImport(args []string) error {
+	f := newFlags("import", false, false)
+	statement := f.String("statement", "", "the writer's signed statement of the snapshot's checksum")
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	r, err := input(f.Args())
+	if err != nil {
+		return err
+	}
+	s, err := f.open()
+	if err != nil {
+		return err
+	}
+	defer s.close()
+	shard, err := s.db.LoadSnapshot(r)
+	if err != nil {
+		return err
+	}
+	if *statement != "" {
+		b, err := ioutil.ReadFile(*statement)
+		if err != nil {
+			return err
+		}
+		st := &shards.SignedChecksum{}
+		if err := json.Unmarshal(b, st); err != nil {
+			return err
+		}
+		if st.Shard != shard {
+			return fmt.Errorf("statement is for shard %d, snapshot for %d: %w", st.Shard, shard, shards.ErrMismatch)
+		}
+		local, err := s.db.Statement(shard)
+		if err != nil {
+			return err
+		}
+		if local.Seq != st.Seq || !bytes.Equal(local.Checksum, st.Checksum) {
+			return fmt.Errorf("statement is of %d %s, snapshot of %d %s: %w", st.Seq, st, local.Seq, local, shards.ErrMismatch)
+		}
+		if err := s.db.VerifyChecksum(st); err != nil {
+			return err
+		}
+	}
+	if err := s.db.Compact(shard); err != nil {
+		return err
+	}
+	if err := s.saveAccepted(); err != nil {
+		return err
+	}
+	fmt.Printf("imported %s\n", s.db.Checksum(shard))
+	return nil
 }
 
-func (db *Db) Get(shard Shard, id Id) *DataRecord {
-	return db.State[shard].Data[id]
+func cmdTrust(args []string) error {
+	f := newFlags("trust", false, false)
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	r, err := input(f.Args())
+	if err != nil {
+		return err
+	}
+	s, err := f.open()
+	if err != nil {
+		return err
+	}
+	defer s.close()
+	if err := s.db.ImportPublicKeys(r); err != nil {
+		return err
+	}
+	return s.savePublicKeys()
 }
 
-func main() {
-	dbShard := Shard(22)
-	db, err := NewDB(dbShard)
+func cmdKeys(args []string) error {
+	f := newFlags("keys", false, false)
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	s, err := f.open()
 	if err != nil {
-		panic(err)
+		return err
 	}
-	fmt.Printf("initial checksum: %s\n\n", db.Checksum(dbShard))
+	defer s.close()
+	return s.db.ExportPublicKeys(os.Stdout)
+}
 
-	dbShard_1, _ := db.Do(Command{
-		Action: ActionInsert,
-		Record: &DataRecord{
-			Shard: dbShard,
-			TTL:   20,
-		},
-	})
-	fmt.Printf("id1: %s\n\n", db.Checksum(dbShard))
-	sig, err := db.Sign(dbShard)
+func cmdServe(args []string) error {
+	f := newFlags("serve", false, false)
+	addr := f.String("addr", ":8080", "address to listen on")
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	s, err := f.open()
 	if err != nil {
-		panic(err)
+		return err
 	}
-	fmt.Printf("sign %d: %s\n\n", dbShard, AsJson(sig))
-
-	dbShard_2, _ := db.Do(Command{
-		Action: ActionInsert,
-		Record: &DataRecord{
-			Shard: dbShard,
-			TTL:   21,
-		},
-	})
-	fmt.Printf("id1+id2: %s\n\n", db.Checksum(dbShard))
-
-	db.Do(Command{
-		Action: ActionRemove,
-		Record: db.Get(dbShard, dbShard_2.Id),
-	})
-	fmt.Printf("id1: %s\n\n", db.Checksum(dbShard))
-
-	dbShard2 := Shard(202)
-	db.Do(Command{
-		Action: ActionInsert,
-		Record: &DataRecord{
-			Shard: dbShard2,
-			TTL:   50,
-		},
-	})
-
-	verified := db.Verify(dbShard, sig)
-	fmt.Printf("verify: %t\n\n", verified)
-
-	db.Do(Command{Action: ActionRemove, Record: db.Get(dbShard, 1)})
-	fmt.Printf("empty checksum: %s\n\n", db.Checksum(dbShard))
+	defer s.close()
+	fmt.Fprintf(os.Stderr, "serving %s on %s\n", *f.dir, *addr)
+	return http.ListenAndServe(*addr, server.New(s.db))
+}
 
-	// empty out the other shard
-	db.Do(Command{
-		Action: ActionRemove,
-		Record: db.Get(dbShard2, dbShard_1.Id),
-	})
-	fmt.Printf("shard %d, id1: %s\n\n", dbShard2, db.Checksum(dbShard2))
+func cmdSync(args []string) error {
+	f := newFlags("sync", false, false)
+	peer := f.String("peer", "", "base url of the peer")
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	if *peer == "" {
+		return errors.New("-peer is required")
+	}
+	s, err := f.open()
+	if err != nil {
+		return err
+	}
+	defer s.close()
+	err = s.db.SyncFrom(http.DefaultClient, strings.TrimSuffix(*peer, "/"))
+	if serr := s.saveAccepted(); err == nil {
+		err = serr
+	}
+	return err
 }
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "bc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// bc runs a command, and returns what it wrote to stdout.
+func bc(t *testing.T, args ...string) (string, error) {
+	t.Helper()
+	out, err := ioutil.TempFile("", "bc-out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+	stdout := os.Stdout
+	os.Stdout = out
+	err = commands[args[0]].run(args[1:])
+	os.Stdout = stdout
+	b, rerr := ioutil.ReadFile(out.Name())
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	return string(b), err
+}
+
+// must runs a command that must succeed.
+func must(t *testing.T, args ...string) string {
+	t.Helper()
+	out, err := bc(t, args...)
+	if err != nil {
+		t.Fatalf("bc %s: %v", strings.Join(args, " "), err)
+	}
+	return out
+}
+
+func TestRoundTrip(t *testing.T) {
+	dir := tempDir(t)
+	writer, verifier := filepath.Join(dir, "writer"), filepath.Join(dir, "verifier")
+	file := func(name, content string) string {
+		name = filepath.Join(dir, name)
+		if err := ioutil.WriteFile(name, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return name
+	}
+
+	must(t, "init", "-dir", writer, "-shard", "22")
+	records := file("records.json", `{"shard":22,"ints":{"n":1}} [{"shard":22},{"shard":22,"strings":{"s":"x"}}]`)
+	must(t, "insert", "-dir", writer, records)
+	if out := must(t, "get", "-dir", writer, "-shard", "22", "-id", "3"); !strings.Contains(out, `"s": "x"`) {
+		t.Fatalf("got %s", out)
+	}
+	must(t, "remove", "-dir", writer, "-shard", "22", "-id", "2")
+	checksum := must(t, "checksum", "-dir", writer, "-shard", "22")
+	statement := file("s.json", must(t, "sign", "-dir", writer, "-shard", "22"))
+	must(t, "verify", "-dir", writer, statement)
+	snap := filepath.Join(dir, "22.snap")
+	must(t, "export", "-dir", writer, "-shard", "22", "-o", snap)
+
+	// a verifier that trusts the writer's key takes the snapshot
+	must(t, "init", "-dir", verifier)
+	must(t, "trust", "-dir", verifier, file("keys.pem", must(t, "keys", "-dir", writer)))
+	must(t, "import", "-dir", verifier, "-statement", statement, snap)
+	if got := must(t, "checksum", "-dir", verifier, "-shard", "22"); got != checksum {
+		t.Fatalf("the verifier has %s, expected %s", got, checksum)
+	}
+	if out := must(t, "verify", "-dir", verifier, statement); !strings.HasPrefix(out, "verified ") {
+		t.Fatalf("got %s", out)
+	}
+	if out := must(t, "ls", "-dir", verifier, "-shard", "22"); strings.Count(out, "\n") != 2 {
+		t.Fatalf("the verifier lists\n%s", out)
+	}
+
+	// the verifier can't be written to, and the writer keeps its key
+	if _, err := bc(t, "insert", "-dir", verifier, records); err == nil {
+		t.Fatal("the verifier took an insert")
+	}
+	if _, err := bc(t, "trust", "-dir", writer, filepath.Join(verifier, "pubkeys.pem")); err != nil {
+		t.Fatal(err)
+	}
+	must(t, "insert", "-dir", writer, records)
+}
+
+func TestMissingFlags(t *testing.T) {
+	dir := tempDir(t)
+	must(t, "init", "-dir", dir, "-shard", "1")
+	for _, c := range []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"get", "-dir", dir, "-id", "1"}, "-shard is required"},
+		{[]string{"get", "-dir", dir, "-shard", "1"}, "-id is required"},
+		{[]string{"remove", "-dir", dir, "-shard", "1"}, "-id is required"},
+		{[]string{"checksum", "-dir", dir}, "-shard is required"},
+		{[]string{"get", "-dir", filepath.Join(dir, "missing"), "-shard", "1", "-id", "1"}, "no store"},
+	} {
+		if _, err := bc(t, c.args...); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Fatalf("bc %s: got %v, expected %q", strings.Join(c.args, " "), err, c.err)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+// Package server serves a shards.Db over HTTP, with JSON bodies:
+//
+//  POST /commands               a command, or a list of them as one batch
+//  GET  /records/{shard}        the shard's records in id order,
+//                               ?after=id&limit=n pages through them
+//  GET  /records/{shard}/{id}   a record
+//  GET  /checksums/{shard}      the shard's current checksum and version
+//  GET  /statements/{shard}     its latest signed checksum statement
+//  /replication/...             the database's ReplicationHandler
+//
+// A command returns the record it made or removed, and a batch the list of
+// them.  Failures are an Error, with a status and code for each of the
+// shards errors, so clients can tell "already exists" (409, "exists") from
+// "not the object we think we are removing" (412, "mismatch").  A request
+// body over MaxBody bytes is refused (413, "too_large").
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/rfielding/bc/shards"
+)
+
+// DefaultLimit is how many records a page of a shard has unless the request
+// asks for fewer, and MaxLimit the most it can ask for.
+const (
+	DefaultLimit = 100
+	MaxLimit     = 1000
+)
+
+// MaxBody is the largest request body the server reads.
+const MaxBody = 1 << 20
+
+// Error is the body of every failed request.
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"error"`
+}
+
+var codes = []struct {
+	err    error
+	status int
+	code   string
+}{
+	{shards.ErrExists, http.StatusConflict, "exists"},
+	{shards.ErrMismatch, http.StatusPreconditionFailed, "mismatch"},
+	{shards.ErrConflict, http.StatusPreconditionFailed, "conflict"},
+	{shards.ErrNotFound, http.StatusNotFound, "not_found"},
+	{shards.ErrUnknownShard, http.StatusNotFound, "unknown_shard"},
+	{shards.ErrReferenced, http.StatusConflict, "referenced"},
+	{shards.ErrDanglingRef, http.StatusUnprocessableEntity, "dangling_ref"},
+	{shards.ErrShortLease, http.StatusUnprocessableEntity, "short_lease"},
+	{shards.ErrNoRecord, http.StatusBadRequest, "bad_command"},
+	{shards.ErrUnknownAction, http.StatusBadRequest, "bad_command"},
+	{shards.ErrOfferExpired, http.StatusGone, "offer_expired"},
+	{shards.ErrNotExpired, http.StatusConflict, "not_expired"},
+	{shards.ErrBadSignature, http.StatusForbidden, "bad_signature"},
+	{shards.ErrReadOnly, http.StatusForbidden, "read_only"},
+	{shards.ErrNoKey, http.StatusForbidden, "no_key"},
+	{shards.ErrWrongKey, http.StatusForbidden, "wrong_key"},
+	{shards.ErrStale, http.StatusConflict, "stale"},
+	{shards.ErrQuorum, http.StatusForbidden, "quorum"},
+	{shards.ErrNonCanonical, http.StatusBadRequest, "non_canonical"},
+}
+
+// errBadRequest is a request the server can't make sense of, and
+// errTooLarge one with a body over MaxBody.
+var (
+	errBadRequest = errors.New("bad request")
+	errTooLarge   = errors.New("request body is too large")
+)
+
+// Status returns the HTTP status and code that an error is served with.
+func Status(err error) (int, string) {
+	if errors.Is(err, errBadRequest) {
+		return http.StatusBadRequest, "bad_request"
+	}
+	if errors.Is(err, errTooLarge) {
+		return http.StatusRequestEntityTooLarge, "too_large"
+	}
+	for _, c := range codes {
+		if errors.Is(err, c.err) {
+			return c.status, c.code
+		}
+	}
+	return http.StatusInternalServerError, "internal"
+}
+
+type server struct {
+	db *shards.Db
+}
+
+// New returns a handler that serves db.
+func New(db *shards.Db) http.Handler {
+	s := &server{db: db}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/commands", s.commands)
+	mux.HandleFunc("/records/", s.records)
+	mux.HandleFunc("/checksums/", s.checksums)
+	mux.HandleFunc("/statements/", s.statements)
+	mux.Handle("/replication/", db.ReplicationHandler())
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, MaxBody)
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status, code := Status(err)
+	writeJSON(w, status, Error{Code: code, Message: err.Error()})
+}
+
+func allow(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeJSON(w, http.StatusMethodNotAllowed, Error{Code: "method", Message: r.Method + " is not allowed"})
+		return false
+	}
+	return true
+}
+
+// path splits what follows prefix in the request's path into a shard and,
+// if there are n of them, an id.
+func path(r *http.Request, prefix string, n int) (shards.Shard, shards.Id, error) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, prefix), "/"), "/")
+	if len(parts) != n {
+		return 0, 0, fmt.Errorf("%s: %w", r.URL.Path, errBadRequest)
+	}
+	shard, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("shard %q: %w", parts[0], errBadRequest)
+	}
+	var id int64
+	if n > 1 {
+		if id, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("id %q: %w", parts[1], errBadRequest)
+		}
+	}
+	return shards.Shard(shard), shards.Id(id), nil
+}
+
+func (s *server) commands(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodPost) {
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, fmt.Errorf("%v: %w", err, errTooLarge))
+		return
+	}
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		var b shards.Batch
+		if err := json.Unmarshal(body, &b.Commands); err != nil {
+			writeError(w, fmt.Errorf("%v: %w", err, errBadRequest))
+			return
+		}
+		// a client doesn't choose when its commands happen
+		for i := range b.Commands {
+			b.Commands[i].At = 0
+		}
+		records, err := s.db.DoBatch(b)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, records)
+		return
+	}
+	var cmd shards.Command
+	if err := json.Unmarshal(body, &cmd); err != nil {
+		writeError(w, fmt.Errorf("%v: %w", err, errBadRequest))
+		return
+	}
+	cmd.At = 0
+	v, err := s.db.Do(cmd)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, v)
+}
+
+func (s *server) records(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+	if strings.Count(strings.Trim(r.URL.Path, "/"), "/") == 2 {
+		shard, id, err := path(r, "/records/", 2)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		v := s.db.Get(shard, id)
+		if v == nil {
+			writeError(w, fmt.Errorf("object %d:%d: %w", shard, id, shards.ErrNotFound))
+			return
+		}
+		writeJSON(w, http.StatusOK, v)
+		return
+	}
+	shard, _, err := path(r, "/records/", 1)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	q := r.URL.Query()
+	after, limit := int64(0), DefaultLimit
+	if a := q.Get("after"); a != "" {
+		if after, err = strconv.ParseInt(a, 10, 64); err != nil {
+			writeError(w, fmt.Errorf("after %q: %w", a, errBadRequest))
+			return
+		}
+	}
+	if l := q.Get("limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil || limit < 1 || limit > MaxLimit {
+			writeError(w, fmt.Errorf("limit %q is not from 1 to %d: %w", l, MaxLimit, errBadRequest))
+			return
+		}
+	}
+	records := s.db.List(shard, shards.Id(after), limit)
+	if records == nil {
+		records = []*shards.DataRecord{}
+	}
+	writeJSON(w, http.StatusOK, records)
+}
+
+// Checksum is a shard's current checksum, formatted as by shards.Db.Checksum,
+// and its version.
+type Checksum struct {
+	Shard    shards.Shard `json:"shard"`
+	Checksum string       `json:"checksum"`
+	Version  int64        `json:"version,omitempty"`
+}
+
+func (s *server) checksums(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+	shard, _, err := path(r, "/checksums/", 1)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	st, err := s.db.Statement(shard)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, Checksum{Shard: shard, Checksum: st.String(), Version: st.Seq})
+}
+
+// statements signs a statement now if the database writes the shard, and
+// otherwise returns the last one it accepted.
+func (s *server) statements(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+	shard, _, err := path(r, "/statements/", 1)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	st, err := s.db.SignChecksum(shard)
+	if errors.Is(err, shards.ErrNoKey) {
+		if st = s.db.LastChecksum(shard); st == nil {
+			err = fmt.Errorf("shard %d has no signed checksum: %w", shard, shards.ErrNotFound)
+		} else {
+			err = nil
+		}
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, st)
+}
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rfielding/bc/shards"
+)
+
+var testKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+func testServer(t *testing.T) (*shards.Db, string) {
+	db, err := shards.NewDB(1, shards.WithAlgorithm(shards.LtHash16), shards.WithKeyPair(1, testKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(New(db))
+	t.Cleanup(srv.Close)
+	return db, srv.URL
+}
+
+// do makes a request, checks its status and decodes the reply into v.
+func do(t *testing.T, method, url, body string, status int, v interface{}) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != status {
+		var e Error
+		json.NewDecoder(resp.Body).Decode(&e)
+		t.Fatalf("%s %s: %d %v, expected %d", method, url, resp.StatusCode, e, status)
+	}
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// fails checks that a request fails with a status and code.
+func fails(t *testing.T, method, url, body string, status int, code string) {
+	t.Helper()
+	var e Error
+	do(t, method, url, body, status, &e)
+	if e.Code != code || e.Message == "" {
+		t.Fatalf("%s %s: %+v, expected code %s", method, url, e, code)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	db, url := testServer(t)
+	var v shards.DataRecord
+	do(t, "POST", url+"/commands", `{"record":{"shard":1,"ints":{"n":1}}}`, http.StatusOK, &v)
+	if v.Shard != 1 || v.Id != 1 || db.Get(1, 1) == nil {
+		t.Fatalf("inserted %+v", v)
+	}
+	var batch []shards.DataRecord
+	do(t, "POST", url+"/commands", `[{"record":{"shard":1}},{"record":{"shard":1}}]`, http.StatusOK, &batch)
+	if len(batch) != 2 || batch[1].Id != 3 {
+		t.Fatalf("batch %+v", batch)
+	}
+
+	fails(t, "POST", url+"/commands", `{"record":{"shard":1,"id":1}}`, http.StatusConflict, "exists")
+	// the record stored as 1 has n 1
+	fails(t, "POST", url+"/commands", `{"action":1,"record":{"shard":1,"id":1,"ints":{"n":2}}}`, http.StatusPreconditionFailed, "mismatch")
+	fails(t, "POST", url+"/commands", `{"action":1,"record":{"shard":1,"id":9}}`, http.StatusNotFound, "not_found")
+	fails(t, "POST", url+"/commands", `{"action":99,"record":{"shard":1}}`, http.StatusBadRequest, "bad_command")
+	fails(t, "POST", url+"/commands", `{"record":`, http.StatusBadRequest, "bad_request")
+	fails(t, "POST", url+"/commands", ``, http.StatusBadRequest, "bad_request")
+	fails(t, "GET", url+"/commands", ``, http.StatusMethodNotAllowed, "method")
+	big := fmt.Sprintf(`{"record":{"shard":1,"strings":{"s":%q}}}`, strings.Repeat("x", MaxBody))
+	fails(t, "POST", url+"/commands", big, http.StatusRequestEntityTooLarge, "too_large")
+
+	do(t, "POST", url+"/commands", `{"action":1,"record":{"shard":1,"id":1,"ints":{"n":1}}}`, http.StatusOK, &v)
+	if db.Get(1, 1) != nil {
+		t.Fatal("the record was not removed")
+	}
+}
+
+func TestCommandTimeIgnored(t *testing.T) {
+	clock := &shards.LogicalClock{}
+	db, err := shards.NewDB(1, shards.WithAlgorithm(shards.LtHash16), shards.WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(New(db))
+	defer srv.Close()
+
+	from, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	to, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	pkix, err := x509.MarshalPKIXPublicKey(&to.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := &shards.Offer{
+		Shard:    1,
+		Id:       1,
+		Expires:  50,
+		Commands: []shards.Command{{Record: &shards.DataRecord{Shard: 1, Id: 7}}},
+		To:       pkix,
+	}
+	if err := o.Sign(from); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Offer(o); err != nil {
+		t.Fatal(err)
+	}
+	a, err := shards.AcceptOffer(o, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.Set(100)
+
+	// an accept that claims to be from before the offer expired is too late
+	cmd := shards.AsJson(shards.Command{Action: shards.ActionAccept, Accept: a, At: 1})
+	fails(t, "POST", srv.URL+"/commands", cmd, http.StatusGone, "offer_expired")
+	fails(t, "POST", srv.URL+"/commands", "["+cmd+"]", http.StatusGone, "offer_expired")
+	if db.Get(1, 7) != nil {
+		t.Fatal("the expired offer was accepted")
+	}
+}
+
+func TestRecords(t *testing.T) {
+	db, url := testServer(t)
+	for i := 0; i < 5; i++ {
+		if _, err := db.Insert(&shards.DataRecord{Shard: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var v shards.DataRecord
+	do(t, "GET", url+"/records/1/3", "", http.StatusOK, &v)
+	if v.Id != 3 {
+		t.Fatalf("got %+v", v)
+	}
+	fails(t, "GET", url+"/records/1/9", "", http.StatusNotFound, "not_found")
+	fails(t, "GET", url+"/records/x/1", "", http.StatusBadRequest, "bad_request")
+	fails(t, "POST", url+"/records/1/1", "", http.StatusMethodNotAllowed, "method")
+
+	var page []shards.DataRecord
+	do(t, "GET", url+"/records/1?after=1&limit=2", "", http.StatusOK, &page)
+	if len(page) != 2 || page[0].Id != 2 || page[1].Id != 3 {
+		t.Fatalf("page %+v", page)
+	}
+	do(t, "GET", url+"/records/1?after=3", "", http.StatusOK, &page)
+	if len(page) != 2 || page[1].Id != 5 {
+		t.Fatalf("page %+v", page)
+	}
+	do(t, "GET", url+"/records/7", "", http.StatusOK, &page)
+	if len(page) != 0 {
+		t.Fatalf("page %+v", page)
+	}
+	fails(t, "GET", url+"/records/1?limit=0", "", http.StatusBadRequest, "bad_request")
+	fails(t, "GET", url+"/records/1?after=x", "", http.StatusBadRequest, "bad_request")
+}
+
+func TestChecksumsAndStatements(t *testing.T) {
+	db, url := testServer(t)
+	if _, err := db.Insert(&shards.DataRecord{Shard: 1}); err != nil {
+		t.Fatal(err)
+	}
+	var ck Checksum
+	do(t, "GET", url+"/checksums/1", "", http.StatusOK, &ck)
+	if ck.Checksum != db.Checksum(1) || ck.Version != 1 {
+		t.Fatalf("got %+v", ck)
+	}
+	fails(t, "GET", url+"/checksums/9", "", http.StatusNotFound, "unknown_shard")
+
+	var s shards.SignedChecksum
+	do(t, "GET", url+"/statements/1", "", http.StatusOK, &s)
+	v, _ := shards.NewVerifier(shards.WithAlgorithm(shards.LtHash16), shards.WithPublicKey(1, &testKey.PublicKey))
+	if err := v.VerifyChecksum(&s); err != nil || s.Seq != 1 {
+		t.Fatalf("statement %d: %v", s.Seq, err)
+	}
+
+	// a verifier serves the last statement it accepted
+	srv := httptest.NewServer(New(v))
+	defer srv.Close()
+	var last shards.SignedChecksum
+	do(t, "GET", srv.URL+"/statements/1", "", http.StatusOK, &last)
+	if !bytes.Equal(last.Checksum, s.Checksum) {
+		t.Fatal("the verifier served a different statement")
+	}
+	fails(t, "GET", srv.URL+"/statements/2", "", http.StatusNotFound, "not_found")
+	fails(t, "POST", srv.URL+"/commands", `{"record":{"shard":1}}`, http.StatusForbidden, "read_only")
+
+	var summaries []shards.ShardSummary
+	do(t, "GET", url+"/replication/shards", "", http.StatusOK, &summaries)
+	if len(summaries) != 1 || summaries[0].Version != 1 {
+		t.Fatalf("got %+v", summaries)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	for _, c := range []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{shards.ErrExists, http.StatusConflict, "exists"},
+		{shards.ErrMismatch, http.StatusPreconditionFailed, "mismatch"},
+		{shards.ErrQuorum, http.StatusForbidden, "quorum"},
+		{shards.ErrNonCanonical, http.StatusBadRequest, "non_canonical"},
+		{errTooLarge, http.StatusRequestEntityTooLarge, "too_large"},
+		{fmt.Errorf("something else"), http.StatusInternalServerError, "internal"},
+	} {
+		status, code := Status(fmt.Errorf("shard 1: %w", c.err))
+		if status != c.status || code != c.code {
+			t.Fatalf("%v: %d %s, expected %d %s", c.err, status, code, c.status, c.code)
+		}
+	}
+}
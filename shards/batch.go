@@ -0,0 +1,223 @@
+package shards
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Batch is a list of commands, possibly across shards, that are applied all
+// together or not at all.  Every command is checked before any of them is
+// applied, and if one of them fails, the changes made by the ones before it
+// are rolled back, checksums included.  A batch is logged as one frame, in
+// the log of every shard it touches, and one across shards is only replayed
+// if it was committed to the WAL's commit log too.
+type Batch struct {
+	Commands []Command `json:"commands,omitempty"`
+}
+
+const kindBatch = byte(5)
+
+const tagBatchCommands = byte(1)
+
+// MarshalBinary returns the canonical encoding of the batch: its commands
+// field is a 4 byte count, then each command's encoding, length prefixed
+// with 4 bytes.
+func (b *Batch) MarshalBinary() ([]byte, error) {
+	e := &encBuf{b: []byte{EncodingVersion, kindBatch}}
+	if len(b.Commands) == 0 {
+		return e.b, nil
+	}
+	if err := e.commandsField(tagBatchCommands, b.Commands); err != nil {
+		return nil, err
+	}
+	return e.b, nil
+}
+
+// commandsField appends a list of commands: a 4 byte count, then each
+// command's encoding, length prefixed with 4 bytes.
+func (e *encBuf) commandsField(tag byte, commands []Command) error {
+	cmds := make([][]byte, len(commands))
+	for i := range commands {
+		c, err := commands[i].MarshalBinary()
+		if err != nil {
+			return err
+		}
+		cmds[i] = c
+	}
+	e.field(tag, func(e *encBuf) {
+		e.u32(len(cmds))
+		for _, c := range cmds {
+			e.str(string(c))
+		}
+	})
+	return nil
+}
+
+// commands reads a list of commands written by commandsField.
+func (d *decBuf) commands(tag byte) []Command {
+	n := d.u32()
+	if n == 0 {
+		d.fail("field %d is empty", tag)
+	}
+	var cmds []Command
+	for i := 0; i < n && d.err == nil; i++ {
+		var cmd Command
+		if err := cmd.UnmarshalBinary(d.take(d.u32())); err != nil && d.err == nil {
+			d.err = err
+		}
+		cmds = append(cmds, cmd)
+	}
+	return cmds
+}
+
+// UnmarshalBinary parses a canonical encoding of a batch.
+func (b *Batch) UnmarshalBinary(p []byte) error {
+	*b = Batch{}
+	d := &decBuf{b: p}
+	d.header(kindBatch)
+	d.fields(func(tag byte, f *decBuf) bool {
+		if tag != tagBatchCommands {
+			return false
+		}
+		b.Commands = f.commands(tag)
+		return true
+	})
+	return d.err
+}
+
+// shards lists the shards that the commands touch, in order.
+func (b *Batch) shards() []Shard {
+	seen := make(map[Shard]bool)
+	var ids []Shard
+	for _, cmd := range b.Commands {
+		if shard, ok := cmd.shard(); ok && !seen[shard] {
+			seen[shard] = true
+			ids = append(ids, shard)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// validate checks everything about a command that doesn't depend on the
+// state of the database.
+func (cmd *Command) validate() error {
+	switch cmd.Action {
+	case ActionOffer, ActionWithdraw:
+		if cmd.Offer == nil {
+			return fmt.Errorf("action %d without an offer: %w", cmd.Action, ErrNoRecord)
+		}
+		if cmd.Offer.Id < 0 {
+			return fmt.Errorf("offer %d:%d has a negative id: %w", cmd.Offer.Shard, cmd.Offer.Id, ErrNoRecord)
+		}
+		return nil
+	case ActionAccept:
+		if cmd.Accept == nil {
+			return fmt.Errorf("action %d without an acceptance: %w", cmd.Action, ErrNoRecord)
+		}
+		return nil
+	case ActionRotate:
+		if cmd.Handoff == nil {
+			return fmt.Errorf("action %d without a handoff: %w", cmd.Action, ErrNoRecord)
+		}
+		return nil
+	}
+	if cmd.Record == nil {
+		return ErrNoRecord
+	}
+	// snapshots only hold records from 1 up, and 0 asks for the next id
+	if cmd.Record.Id < 0 {
+		return fmt.Errorf("record %d:%d has a negative id: %w", cmd.Record.Shard, cmd.Record.Id, ErrNoRecord)
+	}
+	switch cmd.Action {
+	case ActionInsert, ActionRemove, ActionRenew:
+	case ActionTouch:
+		return fmt.Errorf("action %d is only logged: %w", cmd.Action, ErrUnknownAction)
+	case ActionReplace:
+		if len(cmd.Expect) == 0 {
+			return fmt.Errorf("replace of %d:%d without an expected digest: %w", cmd.Record.Shard, cmd.Record.Id, ErrConflict)
+		}
+	default:
+		return fmt.Errorf("action %d: %w", cmd.Action, ErrUnknownAction)
+	}
+	return nil
+}
+
+// DoBatch applies the commands of a batch atomically, and returns the record
+// that each one returned.  The commands are applied at the time on the
+// database's clock, whatever their At.
+func (db *Db) DoBatch(b Batch) ([]*DataRecord, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return db.doBatch(b, db.clock.Now())
+}
+
+// doBatch applies the commands of a batch at now.
+func (db *Db) doBatch(b Batch, now int64) ([]*DataRecord, error) {
+	if db.readOnly {
+		return nil, ErrReadOnly
+	}
+	for i := range b.Commands {
+		if err := b.Commands[i].validate(); err != nil {
+			db.logger.Printf("error! command %d: %v", i, err)
+			return nil, fmt.Errorf("command %d: %w", i, err)
+		}
+	}
+	t := &tx{}
+	results := make([]*DataRecord, len(b.Commands))
+	var applied []Command
+	var err error
+	for i, cmd := range b.Commands {
+		cmd.At = now
+		cmds := []Command{cmd}
+		if cmd.Action == ActionRemove && cmd.Cascade {
+			cmds = db.cascade(cmd)
+			t.cascade = make(map[Reference]bool)
+			for _, c := range cmds {
+				t.cascade[refOf(c.Record)] = true
+			}
+		}
+		for _, c := range cmds {
+			if results[i], err = db.apply(t, c); err != nil {
+				break
+			}
+		}
+		t.cascade = nil
+		// the records that the command referred to in other shards
+		touches := t.touches
+		t.touches = nil
+		sort.Slice(touches, func(i, j int) bool {
+			a, b := touches[i].Record, touches[j].Record
+			return a.Shard < b.Shard || (a.Shard == b.Shard && a.Id < b.Id)
+		})
+		for _, c := range touches {
+			if err == nil {
+				_, err = db.apply(t, c)
+			}
+		}
+		cmds = append(cmds, touches...)
+		if err != nil {
+			if len(b.Commands) > 1 {
+				err = fmt.Errorf("command %d: %w", i, err)
+			}
+			break
+		}
+		applied = append(applied, cmds...)
+	}
+	if err == nil && db.wal != nil {
+		if len(applied) == 1 {
+			err = db.wal.Append(applied[0])
+		} else {
+			err = db.wal.AppendBatch(Batch{Commands: applied})
+		}
+	}
+	if err != nil {
+		t.rollback()
+		db.logger.Printf("error! %v", err)
+		return nil, err
+	}
+	for _, c := range applied {
+		db.logger.Printf("%s", AsJson(c))
+	}
+	return results, nil
+}
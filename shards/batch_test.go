@@ -0,0 +1,122 @@
+package shards
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func crossShard(ids ...Shard) Batch {
+	var b Batch
+	for _, shard := range ids {
+		b.Commands = append(b.Commands, Command{Action: ActionInsert, Record: &DataRecord{Shard: shard}})
+	}
+	return b
+}
+
+func TestBatchAtomic(t *testing.T) {
+	db, _ := NewDB(1, WithAlgorithm(LtHash16))
+	empty := db.Checksum(1)
+	b := crossShard(1, 2)
+	b.Commands = append(b.Commands, Command{Action: ActionInsert, Record: &DataRecord{Shard: 1, Id: 1}})
+	if _, err := db.DoBatch(b); !errors.Is(err, ErrExists) {
+		t.Fatalf("got %v", err)
+	}
+	if db.Checksum(1) != empty || len(db.State[1].Data) != 0 || db.State[1].HighestId != 0 || len(db.State[2].Data) != 0 {
+		t.Fatal("a failed batch was not rolled back")
+	}
+}
+
+func TestBatchLogFailure(t *testing.T) {
+	dir := tempDir(t)
+	db, wal := testDb(t, dir)
+	empty := db.Checksum(1)
+	// shard 2's log can't be created
+	if err := ioutil.WriteFile(filepath.Join(dir, "2"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.DoBatch(crossShard(1, 2)); err == nil {
+		t.Fatal("the batch was logged")
+	}
+	if db.Checksum(1) != empty || len(db.State[1].Data) != 0 {
+		t.Fatal("the batch was not rolled back")
+	}
+	wal.Close()
+
+	again, wal := testDb(t, dir)
+	defer wal.Close()
+	if again.Checksum(1) != empty || again.Get(1, 1) != nil {
+		t.Fatalf("shard 1 replayed part of a failed batch: %s", again.Checksum(1))
+	}
+}
+
+func TestBatchUncommitted(t *testing.T) {
+	dir := tempDir(t)
+	db, wal := testDb(t, dir)
+	if _, err := db.DoBatch(crossShard(1, 2)); err != nil {
+		t.Fatal(err)
+	}
+	// a crash after the batch reached shard 1's log, but before it was
+	// committed
+	b := crossShard(1, 2)
+	e := &encBuf{b: []byte{EncodingVersion, kindLoggedBatch}}
+	e.bytesField(tagLoggedBatchId, make([]byte, batchIdSize))
+	e.bytesField(tagLoggedBatchBatch, canonical(&b))
+	if _, err := wal.write([]Shard{1}, e.b); err != nil {
+		t.Fatal(err)
+	}
+	wal.Close()
+
+	again, wal := testDb(t, dir)
+	sameShard(t, db, again, 1)
+	sameShard(t, db, again, 2)
+	// the log carries on after the uncommitted batch
+	if _, err := again.DoBatch(crossShard(1, 2)); err != nil {
+		t.Fatal(err)
+	}
+	wal.Close()
+	third, wal := testDb(t, dir)
+	sameShard(t, again, third, 1)
+	sameShard(t, again, third, 2)
+	if len(third.State[1].Data) != 2 || len(third.State[2].Data) != 2 {
+		t.Fatal("committed batches were not replayed")
+	}
+	wal.Close()
+}
+
+func TestBatchCommitsPruned(t *testing.T) {
+	dir := tempDir(t)
+	db, wal := testDb(t, dir)
+	for i := 0; i < 3; i++ {
+		if _, err := db.DoBatch(crossShard(1, 2)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Compact(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.DoBatch(crossShard(1, 2)); err != nil {
+		t.Fatal(err)
+	}
+	wal.Close()
+	again, wal := testDb(t, dir)
+	sameShard(t, db, again, 1)
+	sameShard(t, db, again, 2)
+	// shard 2's log still has all four
+	if info, err := os.Stat(filepath.Join(dir, "commits.log")); err != nil || info.Size() != 4*(frameHeader+batchIdSize) {
+		t.Fatalf("commit log %v, %v", info, err)
+	}
+	if err := again.Compact(2); err != nil {
+		t.Fatal(err)
+	}
+	wal.Close()
+	third, wal := testDb(t, dir)
+	defer wal.Close()
+	sameShard(t, db, third, 1)
+	sameShard(t, db, third, 2)
+	if info, err := os.Stat(filepath.Join(dir, "commits.log")); err != nil || info.Size() != frameHeader+batchIdSize {
+		t.Fatalf("commit log %v, %v", info, err)
+	}
+}
@@ -0,0 +1,332 @@
+package shards
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// Point sums are additive, so a shard's checksum is also the sum of the
+// checksums of its id ranges.  A shard keeps them as a tree of buckets: a
+// leaf covers 128 ids, each level above covers 256 buckets of the one below,
+// and the root, at level 7, covers every id and has the shard's checksum.  A
+// bucket sums the records, pending removals and open offers with the ids it
+// covers.  Two replicas that disagree on a shard compare the children of the
+// buckets they disagree on, from the root down, and so narrow the difference
+// to the leaves that hold it in 7 round trips.
+//
+// The tree is built the first time it is needed, and kept from then on: a
+// change only marks the buckets over its id stale, and they are summed again
+// when they are next read.
+
+const (
+	leafBits   = 7
+	fanoutBits = 8
+	topLevel   = 7
+)
+
+// Bucket is the checksum of the ids from From to To.
+type Bucket struct {
+	Level    int    `json:"level"`
+	Index    int64  `json:"index"`
+	From     Id     `json:"from,omitempty"`
+	To       Id     `json:"to,omitempty"`
+	Checksum []byte `json:"checksum,omitempty"`
+}
+
+type bucketKey struct {
+	level int
+	index int64
+}
+
+func bucketOf(level int, id Id) bucketKey {
+	return bucketKey{level, int64(uint64(id) >> uint(leafBits+fanoutBits*level))}
+}
+
+// span is the first and last id of a bucket.
+func (k bucketKey) span() (Id, Id) {
+	shift := uint(leafBits + fanoutBits*k.level)
+	from := uint64(k.index) << shift
+	return Id(from), Id(from + (uint64(1)<<shift - 1))
+}
+
+func (k bucketKey) child(i int64) bucketKey {
+	return bucketKey{k.level - 1, k.index<<fanoutBits | i}
+}
+
+type bucketTree struct {
+	sums  map[bucketKey]MultisetHash
+	stale map[bucketKey]bool
+}
+
+// invalidate marks the buckets over an id stale.
+func (st *State) invalidate(id Id) {
+	if st.buckets == nil || id <= 0 {
+		return
+	}
+	for level := 0; level <= topLevel; level++ {
+		st.buckets.stale[bucketOf(level, id)] = true
+	}
+}
+
+// tree returns the shard's buckets, building them the first time.
+func (st *State) tree() *bucketTree {
+	if st.buckets == nil {
+		st.buckets = &bucketTree{
+			sums:  make(map[bucketKey]MultisetHash),
+			stale: make(map[bucketKey]bool),
+		}
+		for id := range st.Data {
+			st.invalidate(id)
+		}
+		for id := range st.Pending {
+			st.invalidate(id)
+		}
+		for id := range st.Offers {
+			st.invalidate(id)
+		}
+	}
+	return st.buckets
+}
+
+// addId adds whatever the shard has with an id to sum, and returns how many
+// entries that was.
+func (db *Db) addId(st *State, id Id, sum MultisetHash) int {
+	n := 0
+	if v, ok := st.Data[id]; ok {
+		sum.Add(db.digester.Record(v))
+		n++
+	}
+	if v, ok := st.Pending[id]; ok {
+		sum.Remove(db.digester.Record(v))
+		n++
+	}
+	if o, ok := st.Offers[id]; ok {
+		sum.Add(db.digester.Offer(o))
+		n++
+	}
+	return n
+}
+
+// bucket returns the checksum of a bucket, or nil if it is empty.
+func (db *Db) bucket(st *State, k bucketKey) MultisetHash {
+	bt := st.tree()
+	if !bt.stale[k] {
+		return bt.sums[k]
+	}
+	delete(bt.stale, k)
+	sum, err := NewMultisetHash(st.Algorithm)
+	if err != nil {
+		return nil
+	}
+	n := 0
+	if k.level == 0 {
+		from, to := k.span()
+		for id := from; ; id++ {
+			if id > 0 {
+				n += db.addId(st, id, sum)
+			}
+			if id == to {
+				break
+			}
+		}
+	} else {
+		for i := int64(0); i < 1<<fanoutBits; i++ {
+			if c := db.bucket(st, k.child(i)); c != nil {
+				sum.Combine(c)
+				n++
+			}
+		}
+	}
+	if n == 0 {
+		delete(bt.sums, k)
+		return nil
+	}
+	bt.sums[k] = sum
+	return sum
+}
+
+// RangeChecksum is the checksum of the records, pending removals and open
+// offers of a shard with ids from from to to, inclusive.
+func (db *Db) RangeChecksum(shard Shard, from, to Id) (MultisetHash, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	st, ok := db.State[shard]
+	if !ok {
+		return nil, fmt.Errorf("shard %d: %w", shard, ErrUnknownShard)
+	}
+	sum, err := NewMultisetHash(st.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	db.rangeSum(st, bucketKey{topLevel, 0}, from, to, sum)
+	return sum, nil
+}
+
+func (db *Db) rangeSum(st *State, k bucketKey, from, to Id, sum MultisetHash) {
+	lo, hi := k.span()
+	if hi < from || lo > to {
+		return
+	}
+	if from <= lo && hi <= to {
+		if c := db.bucket(st, k); c != nil {
+			sum.Combine(c)
+		}
+		return
+	}
+	bt := st.tree()
+	if !bt.stale[k] && bt.sums[k] == nil {
+		return
+	}
+	if k.level == 0 {
+		if lo < from {
+			lo = from
+		}
+		if hi > to {
+			hi = to
+		}
+		for id := lo; id <= hi; id++ {
+			db.addId(st, id, sum)
+		}
+		return
+	}
+	for i := int64(0); i < 1<<fanoutBits; i++ {
+		db.rangeSum(st, k.child(i), from, to, sum)
+	}
+}
+
+// RootBucket returns the bucket over every id of a shard.
+func (db *Db) RootBucket(shard Shard) (Bucket, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	st, ok := db.State[shard]
+	if !ok {
+		return Bucket{}, fmt.Errorf("shard %d: %w", shard, ErrUnknownShard)
+	}
+	return db.bucketAt(st, bucketKey{topLevel, 0}), nil
+}
+
+func (db *Db) bucketAt(st *State, k bucketKey) Bucket {
+	b := Bucket{Level: k.level, Index: k.index}
+	b.From, b.To = k.span()
+	if c := db.bucket(st, k); c != nil {
+		b.Checksum = c.Encode()
+	}
+	return b
+}
+
+// Children returns the buckets under b that aren't empty.
+func (db *Db) Children(shard Shard, b Bucket) ([]Bucket, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if b.Level < 1 || b.Level > topLevel {
+		return nil, fmt.Errorf("bucket level %d has no children: %w", b.Level, ErrNotFound)
+	}
+	st, ok := db.State[shard]
+	if !ok {
+		return nil, nil
+	}
+	return db.children(st, bucketKey{b.Level, b.Index}), nil
+}
+
+func (db *Db) children(st *State, k bucketKey) []Bucket {
+	var out []Bucket
+	for i := int64(0); i < 1<<fanoutBits; i++ {
+		if c := db.bucketAt(st, k.child(i)); c.Checksum != nil {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func (db *Db) serveBuckets(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST a list of buckets", http.StatusMethodNotAllowed)
+		return
+	}
+	shard, err := shardParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var parents []Bucket
+	if err := json.NewDecoder(r.Body).Decode(&parents); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	reply := [][]Bucket{}
+	st, ok := db.State[shard]
+	for _, b := range parents {
+		if b.Level < 1 || b.Level > topLevel {
+			http.Error(w, fmt.Sprintf("bucket level %d has no children", b.Level), http.StatusBadRequest)
+			return
+		}
+		var children []Bucket
+		if ok {
+			children = db.children(st, bucketKey{b.Level, b.Index})
+		}
+		reply = append(reply, children)
+	}
+	writeJSON(w, reply)
+}
+
+// Bisect compares a shard with peer's, a level of buckets per round trip,
+// and returns the leaf buckets whose checksums differ, in id order.
+func (db *Db) Bisect(client *http.Client, peer string, shard Shard) ([]Bucket, error) {
+	parents := []Bucket{{Level: topLevel}}
+	var leaves []Bucket
+	for len(parents) > 0 {
+		var remote [][]Bucket
+		if err := postJSON(client, fmt.Sprintf("%s/replication/buckets?shard=%d", peer, shard), parents, &remote); err != nil {
+			return nil, err
+		}
+		if len(remote) != len(parents) {
+			return nil, fmt.Errorf("shard %d peer sent %d lists of buckets for %d: %w", shard, len(remote), len(parents), ErrMismatch)
+		}
+		db.lock.Lock()
+		st := db.State[shard]
+		var next []Bucket
+		for i, p := range parents {
+			var local []Bucket
+			if st != nil {
+				local = db.children(st, bucketKey{p.Level, p.Index})
+			}
+			for _, b := range diffBuckets(local, remote[i]) {
+				if b.Level == 0 {
+					leaves = append(leaves, b)
+				} else {
+					next = append(next, b)
+				}
+			}
+		}
+		db.lock.Unlock()
+		parents = next
+	}
+	sort.Slice(leaves, func(i, j int) bool { return leaves[i].Index < leaves[j].Index })
+	return leaves, nil
+}
+
+// diffBuckets returns the buckets that are in one list and not the other,
+// or in both with different checksums.
+func diffBuckets(a, b []Bucket) []Bucket {
+	other := make(map[int64]Bucket, len(b))
+	for _, x := range b {
+		other[x.Index] = x
+	}
+	var out []Bucket
+	for _, x := range a {
+		y, ok := other[x.Index]
+		if !ok || !bytes.Equal(x.Checksum, y.Checksum) {
+			out = append(out, x)
+		}
+		delete(other, x.Index)
+	}
+	for _, y := range other {
+		out = append(out, y)
+	}
+	return out
+}
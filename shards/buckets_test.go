@@ -0,0 +1,129 @@
+package shards
+
+import (
+	"bytes"
+	"math"
+	"net/http"
+	"testing"
+)
+
+func TestRangeChecksum(t *testing.T) {
+	db := testWriter(t, 300)
+	if _, err := db.Insert(&DataRecord{Shard: 1, Id: 100000}); err != nil {
+		t.Fatal(err)
+	}
+	all, err := db.RangeChecksum(1, 0, 1<<62)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if FormatChecksum(1, all) != db.Checksum(1) {
+		t.Fatal("the range over every id isn't the shard's checksum")
+	}
+	for _, r := range [][2]Id{{1, 1}, {1, 127}, {100, 300}, {128, 255}, {250, 100000}, {301, 99999}} {
+		var records []*DataRecord
+		for id := r[0]; id <= r[1]; id++ {
+			if v := db.Get(1, id); v != nil {
+				records = append(records, v)
+			}
+		}
+		want, _ := ChecksumOf(LtHash16, DefaultDigester, records)
+		got, err := db.RangeChecksum(1, r[0], r[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if FormatChecksum(1, got) != FormatChecksum(1, want) {
+			t.Fatalf("range %d-%d has checksum %s, expected %s", r[0], r[1], FormatChecksum(1, got), FormatChecksum(1, want))
+		}
+	}
+
+	// a change is summed again
+	before, _ := db.RangeChecksum(1, 128, 255)
+	if _, err := db.Remove(db.Get(1, 200)); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := db.RangeChecksum(1, 128, 255)
+	if FormatChecksum(1, before) == FormatChecksum(1, after) {
+		t.Fatal("the removal didn't change the bucket")
+	}
+	all, _ = db.RangeChecksum(1, 0, 1<<62)
+	if FormatChecksum(1, all) != db.Checksum(1) {
+		t.Fatal("the range over every id isn't the shard's checksum after a removal")
+	}
+}
+
+func TestRootIsChecksum(t *testing.T) {
+	db := testWriter(t, 3)
+	root := func() {
+		t.Helper()
+		b, err := db.RootBucket(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b.Checksum, db.State[1].Checksum.Encode()) {
+			t.Fatal("the root bucket isn't the shard's checksum")
+		}
+	}
+	root()
+	// every id that an insert takes, built before and after the tree is
+	for _, id := range []Id{-5, -1, 0, 1 << 7, 1 << 40, 1 << 62, math.MaxInt64} {
+		db.Insert(&DataRecord{Shard: 1, Id: id})
+		root()
+	}
+	for _, id := range []Id{1 << 62, math.MaxInt64} {
+		if _, err := db.Remove(db.Get(1, id)); err != nil {
+			t.Fatal(err)
+		}
+		root()
+	}
+	db.State[1].buckets = nil
+	root()
+}
+
+func TestBisect(t *testing.T) {
+	writer := testWriter(t, 1000)
+	peer := serve(t, writer.ReplicationHandler())
+	replica := testReplica()
+	if err := replica.SyncFrom(http.DefaultClient, peer); err != nil {
+		t.Fatal(err)
+	}
+	leaves, err := replica.Bisect(http.DefaultClient, peer, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leaves) != 0 {
+		t.Fatalf("equal replicas differ in %v", leaves)
+	}
+
+	// a removal in leaf 2, an insert in leaf 7 and one far away
+	if _, err := writer.Remove(writer.Get(1, 300)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.Insert(&DataRecord{Shard: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.Insert(&DataRecord{Shard: 1, Id: 100000}); err != nil {
+		t.Fatal(err)
+	}
+	leaves, err = replica.Bisect(http.DefaultClient, peer, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []int64{300 >> leafBits, 1001 >> leafBits, 100000 >> leafBits}
+	if len(leaves) != len(want) {
+		t.Fatalf("differ in %v, expected leaves %v", leaves, want)
+	}
+	for i, b := range leaves {
+		if b.Level != 0 || b.Index != want[i] || b.From > Id(want[i])<<leafBits || b.To < Id(want[i])<<leafBits {
+			t.Fatalf("differ in %v, expected leaves %v", leaves, want)
+		}
+	}
+
+	// a replica without the shard differs in every leaf: 0 to 7, and 781
+	leaves, err = testReplica().Bisect(http.DefaultClient, peer, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leaves) != 9 {
+		t.Fatalf("an empty replica differs in %d leaves", len(leaves))
+	}
+}
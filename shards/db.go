@@ -0,0 +1,625 @@
+// Package shards is a sharded database whose contents, rather than its event
+// stream, are checksummed.  Every record is hashed to an elliptic curve point
+// and the points are summed per shard, so inserting and later removing a
+// record leaves the checksum as if it had never been there.  A trash
+// compacted shard therefore hashes to the same value as the full event
+// stream, and a signature over that checksum survives garbage collection.
+package shards
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"sort"
+	"sync"
+)
+
+type Db struct {
+	State map[Shard]*State `json:"state,omitempty"`
+
+	lock       sync.Mutex
+	curve      elliptic.Curve
+	algorithm  Algorithm
+	algorithms map[Shard]Algorithm
+	keys       map[Shard]*ecdsa.PrivateKey
+	pubs       map[Shard]*ecdsa.PublicKey
+	accepted   map[Shard]*SignedChecksum
+	quorums    map[Shard]*Quorum
+	cosigned   map[Shard]*QuorumChecksum
+	readOnly   bool
+	digester   Digester
+	logger     *log.Logger
+	wal        *WAL
+	clock      Clock
+	idle       int64
+	refs       refIndex
+	pending    bool
+	indexes    map[indexKey]bool
+}
+
+// Option configures a Db in NewDB.
+type Option func(db *Db)
+
+// WithCurve selects the curve used for shard keys.  The default is P-521.
+func WithCurve(curve elliptic.Curve) Option {
+	return func(db *Db) {
+		db.curve = curve
+	}
+}
+
+// WithAlgorithm selects the multiset hash used for shard checksums.
+// The default is ECMHP521.
+func WithAlgorithm(alg Algorithm) Option {
+	return func(db *Db) {
+		db.algorithm = alg
+	}
+}
+
+// WithShardAlgorithm overrides the multiset hash for one shard, so that busy
+// shards can use a faster hash and others a more compact one.
+func WithShardAlgorithm(shard Shard, alg Algorithm) Option {
+	return func(db *Db) {
+		db.algorithms[shard] = alg
+	}
+}
+
+// WithDigest selects the hash used for record digests.  The default is
+// SHA-256.  The hash must be linked into the binary, eg: crypto/sha512.
+func WithDigest(h crypto.Hash) Option {
+	return func(db *Db) {
+		db.digester = Digester{Hash: h}
+	}
+}
+
+// WithKeyPair sets the signing key of a shard, so that a database that is
+// reopened can verify its snapshots and keep signing as the same writer.
+func WithKeyPair(shard Shard, kp *ecdsa.PrivateKey) Option {
+	return func(db *Db) {
+		db.keys[shard] = kp
+	}
+}
+
+// WithPublicKey registers the public key of a shard's writer, so that its
+// signatures can be verified without its private key.
+func WithPublicKey(shard Shard, pub *ecdsa.PublicKey) Option {
+	return func(db *Db) {
+		db.pubs[shard] = pub
+	}
+}
+
+// WithWAL logs every command to w before Do returns.
+func WithWAL(w *WAL) Option {
+	return func(db *Db) {
+		db.wal = w
+	}
+}
+
+// WithClock sets the clock that TTLs are measured against.  The default is
+// a LogicalClock starting at 0.
+func WithClock(c Clock) Option {
+	return func(db *Db) {
+		db.clock = c
+	}
+}
+
+// WithIdleTimeout expires records that nobody has inserted, renewed or
+// referenced in the last idle ticks of the clock, whatever their TTL.
+func WithIdleTimeout(idle int64) Option {
+	return func(db *Db) {
+		db.idle = idle
+	}
+}
+
+// WithPendingRemoves lets a remove arrive before the insert of its record.
+// The removal is held as a negative count, and the insert cancels it when it
+// lands, so replicas that apply the same commands in any order converge to
+// the same checksum.
+func WithPendingRemoves() Option {
+	return func(db *Db) {
+		db.pending = true
+	}
+}
+
+// WithLogger logs every command applied by Do.  Nothing is logged by default.
+func WithLogger(logger *log.Logger) Option {
+	return func(db *Db) {
+		db.logger = logger
+	}
+}
+
+// NewDB creates a database that holds the signing key for shard.
+func NewDB(shard Shard, opts ...Option) (*Db, error) {
+	db, err := newDB(opts)
+	if err != nil {
+		return nil, err
+	}
+	if db.keys[shard] == nil {
+		kp, err := ecdsa.GenerateKey(db.curve, rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		db.keys[shard] = kp
+	}
+	for s, kp := range db.keys {
+		if db.pubs[s] == nil {
+			db.pubs[s] = &kp.PublicKey
+		}
+	}
+	for s, kp := range db.keys {
+		st, err := db.state(s)
+		if err != nil {
+			return nil, err
+		}
+		st.KeyPair = kp
+	}
+	return db, nil
+}
+
+// NewVerifier creates a read-only replica that holds no private keys.  It
+// verifies signatures with the public keys in its registry, and its shards
+// only change by loading snapshots or replaying logs.
+func NewVerifier(opts ...Option) (*Db, error) {
+	db, err := newDB(opts)
+	if err != nil {
+		return nil, err
+	}
+	if len(db.keys) > 0 {
+		return nil, fmt.Errorf("a verifier holds no private keys: %w", ErrReadOnly)
+	}
+	db.readOnly = true
+	return db, nil
+}
+
+func newDB(opts []Option) (*Db, error) {
+	db := &Db{
+		State:      make(map[Shard]*State),
+		curve:      elliptic.P521(),
+		algorithm:  ECMHP521,
+		algorithms: make(map[Shard]Algorithm),
+		keys:       make(map[Shard]*ecdsa.PrivateKey),
+		pubs:       make(map[Shard]*ecdsa.PublicKey),
+		accepted:   make(map[Shard]*SignedChecksum),
+		quorums:    make(map[Shard]*Quorum),
+		cosigned:   make(map[Shard]*QuorumChecksum),
+		digester:   DefaultDigester,
+		logger:     log.New(ioutil.Discard, "", 0),
+		clock:      &LogicalClock{},
+		refs:       make(refIndex),
+		indexes:    make(map[indexKey]bool),
+	}
+	for _, opt := range opts {
+		opt(db)
+	}
+	if !db.digester.Hash.Available() {
+		return nil, fmt.Errorf("digest hash %v: %w", db.digester.Hash, ErrUnavailableHash)
+	}
+	for shard, q := range db.quorums {
+		if q.K < 1 || q.K > len(q.Keys) {
+			return nil, fmt.Errorf("shard %d quorum of %d from %d keys: %w", shard, q.K, len(q.Keys), ErrQuorum)
+		}
+	}
+	return db, nil
+}
+
+func (db *Db) algorithmFor(shard Shard) Algorithm {
+	if alg, ok := db.algorithms[shard]; ok {
+		return alg
+	}
+	return db.algorithm
+}
+
+func (db *Db) state(shard Shard) (*State, error) {
+	if db.State[shard] == nil {
+		st, err := newState(db.algorithmFor(shard))
+		if err != nil {
+			return nil, fmt.Errorf("shard %d: %w", shard, err)
+		}
+		st.PublicKey = pointOf(db.pubs[shard])
+		db.State[shard] = st
+	}
+	return db.State[shard], nil
+}
+
+// Insert the object only if it does not already exist
+func (db *Db) Insert(v *DataRecord) (*DataRecord, error) {
+	return db.Do(Command{Action: ActionInsert, Record: v})
+}
+
+func (db *Db) insert(t *tx, v *DataRecord, at int64) (*DataRecord, error) {
+	if v == nil {
+		return nil, ErrNoRecord
+	}
+	shard := v.Shard
+	st, err := db.state(shard)
+	if err != nil {
+		return nil, err
+	}
+	if v.Id == 0 {
+		v.Id = st.HighestId + 1
+		t.onUndo(func() { v.Id = 0 })
+	}
+	id := v.Id
+	if st.HighestId < v.Id {
+		st.setHighest(t, v.Id)
+	}
+
+	_, ok := st.Data[id]
+	if ok {
+		return nil, fmt.Errorf("object %d:%d: %w", shard, id, ErrExists)
+	}
+	if pending, ok := st.Pending[id]; ok {
+		h := db.digester.Record(v)
+		if !bytes.Equal(h, db.digester.Record(pending)) {
+			return nil, fmt.Errorf("object %d:%d has a pending removal: %w", shard, id, ErrMismatch)
+		}
+		// the insert and its removal cancel out
+		st.unpend(t, pending, h)
+		return v, nil
+	}
+	if !t.replay {
+		if err := db.checkRefs(v); err != nil {
+			return nil, err
+		}
+	}
+	st.put(t, v, db.digester.Record(v))
+	db.link(t, v)
+	st.touch(t, id, at)
+	for _, ref := range v.Refs {
+		target, ok := db.State[ref.Shard]
+		if !ok || target.Data[ref.Id] == nil {
+			continue
+		}
+		if ref.Shard == shard {
+			target.touch(t, ref.Id, at)
+		} else if !t.replay {
+			// logged in the target's shard, which replays it
+			t.touches = append(t.touches, Command{Action: ActionTouch, Record: &DataRecord{Shard: ref.Shard, Id: ref.Id}, At: at})
+		}
+	}
+	return v, nil
+}
+
+// touchRef touches a record that a record in another shard referred to.
+func (db *Db) touchRef(t *tx, v *DataRecord, at int64) error {
+	if v == nil {
+		return ErrNoRecord
+	}
+	if st, ok := db.State[v.Shard]; ok && st.Data[v.Id] != nil {
+		st.touch(t, v.Id, at)
+	}
+	return nil
+}
+
+// Remove the record only if it is there, and nothing refers to it
+func (db *Db) Remove(vToRemove *DataRecord) (*DataRecord, error) {
+	return db.Do(Command{Action: ActionRemove, Record: vToRemove})
+}
+
+// RemoveCascade removes the record and everything that refers to it
+func (db *Db) RemoveCascade(vToRemove *DataRecord) (*DataRecord, error) {
+	return db.Do(Command{Action: ActionRemove, Record: vToRemove, Cascade: true})
+}
+
+func (db *Db) remove(t *tx, vToRemove *DataRecord) (*DataRecord, error) {
+	if vToRemove == nil {
+		return nil, ErrNoRecord
+	}
+	shard := vToRemove.Shard
+	st, err := db.state(shard)
+	if err != nil {
+		return nil, err
+	}
+	id := vToRemove.Id
+
+	v, ok := st.Data[id]
+	if !ok && db.pending && id > 0 {
+		return db.pend(t, st, vToRemove)
+	}
+	if !ok && t.replay {
+		// without pending removes, nothing logs the removal of a missing
+		// record
+		return nil, fmt.Errorf("object %d:%d is removed but missing: %w", shard, id, ErrCorruptLog)
+	}
+	if !ok {
+		return nil, fmt.Errorf(
+			"object %d:%d cannot be removed: %w",
+			shard, id, ErrNotFound,
+		)
+	}
+	hToRemove := db.digester.Record(vToRemove)
+	h := db.digester.Record(v)
+	if !bytes.Equal(hToRemove, h) {
+		return nil, fmt.Errorf("object %d:%d: %w", shard, id, ErrMismatch)
+	}
+	for _, from := range db.referrers(refOf(v)) {
+		// a cascade removes its referrers too, if not before it
+		if !t.replay && !t.cascade[from] {
+			return nil, fmt.Errorf(
+				"object %d:%d is referred to by %d:%d: %w",
+				shard, id, from.Shard, from.Id, ErrReferenced,
+			)
+		}
+	}
+	st.del(t, v, h)
+	db.unlink(t, v)
+	return v, nil
+}
+
+// pend holds the removal of a record that hasn't been inserted yet.
+func (db *Db) pend(t *tx, st *State, v *DataRecord) (*DataRecord, error) {
+	if _, ok := st.Pending[v.Id]; ok {
+		return nil, fmt.Errorf("object %d:%d removal is already pending: %w", v.Shard, v.Id, ErrExists)
+	}
+	if st.HighestId < v.Id {
+		st.setHighest(t, v.Id)
+	}
+	st.pend(t, v, db.digester.Record(v))
+	return v, nil
+}
+
+// Renew the lease on a record, setting its TTL to that of v.  A lease can
+// only be extended, and a record that never expires can't be renewed.
+func (db *Db) Renew(v *DataRecord) (*DataRecord, error) {
+	return db.Do(Command{Action: ActionRenew, Record: v})
+}
+
+func (db *Db) renew(t *tx, v *DataRecord, at int64) (*DataRecord, error) {
+	if v == nil {
+		return nil, ErrNoRecord
+	}
+	st, err := db.state(v.Shard)
+	if err != nil {
+		return nil, err
+	}
+	old, ok := st.Data[v.Id]
+	if !ok {
+		return nil, fmt.Errorf("object %d:%d cannot be renewed: %w", v.Shard, v.Id, ErrNotFound)
+	}
+	if old.TTL == 0 || (v.TTL != 0 && v.TTL < old.TTL) {
+		return nil, fmt.Errorf(
+			"object %d:%d lease %d cannot be renewed to %d: %w",
+			v.Shard, v.Id, old.TTL, v.TTL, ErrShortLease,
+		)
+	}
+	// the old record may still be in use by readers, so renew a copy
+	renewed := *old
+	renewed.TTL = v.TTL
+	st.del(t, old, db.digester.Record(old))
+	st.put(t, &renewed, db.digester.Record(&renewed))
+	st.touch(t, v.Id, at)
+	return &renewed, nil
+}
+
+// Digest returns the digest of a record, which is what Replace expects.
+func (db *Db) Digest(v *DataRecord) []byte {
+	return db.digester.Record(v)
+}
+
+// Replace a record with v in one step, but only if the record currently
+// stored under its id has the digest expect.  Otherwise it fails with
+// ErrConflict, and the caller can re-read the record and try again.
+func (db *Db) Replace(v *DataRecord, expect []byte) (*DataRecord, error) {
+	return db.Do(Command{Action: ActionReplace, Record: v, Expect: expect})
+}
+
+func (db *Db) replace(t *tx, v *DataRecord, expect []byte, at int64) (*DataRecord, error) {
+	if v == nil {
+		return nil, ErrNoRecord
+	}
+	st, err := db.state(v.Shard)
+	if err != nil {
+		return nil, err
+	}
+	old, ok := st.Data[v.Id]
+	if !ok {
+		return nil, fmt.Errorf("object %d:%d cannot be replaced: %w", v.Shard, v.Id, ErrNotFound)
+	}
+	h := db.digester.Record(old)
+	if !bytes.Equal(h, expect) {
+		return nil, fmt.Errorf("object %d:%d: %w", v.Shard, v.Id, ErrConflict)
+	}
+	if !t.replay {
+		if err := db.checkRefs(v); err != nil {
+			return nil, err
+		}
+	}
+	st.del(t, old, h)
+	db.unlink(t, old)
+	st.put(t, v, db.digester.Record(v))
+	db.link(t, v)
+	st.touch(t, v.Id, at)
+	return v, nil
+}
+
+// apply a command, journaling its changes in t.  Every command that applies
+// moves its shard to the next version.
+func (db *Db) apply(t *tx, cmd Command) (*DataRecord, error) {
+	v, err := db.act(t, cmd)
+	if err != nil {
+		return nil, err
+	}
+	if shard, ok := cmd.shard(); ok && db.State[shard] != nil {
+		db.State[shard].bump(t)
+	}
+	return v, nil
+}
+
+func (db *Db) act(t *tx, cmd Command) (*DataRecord, error) {
+	switch cmd.Action {
+	case ActionInsert:
+		return db.insert(t, cmd.Record, cmd.At)
+	case ActionRemove:
+		return db.remove(t, cmd.Record)
+	case ActionRenew:
+		return db.renew(t, cmd.Record, cmd.At)
+	case ActionReplace:
+		return db.replace(t, cmd.Record, cmd.Expect, cmd.At)
+	case ActionOffer:
+		return nil, db.offer(t, cmd.Offer, cmd.At)
+	case ActionAccept:
+		return nil, db.accept(t, cmd.Accept, cmd.At)
+	case ActionWithdraw:
+		return nil, db.withdraw(t, cmd.Offer, cmd.At)
+	case ActionRotate:
+		return nil, db.rotate(t, cmd.Handoff)
+	case ActionTouch:
+		return nil, db.touchRef(t, cmd.Record, cmd.At)
+	}
+	return nil, fmt.Errorf("action %d: %w", cmd.Action, ErrUnknownAction)
+}
+
+// Do applies a command at the time on the database's clock, whatever its At.
+// If the database has a WAL, the command is only applied once it is durably
+// logged.
+func (db *Db) Do(cmd Command) (*DataRecord, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return db.do(cmd, db.clock.Now())
+}
+
+// do applies a command at now, which only the sweeper chooses.
+func (db *Db) do(cmd Command, now int64) (*DataRecord, error) {
+	r, err := db.doBatch(Batch{Commands: []Command{cmd}}, now)
+	if err != nil {
+		return nil, err
+	}
+	return r[0], nil
+}
+
+// Replay a WAL to rebuild the shards it logged, starting from each shard's
+// latest snapshot.  This is done once, when the database is opened and before
+// anything is appended.
+func (db *Db) Replay(w *WAL) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	load := func(shard Shard, r io.Reader) error {
+		loaded, err := db.loadSnapshot(r)
+		if err == nil && loaded != shard {
+			err = fmt.Errorf("snapshot of shard %d in the log of shard %d: %w", loaded, shard, ErrBadSnapshot)
+		}
+		return err
+	}
+	return w.replay(load, func(cmds []Command) error {
+		// shards are replayed one after another, so refs may be to
+		// records that haven't been replayed yet
+		t := &tx{replay: true}
+		for _, cmd := range cmds {
+			if _, err := db.apply(t, cmd); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (db *Db) checksum(shard Shard) string {
+	var ck MultisetHash
+	if st, ok := db.State[shard]; ok {
+		ck = st.Checksum
+	} else {
+		// a shard we have never seen is empty
+		var err error
+		ck, err = NewMultisetHash(db.algorithmFor(shard))
+		if err != nil {
+			return fmt.Sprintf("%d:%v:", shard, db.algorithmFor(shard))
+		}
+	}
+	return FormatChecksum(shard, ck)
+}
+
+// FormatChecksum renders a checksum as "shard:algorithm:hex", where hex is
+// the value of the hash without its algorithm byte.
+func FormatChecksum(shard Shard, ck MultisetHash) string {
+	return fmt.Sprintf(
+		"%d:%v:%s",
+		shard,
+		ck.Algorithm(),
+		hex.EncodeToString(ck.Encode()[1:]),
+	)
+}
+
+// Checksum renders the running checksum of a shard as "shard:algorithm:hex".
+func (db *Db) Checksum(shard Shard) string {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return db.checksum(shard)
+}
+
+// Sign the current checksum of a shard with its key.
+func (db *Db) Sign(shard Shard) (Point, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return db.sign(shard)
+}
+
+func (db *Db) sign(shard Shard) (Point, error) {
+	kp, err := db.signer(shard)
+	if err != nil {
+		return Point{}, err
+	}
+	h := sha256.Sum256([]byte(db.checksum(shard)))
+	r, s, err := ecdsa.Sign(rand.Reader, kp, h[:])
+	return Point{X: r, Y: s}, err
+}
+
+// Verify that sig is a signature over the current checksum of a shard, by
+// its current writer key.  A shard signed for by a quorum never verifies
+// with a single key.
+func (db *Db) Verify(shard Shard, sig Point) bool {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if _, ok := db.quorums[shard]; ok {
+		return false
+	}
+	pub := db.currentKey(shard)
+	if pub == nil || sig.X == nil || sig.Y == nil {
+		return false
+	}
+	h := sha256.Sum256([]byte(db.checksum(shard)))
+	return ecdsa.Verify(pub, h[:], sig.X, sig.Y)
+}
+
+// Get a record, or nil if it is not in the database.
+func (db *Db) Get(shard Shard, id Id) *DataRecord {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	st, ok := db.State[shard]
+	if !ok {
+		return nil
+	}
+	return st.Data[id]
+}
+
+// List returns up to limit records of a shard with ids after after, in id
+// order.
+func (db *Db) List(shard Shard, after Id, limit int) []*DataRecord {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	st, ok := db.State[shard]
+	if !ok || limit <= 0 {
+		return nil
+	}
+	ids := make([]Id, 0, len(st.Data))
+	for id := range st.Data {
+		if id > after {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+	records := make([]*DataRecord, len(ids))
+	for i, id := range ids {
+		records[i] = st.Data[id]
+	}
+	return records
+}
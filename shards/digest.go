@@ -0,0 +1,60 @@
+package shards
+
+import (
+	"crypto"
+	"encoding/binary"
+	"fmt"
+)
+
+// Digester computes the digest of a record that goes into its shard's
+// multiset hash.  The digest covers a canonical encoding of the record, and
+// is domain separated by shard and id so that the same contents under a
+// different key never produce the same element.
+type Digester struct {
+	Hash crypto.Hash
+}
+
+// DefaultDigester uses SHA-256.
+var DefaultDigester = Digester{Hash: crypto.SHA256}
+
+var recordDomain = []byte("BC-SHARDS-V01-RECORD\x00")
+var offerDomain = []byte("BC-SHARDS-V01-OFFER\x00")
+
+// Record returns the digest of v.
+func (d Digester) Record(v *DataRecord) []byte {
+	return d.sum(recordDomain, v.Shard, v.Id, canonical(v))
+}
+
+// Offer returns the digest of an open offer.  Its domain differs from that
+// of records, so an offer can't cancel a record or the other way around.
+func (d Digester) Offer(o *Offer) []byte {
+	return d.sum(offerDomain, o.Shard, o.Id, canonical(o))
+}
+
+func (d Digester) sum(domain []byte, shard Shard, id Id, enc []byte) []byte {
+	if !d.Hash.Available() {
+		panic(fmt.Sprintf("digest hash %v is not linked into the binary", d.Hash))
+	}
+	h := d.Hash.New()
+	var key [16]byte
+	binary.BigEndian.PutUint64(key[0:], uint64(shard))
+	binary.BigEndian.PutUint64(key[8:], uint64(id))
+	h.Write(domain)
+	h.Write(key[:])
+	h.Write(enc)
+	return h.Sum(nil)
+}
+
+// ChecksumOf computes the checksum of a shard holding exactly records.
+// This is what a shard's running checksum must equal, no matter how many
+// inserts and removes it took to get there.
+func ChecksumOf(alg Algorithm, d Digester, records []*DataRecord) (MultisetHash, error) {
+	ck, err := NewMultisetHash(alg)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range records {
+		ck.Add(d.Record(v))
+	}
+	return ck, nil
+}
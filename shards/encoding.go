@@ -0,0 +1,415 @@
+package shards
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// The canonical encoding is what record digests are computed over, so it must
+// never change for a record whose contents don't.  Unlike JSON, it doesn't
+// depend on struct tags or omitempty, and it is simple to reproduce outside of
+// Go:
+//
+//  version  1 byte, EncodingVersion
+//  kind     1 byte, kindRecord, kindCommand, ...
+//  fields   in ascending tag order, each one:
+//             tag     1 byte
+//             length  4 bytes, big-endian
+//             value   length bytes
+//
+// Fields with a zero value (0, "", empty map, nil) are left out, so adding a
+// field with a new tag doesn't change the encoding of records that don't use
+// it.  Values are:
+//
+//  integer    8 bytes, big-endian two's complement
+//  string     the bytes of the string
+//  map        4 byte big-endian count, then entries sorted by key bytes:
+//             4 byte key length, key, then the value (length prefixed
+//             with 4 bytes if it is a string)
+//  reference  shard then id, as integers
+//  record     its complete encoding, including version and kind
+//
+// Decoding is strict: anything other than the canonical form of a value is
+// rejected, so that two different encodings never decode to the same value.
+// That includes unknown tags, since a reader that doesn't know a field can't
+// reproduce the digest of a record that has it.
+
+const EncodingVersion = 1
+
+const (
+	kindRecord  = byte(1)
+	kindCommand = byte(2)
+)
+
+// DataRecord field tags
+const (
+	tagRecordShard   = byte(1)
+	tagRecordId      = byte(2)
+	tagRecordTTL     = byte(3)
+	tagRecordRefs    = byte(4)
+	tagRecordInts    = byte(5)
+	tagRecordStrings = byte(6)
+)
+
+// Command field tags
+const (
+	tagCommandAction  = byte(1)
+	tagCommandRecord  = byte(2)
+	tagCommandAt      = byte(3)
+	tagCommandCascade = byte(4)
+	tagCommandExpect  = byte(5)
+	tagCommandOffer   = byte(6)
+	tagCommandAccept  = byte(7)
+	tagCommandHandoff = byte(8)
+)
+
+var ErrNonCanonical = errors.New("not a canonical encoding")
+
+type encBuf struct {
+	b []byte
+}
+
+func (e *encBuf) u32(n int) {
+	e.b = append(e.b, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+func (e *encBuf) i64(n int64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(n))
+	e.b = append(e.b, b[:]...)
+}
+
+func (e *encBuf) str(s string) {
+	e.u32(len(s))
+	e.b = append(e.b, s...)
+}
+
+// field appends a field whose value is written by f
+func (e *encBuf) field(tag byte, f func(e *encBuf)) {
+	var v encBuf
+	f(&v)
+	e.b = append(e.b, tag)
+	e.u32(len(v.b))
+	e.b = append(e.b, v.b...)
+}
+
+func (e *encBuf) intField(tag byte, n int64) {
+	if n != 0 {
+		e.field(tag, func(e *encBuf) { e.i64(n) })
+	}
+}
+
+func (e *encBuf) bytesField(tag byte, b []byte) {
+	if len(b) > 0 {
+		e.field(tag, func(e *encBuf) { e.b = append(e.b, b...) })
+	}
+}
+
+func sortedKeys(n int, key func(add func(string))) []string {
+	keys := make([]string, 0, n)
+	key(func(k string) { keys = append(keys, k) })
+	sort.Strings(keys)
+	return keys
+}
+
+// MarshalBinary returns the canonical encoding of the record.
+func (v *DataRecord) MarshalBinary() ([]byte, error) {
+	e := &encBuf{b: []byte{EncodingVersion, kindRecord}}
+	e.intField(tagRecordShard, int64(v.Shard))
+	e.intField(tagRecordId, int64(v.Id))
+	e.intField(tagRecordTTL, v.TTL)
+	if len(v.Refs) > 0 {
+		keys := sortedKeys(len(v.Refs), func(add func(string)) {
+			for k := range v.Refs {
+				add(k)
+			}
+		})
+		e.field(tagRecordRefs, func(e *encBuf) {
+			e.u32(len(keys))
+			for _, k := range keys {
+				e.str(k)
+				e.i64(int64(v.Refs[k].Shard))
+				e.i64(int64(v.Refs[k].Id))
+			}
+		})
+	}
+	if len(v.Ints) > 0 {
+		keys := sortedKeys(len(v.Ints), func(add func(string)) {
+			for k := range v.Ints {
+				add(k)
+			}
+		})
+		e.field(tagRecordInts, func(e *encBuf) {
+			e.u32(len(keys))
+			for _, k := range keys {
+				e.str(k)
+				e.i64(v.Ints[k])
+			}
+		})
+	}
+	if len(v.Strings) > 0 {
+		keys := sortedKeys(len(v.Strings), func(add func(string)) {
+			for k := range v.Strings {
+				add(k)
+			}
+		})
+		e.field(tagRecordStrings, func(e *encBuf) {
+			e.u32(len(keys))
+			for _, k := range keys {
+				e.str(k)
+				e.str(v.Strings[k])
+			}
+		})
+	}
+	return e.b, nil
+}
+
+// MarshalBinary returns the canonical encoding of the command.
+func (cmd *Command) MarshalBinary() ([]byte, error) {
+	e := &encBuf{b: []byte{EncodingVersion, kindCommand}}
+	e.intField(tagCommandAction, int64(cmd.Action))
+	if cmd.Record != nil {
+		r, err := cmd.Record.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		e.field(tagCommandRecord, func(e *encBuf) { e.b = append(e.b, r...) })
+	}
+	e.intField(tagCommandAt, cmd.At)
+	if cmd.Cascade {
+		e.intField(tagCommandCascade, 1)
+	}
+	if len(cmd.Expect) > 0 {
+		e.field(tagCommandExpect, func(e *encBuf) { e.b = append(e.b, cmd.Expect...) })
+	}
+	if cmd.Offer != nil {
+		o, err := cmd.Offer.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		e.bytesField(tagCommandOffer, o)
+	}
+	if cmd.Accept != nil {
+		e.bytesField(tagCommandAccept, canonical(cmd.Accept))
+	}
+	if cmd.Handoff != nil {
+		e.bytesField(tagCommandHandoff, canonical(cmd.Handoff))
+	}
+	return e.b, nil
+}
+
+type decBuf struct {
+	b   []byte
+	err error
+}
+
+func (d *decBuf) fail(format string, args ...interface{}) {
+	if d.err == nil {
+		d.err = fmt.Errorf("%s: %w", fmt.Sprintf(format, args...), ErrNonCanonical)
+	}
+}
+
+func (d *decBuf) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.b) {
+		d.fail("truncated")
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decBuf) u32() int {
+	b := d.take(4)
+	if b == nil {
+		return 0
+	}
+	return int(binary.BigEndian.Uint32(b))
+}
+
+func (d *decBuf) i64() int64 {
+	b := d.take(8)
+	if b == nil {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(b))
+}
+
+func (d *decBuf) str() string {
+	return string(d.take(d.u32()))
+}
+
+func (d *decBuf) done() bool {
+	return d.err != nil || len(d.b) == 0
+}
+
+// header checks the version and kind bytes
+func (d *decBuf) header(kind byte) {
+	h := d.take(2)
+	if h == nil {
+		return
+	}
+	if h[0] != EncodingVersion {
+		d.fail("encoding version %d", h[0])
+	}
+	if h[1] != kind {
+		d.fail("encoding kind %d, expected %d", h[1], kind)
+	}
+}
+
+// fields calls f with each field.  Tags must ascend, and f returns false
+// for tags it doesn't know.
+func (d *decBuf) fields(f func(tag byte, v *decBuf) bool) {
+	last := -1
+	for !d.done() {
+		tag := d.take(1)
+		if tag == nil {
+			return
+		}
+		if int(tag[0]) <= last {
+			d.fail("field %d out of order", tag[0])
+			return
+		}
+		last = int(tag[0])
+		v := &decBuf{b: d.take(d.u32())}
+		if d.err != nil {
+			return
+		}
+		if !f(tag[0], v) {
+			d.fail("unknown field %d", tag[0])
+			return
+		}
+		if len(v.b) > 0 && v.err == nil {
+			v.fail("field %d has trailing bytes", tag[0])
+		}
+		if v.err != nil {
+			d.err = v.err
+		}
+	}
+}
+
+func (d *decBuf) nonZero(tag byte, n int64) int64 {
+	if n == 0 {
+		d.fail("field %d is zero", tag)
+	}
+	return n
+}
+
+// entries reads a map with count entries, checking that keys ascend
+func (d *decBuf) entries(tag byte, f func(k string)) {
+	n := d.u32()
+	if n == 0 {
+		d.fail("field %d is empty", tag)
+	}
+	first := true
+	last := ""
+	for i := 0; i < n && d.err == nil; i++ {
+		k := d.str()
+		if !first && k <= last {
+			d.fail("field %d keys out of order", tag)
+		}
+		first = false
+		last = k
+		f(k)
+	}
+}
+
+// UnmarshalBinary parses a canonical encoding of a record.
+func (v *DataRecord) UnmarshalBinary(b []byte) error {
+	*v = DataRecord{}
+	d := &decBuf{b: b}
+	d.header(kindRecord)
+	d.fields(func(tag byte, f *decBuf) bool {
+		switch tag {
+		case tagRecordShard:
+			v.Shard = Shard(f.nonZero(tag, f.i64()))
+		case tagRecordId:
+			v.Id = Id(f.nonZero(tag, f.i64()))
+		case tagRecordTTL:
+			v.TTL = f.nonZero(tag, f.i64())
+		case tagRecordRefs:
+			v.Refs = make(map[string]Reference)
+			f.entries(tag, func(k string) {
+				v.Refs[k] = Reference{Shard: Shard(f.i64()), Id: Id(f.i64())}
+			})
+		case tagRecordInts:
+			v.Ints = make(map[string]int64)
+			f.entries(tag, func(k string) {
+				v.Ints[k] = f.i64()
+			})
+		case tagRecordStrings:
+			v.Strings = make(map[string]string)
+			f.entries(tag, func(k string) {
+				v.Strings[k] = f.str()
+			})
+		default:
+			return false
+		}
+		return true
+	})
+	return d.err
+}
+
+// UnmarshalBinary parses a canonical encoding of a command.
+func (cmd *Command) UnmarshalBinary(b []byte) error {
+	*cmd = Command{}
+	d := &decBuf{b: b}
+	d.header(kindCommand)
+	d.fields(func(tag byte, f *decBuf) bool {
+		switch tag {
+		case tagCommandAction:
+			cmd.Action = Action(f.nonZero(tag, f.i64()))
+		case tagCommandRecord:
+			cmd.Record = &DataRecord{}
+			if err := cmd.Record.UnmarshalBinary(f.b); err != nil {
+				f.err = err
+			}
+			f.b = nil
+		case tagCommandAt:
+			cmd.At = f.nonZero(tag, f.i64())
+		case tagCommandCascade:
+			if f.i64() != 1 {
+				f.fail("field %d is not 1", tag)
+			}
+			cmd.Cascade = true
+		case tagCommandExpect:
+			cmd.Expect, f.b = f.b, nil
+		case tagCommandOffer:
+			cmd.Offer = &Offer{}
+			if err := cmd.Offer.UnmarshalBinary(f.b); err != nil {
+				f.err = err
+			}
+			f.b = nil
+		case tagCommandAccept:
+			cmd.Accept = &Accept{}
+			if err := cmd.Accept.UnmarshalBinary(f.b); err != nil {
+				f.err = err
+			}
+			f.b = nil
+		case tagCommandHandoff:
+			cmd.Handoff = &KeyHandoff{}
+			if err := cmd.Handoff.UnmarshalBinary(f.b); err != nil {
+				f.err = err
+			}
+			f.b = nil
+		default:
+			return false
+		}
+		return true
+	})
+	return d.err
+}
+
+// canonical is MarshalBinary for values whose encoding can't fail
+func canonical(v interface{ MarshalBinary() ([]byte, error) }) []byte {
+	b, err := v.MarshalBinary()
+	if err != nil {
+		panic(fmt.Sprintf("cannot encode %T: %v", v, err))
+	}
+	return b
+}
@@ -0,0 +1,108 @@
+package shards
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// The golden vectors in the README.
+var encodingVectors = []struct {
+	json, enc, digest string
+}{
+	{
+		`{"shard":22,"id":1,"ttl":20,"refs":{"owner":{"shard":7,"id":3}},"ints":{"a":5,"b":-1},"strings":{"name":"alice"}}`,
+		"0101010000000800000000000000160200000008000000000000000103000000080000000000000014040000001d00000001000000056f776e657200000000000000070000000000000003050000001e00000002000000016100000000000000050000000162ffffffffffffffff060000001500000001000000046e616d6500000005616c696365",
+		"ccc6e9f6849d49dec491f96464883816ffb03444dd0c7478ba034ca8c4ed388f",
+	},
+	{`{}`, "0101", ""},
+}
+
+func TestRecordEncodingVectors(t *testing.T) {
+	for _, test := range encodingVectors {
+		var v DataRecord
+		if err := json.Unmarshal([]byte(test.json), &v); err != nil {
+			t.Fatal(err)
+		}
+		b, err := v.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(b) != test.enc {
+			t.Errorf("%s: got %x", test.json, b)
+		}
+		if test.digest != "" {
+			if h := hex.EncodeToString(DefaultDigester.Record(&v)); h != test.digest {
+				t.Errorf("%s: digest %s", test.json, h)
+			}
+		}
+		var back DataRecord
+		if err := back.UnmarshalBinary(b); err != nil {
+			t.Fatalf("%s: %v", test.json, err)
+		}
+		if !reflect.DeepEqual(back, v) {
+			t.Errorf("%s: decoded %+v", test.json, back)
+		}
+	}
+}
+
+func TestCommandEncodingVector(t *testing.T) {
+	const enc = "01020100000008000000000000000102000000290101010000000800000000000000160200000008000000000000000203000000080000000000000015"
+	var cmd Command
+	if err := json.Unmarshal([]byte(`{"action":1,"record":{"shard":22,"id":2,"ttl":21}}`), &cmd); err != nil {
+		t.Fatal(err)
+	}
+	if b := canonical(&cmd); hex.EncodeToString(b) != enc {
+		t.Fatalf("got %x", b)
+	}
+	var back Command
+	if err := back.UnmarshalBinary(canonical(&cmd)); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(back, cmd) {
+		t.Errorf("decoded %+v", back)
+	}
+}
+
+func TestDecodeRejects(t *testing.T) {
+	valid, _ := hex.DecodeString(encodingVectors[0].enc)
+	field := func(tag byte, value ...byte) []byte {
+		return append([]byte{tag, 0, 0, 0, byte(len(value))}, value...)
+	}
+	i64 := func(n byte) []byte { return []byte{0, 0, 0, 0, 0, 0, 0, n} }
+	record := func(fields ...[]byte) []byte {
+		return append([]byte{EncodingVersion, kindRecord}, bytes.Join(fields, nil)...)
+	}
+	tests := []struct {
+		name string
+		b    []byte
+	}{
+		{"empty", nil},
+		{"wrong version", append([]byte{2}, valid[1:]...)},
+		{"wrong kind", append([]byte{EncodingVersion, kindCommand}, valid[2:]...)},
+		{"trailing bytes", append(append([]byte{}, valid...), 0)},
+		{"unknown tag", record(field(tagRecordShard, i64(1)...), field(7, i64(1)...))},
+		{"fields out of order", record(field(tagRecordId, i64(1)...), field(tagRecordShard, i64(1)...))},
+		{"repeated field", record(field(tagRecordShard, i64(1)...), field(tagRecordShard, i64(2)...))},
+		{"zero value", record(field(tagRecordShard, i64(0)...))},
+		{"short integer", record(field(tagRecordShard, 1))},
+		{"long integer", record(field(tagRecordShard, append(i64(1), 0)...))},
+		{"truncated", valid[:len(valid)-1]},
+		{"empty map", record(field(tagRecordInts, 0, 0, 0, 0))},
+		{"keys out of order", record(field(tagRecordInts,
+			append(append([]byte{0, 0, 0, 2, 0, 0, 0, 1, 'b'}, i64(1)...), append([]byte{0, 0, 0, 1, 'a'}, i64(1)...)...)...))},
+	}
+	for _, test := range tests {
+		var v DataRecord
+		if err := v.UnmarshalBinary(test.b); !errors.Is(err, ErrNonCanonical) {
+			t.Errorf("%s: got %v", test.name, err)
+		}
+	}
+	var cmd Command
+	if err := cmd.UnmarshalBinary(append([]byte{EncodingVersion, kindCommand}, field(tagCommandCascade, i64(2)...)...)); !errors.Is(err, ErrNonCanonical) {
+		t.Errorf("cascade of 2: got %v", err)
+	}
+}
@@ -0,0 +1,28 @@
+package shards
+
+import "errors"
+
+// Errors returned by Db operations.  They are wrapped with the shard and id
+// involved, so compare them with errors.Is.
+var (
+	ErrExists          = errors.New("already exists")
+	ErrNotFound        = errors.New("does not exist")
+	ErrMismatch        = errors.New("not the object we think we are removing")
+	ErrNoRecord        = errors.New("command has no record")
+	ErrUnknownAction   = errors.New("unknown action")
+	ErrUnknownShard    = errors.New("unknown shard")
+	ErrNoKey           = errors.New("shard has no signing key")
+	ErrDanglingRef     = errors.New("ref points at a record that does not exist")
+	ErrReferenced      = errors.New("record is still referred to")
+	ErrConflict        = errors.New("record is not the expected version")
+	ErrShortLease      = errors.New("lease can only be extended")
+	ErrUnavailableHash = errors.New("hash is not available")
+	ErrBadSignature    = errors.New("signature does not verify")
+	ErrOfferExpired    = errors.New("offer has expired")
+	ErrNotExpired      = errors.New("offer has not expired")
+	ErrReadOnly        = errors.New("database is read-only")
+	ErrWrongKey        = errors.New("public key does not match the shard's key")
+	ErrStale           = errors.New("statement is older than the last one accepted")
+	ErrQuorum          = errors.New("statement lacks a quorum of co-signers")
+	ErrNoIndex         = errors.New("field has no index")
+)
@@ -0,0 +1,167 @@
+package shards
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// A record's TTL is the time on the database's Clock at which it expires,
+// and 0 means that it never does.  With an idle timeout, a record also
+// expires once it has gone that long without being inserted, renewed or
+// referenced; the times come from the commands, so they replay too.
+// Expiry removes records with ordinary ActionRemove commands stamped with the
+// time of the sweep, in id order, so every replica that sweeps a shard at the
+// same time reaches the same checksum, and the log replays the sweep exactly.
+
+// Clock tells the database what time it is.
+type Clock interface {
+	Now() int64
+}
+
+// LogicalClock only moves when it is told to, so replicas can agree on it.
+type LogicalClock struct {
+	lock sync.Mutex
+	now  int64
+}
+
+func (c *LogicalClock) Now() int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+// Set the time.  Time never goes backwards, so an earlier time is ignored.
+func (c *LogicalClock) Set(now int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.now < now {
+		c.now = now
+	}
+}
+
+// Advance the clock by d and return the new time.  A negative d is ignored.
+func (c *LogicalClock) Advance(d int64) int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if d > 0 {
+		c.now += d
+	}
+	return c.now
+}
+
+// WallClock is the time in unix seconds.
+type WallClock struct{}
+
+func (WallClock) Now() int64 {
+	return time.Now().Unix()
+}
+
+func (v *DataRecord) expired(now int64) bool {
+	return v.TTL != 0 && v.TTL <= now
+}
+
+func (db *Db) idleOut(st *State, id Id, now int64) bool {
+	if db.idle <= 0 {
+		return false
+	}
+	touched, ok := st.Touched[id]
+	return ok && now-touched >= db.idle
+}
+
+// Expire removes the records of a shard whose TTL has passed on the
+// database's clock, withdraws its expired offers and collects its expired
+// settled ones.
+func (db *Db) Expire(shard Shard) ([]*DataRecord, error) {
+	return db.ExpireAt(shard, db.clock.Now())
+}
+
+// ExpireAt removes the records of a shard whose TTL is at or before now, and
+// returns them.
+func (db *Db) ExpireAt(shard Shard, now int64) ([]*DataRecord, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return db.expireAt(shard, now)
+}
+
+func (db *Db) expireAt(shard Shard, now int64) ([]*DataRecord, error) {
+	st, ok := db.State[shard]
+	if !ok {
+		return nil, nil
+	}
+	var ids []Id
+	for id, v := range st.Data {
+		if v.expired(now) || db.idleOut(st, id, now) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	// a record that is still referred to waits for its referrers to
+	// expire first, which may be later in the same sweep
+	var removed []*DataRecord
+	for progress := true; progress; {
+		progress = false
+		waiting := ids[:0]
+		for _, id := range ids {
+			if len(db.referrers(Reference{Shard: shard, Id: id})) > 0 {
+				waiting = append(waiting, id)
+				continue
+			}
+			v, err := db.do(Command{Action: ActionRemove, Record: st.Data[id]}, now)
+			if err != nil {
+				return removed, err
+			}
+			removed = append(removed, v)
+			progress = true
+		}
+		ids = waiting
+	}
+	if err := db.withdrawAt(st, now); err != nil {
+		return removed, err
+	}
+	st.collectOffers(now)
+	return removed, nil
+}
+
+// Sweep expires every shard at the current time.
+func (db *Db) Sweep() ([]*DataRecord, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	now := db.clock.Now()
+	ids := make([]Shard, 0, len(db.State))
+	for shard := range db.State {
+		ids = append(ids, shard)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	var removed []*DataRecord
+	for _, shard := range ids {
+		r, err := db.expireAt(shard, now)
+		removed = append(removed, r...)
+		if err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+// StartSweeper sweeps the database every interval until stop is called.
+// Errors go to the database's logger.
+func (db *Db) StartSweeper(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if _, err := db.Sweep(); err != nil {
+					db.logger.Printf("sweep: %v", err)
+				}
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
@@ -0,0 +1,91 @@
+package shards
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestExpireIsDeterministic(t *testing.T) {
+	var logs [2]bytes.Buffer
+	var dbs [2]*Db
+	for i := range dbs {
+		dbs[i], _ = NewDB(1, WithAlgorithm(LtHash16), WithLogger(log.New(&logs[i], "", 0)))
+		// the clocks disagree, but the sweep time is what counts
+		dbs[i].clock.(*LogicalClock).Set(int64(i * 1000))
+		for ttl := int64(10); ttl <= 50; ttl += 10 {
+			dbs[i].Insert(&DataRecord{Shard: 1, TTL: ttl})
+		}
+		dbs[i].Insert(&DataRecord{Shard: 1})
+		removed, err := dbs[i].ExpireAt(1, 30)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(removed) != 3 || removed[0].Id != 1 || removed[2].Id != 3 {
+			t.Fatalf("removed %v", removed)
+		}
+	}
+	if dbs[0].Checksum(1) != dbs[1].Checksum(1) {
+		t.Fatal("replicas that swept at the same time differ")
+	}
+	for i := range logs {
+		if n := strings.Count(logs[i].String(), `"at":30`); n != 3 {
+			t.Fatalf("%d of the removes were stamped with the sweep time:\n%s", n, logs[i].String())
+		}
+	}
+}
+
+func TestCrossShardTouchReplays(t *testing.T) {
+	dir := tempDir(t)
+	clock := &LogicalClock{}
+	db, wal := testDb(t, dir, WithClock(clock), WithIdleTimeout(100))
+	clock.Set(10)
+	target, err := db.Insert(&DataRecord{Shard: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.Set(50)
+	if _, err := db.Insert(&DataRecord{Shard: 1, Refs: map[string]Reference{"t": refOf(target)}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Do(Command{Action: ActionTouch, Record: target}); !errors.Is(err, ErrUnknownAction) {
+		t.Fatalf("touch was submitted: %v", err)
+	}
+	wal.Close()
+
+	again, wal := testDb(t, dir, WithIdleTimeout(100))
+	defer wal.Close()
+	for _, d := range []*Db{db, again} {
+		if touched := d.State[2].Touched[target.Id]; touched != 50 {
+			t.Fatalf("touched at %d", touched)
+		}
+	}
+	sameShard(t, db, again, 1)
+	sameShard(t, db, again, 2)
+	// the referrer doesn't expire, so neither does the target
+	for _, d := range []*Db{db, again} {
+		if removed, err := d.ExpireAt(2, 120); err != nil || len(removed) != 0 {
+			t.Fatalf("removed %v, %v", removed, err)
+		}
+	}
+}
+
+func TestLogicalClockOnlyMovesForward(t *testing.T) {
+	c := &LogicalClock{}
+	if now := c.Advance(10); now != 10 {
+		t.Fatalf("advanced to %d", now)
+	}
+	if now := c.Advance(-5); now != 10 {
+		t.Fatalf("went back to %d", now)
+	}
+	c.Set(3)
+	if c.Now() != 10 {
+		t.Fatalf("set back to %d", c.Now())
+	}
+	c.Set(20)
+	if c.Now() != 20 {
+		t.Fatalf("set to %d", c.Now())
+	}
+}
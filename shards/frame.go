@@ -0,0 +1,60 @@
+package shards
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// Logs and snapshots are sequences of frames:
+//
+//  length   4 bytes, big-endian length of the payload
+//  crc      4 bytes, big-endian CRC-32C of the payload
+//  payload  length bytes
+//
+// A frame that is cut short, or whose CRC doesn't match, is torn.
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+const frameHeader = 8
+
+// maxFrame bounds the allocation for a corrupt length
+const maxFrame = 64 << 20
+
+var errTornFrame = errors.New("torn frame")
+
+func writeFrame(w io.Writer, payload []byte) error {
+	b := make([]byte, frameHeader+len(payload))
+	binary.BigEndian.PutUint32(b[0:], uint32(len(payload)))
+	binary.BigEndian.PutUint32(b[4:], crc32.Checksum(payload, castagnoli))
+	copy(b[frameHeader:], payload)
+	_, err := w.Write(b)
+	return err
+}
+
+// readFrame returns the next payload and the bytes consumed, io.EOF at a
+// clean end, or errTornFrame.
+func readFrame(r io.Reader) ([]byte, int64, error) {
+	var h [frameHeader]byte
+	n, err := io.ReadFull(r, h[:])
+	if err == io.EOF {
+		return nil, 0, io.EOF
+	}
+	if err != nil {
+		return nil, int64(n), errTornFrame
+	}
+	size := binary.BigEndian.Uint32(h[0:])
+	if size > maxFrame {
+		return nil, frameHeader, errTornFrame
+	}
+	payload := make([]byte, size)
+	m, err := io.ReadFull(r, payload)
+	if err != nil {
+		return nil, int64(frameHeader + m), errTornFrame
+	}
+	if crc32.Checksum(payload, castagnoli) != binary.BigEndian.Uint32(h[4:]) {
+		return nil, int64(frameHeader + m), errTornFrame
+	}
+	return payload, int64(frameHeader + m), nil
+}
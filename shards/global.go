@@ -0,0 +1,213 @@
+package shards
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// Records are domain separated by shard, so the checksums of different
+// shards can be added together without two of them ever cancelling: the sum
+// over a set of shards is a checksum of everything in them.  A
+// GlobalStatement bundles the signed statements of a set of shards with
+// their sum, so the global checksum is signed by every writer whose shard is
+// a part of it, and an auditor who has verified the bundle can check a whole
+// replica against it with one comparison.  It is encoded like a record, as
+// kind 10:
+//
+//  1 encoded checksum, 2 statements: a 4 byte count, then the encoding of
+//  each, length prefixed with 4 bytes, in shard order
+//
+// Shards signed for by a quorum can't be bundled, since the bundle carries
+// one signature per shard.
+
+type GlobalStatement struct {
+	Checksum []byte            `json:"checksum,omitempty"`
+	Parts    []*SignedChecksum `json:"parts,omitempty"`
+}
+
+const kindGlobal = byte(10)
+
+// GlobalStatement field tags
+const (
+	tagGlobalChecksum = byte(1)
+	tagGlobalParts    = byte(2)
+)
+
+// MarshalBinary returns the canonical encoding of the statement.
+func (g *GlobalStatement) MarshalBinary() ([]byte, error) {
+	e := &encBuf{b: []byte{EncodingVersion, kindGlobal}}
+	e.bytesField(tagGlobalChecksum, g.Checksum)
+	if len(g.Parts) > 0 {
+		e.field(tagGlobalParts, func(e *encBuf) {
+			e.u32(len(g.Parts))
+			for _, s := range g.Parts {
+				e.str(string(canonical(s)))
+			}
+		})
+	}
+	return e.b, nil
+}
+
+// UnmarshalBinary parses a canonical encoding of a statement.
+func (g *GlobalStatement) UnmarshalBinary(b []byte) error {
+	*g = GlobalStatement{}
+	d := &decBuf{b: b}
+	d.header(kindGlobal)
+	d.fields(func(tag byte, f *decBuf) bool {
+		switch tag {
+		case tagGlobalChecksum:
+			g.Checksum, f.b = f.b, nil
+		case tagGlobalParts:
+			n := f.u32()
+			if n == 0 {
+				f.fail("field %d is empty", tag)
+			}
+			for i := 0; i < n && f.err == nil; i++ {
+				s := &SignedChecksum{}
+				if err := s.UnmarshalBinary(f.take(f.u32())); err != nil && f.err == nil {
+					f.err = err
+				}
+				g.Parts = append(g.Parts, s)
+			}
+		default:
+			return false
+		}
+		return true
+	})
+	return d.err
+}
+
+// Shards lists the shards of the statement.
+func (g *GlobalStatement) Shards() []Shard {
+	ids := make([]Shard, len(g.Parts))
+	for i, s := range g.Parts {
+		ids[i] = s.Shard
+	}
+	return ids
+}
+
+// sortShards sorts shards and drops duplicates.
+func sortShards(shards []Shard) []Shard {
+	ids := append([]Shard(nil), shards...)
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	out := ids[:0]
+	for i, shard := range ids {
+		if i == 0 || shard != ids[i-1] {
+			out = append(out, shard)
+		}
+	}
+	return out
+}
+
+// GlobalChecksum is the sum of the checksums of shards, which must all use
+// the same algorithm.  A shard the database has never seen is empty.
+func (db *Db) GlobalChecksum(shards ...Shard) (MultisetHash, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return db.globalChecksum(shards)
+}
+
+func (db *Db) globalChecksum(shards []Shard) (MultisetHash, error) {
+	if len(shards) == 0 {
+		return nil, fmt.Errorf("no shards: %w", ErrUnknownShard)
+	}
+	sum, err := NewMultisetHash(db.algorithmFor(shards[0]))
+	if err != nil {
+		return nil, err
+	}
+	for _, shard := range sortShards(shards) {
+		st, ok := db.State[shard]
+		if !ok {
+			if alg := db.algorithmFor(shard); alg != sum.Algorithm() {
+				return nil, fmt.Errorf("shard %d is %v, not %v: %w", shard, alg, sum.Algorithm(), ErrAlgorithmMismatch)
+			}
+			continue
+		}
+		if err := sum.Combine(st.Checksum); err != nil {
+			return nil, fmt.Errorf("shard %d: %w", shard, err)
+		}
+	}
+	return sum, nil
+}
+
+// GlobalStatement bundles a statement for each of shards.  A shard that this
+// database holds the key for is signed now; any other shard contributes the
+// last statement accepted from its writer, so the global checksum is of the
+// parts, which may be behind this replica.
+func (db *Db) GlobalStatement(shards ...Shard) (*GlobalStatement, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if len(shards) == 0 {
+		return nil, fmt.Errorf("no shards: %w", ErrUnknownShard)
+	}
+	g := &GlobalStatement{}
+	for _, shard := range sortShards(shards) {
+		if _, ok := db.quorums[shard]; ok {
+			return nil, fmt.Errorf("shard %d is signed for by a quorum: %w", shard, ErrQuorum)
+		}
+		var s *SignedChecksum
+		if st, ok := db.State[shard]; ok && st.KeyPair != nil {
+			var err error
+			if s, err = db.signChecksum(shard); err != nil {
+				return nil, err
+			}
+		} else if s = db.accepted[shard]; s == nil {
+			return nil, fmt.Errorf("shard %d has no signed checksum: %w", shard, ErrNoKey)
+		}
+		g.Parts = append(g.Parts, s)
+	}
+	sum, err := sumParts(g.Parts)
+	if err != nil {
+		return nil, err
+	}
+	g.Checksum = sum.Encode()
+	return g, nil
+}
+
+func sumParts(parts []*SignedChecksum) (MultisetHash, error) {
+	var sum MultisetHash
+	for _, s := range parts {
+		ck, err := DecodeMultisetHash(s.Checksum)
+		if err != nil {
+			return nil, fmt.Errorf("shard %d: %w", s.Shard, err)
+		}
+		if sum == nil {
+			sum = ck
+		} else if err := sum.Combine(ck); err != nil {
+			return nil, fmt.Errorf("shard %d: %w", s.Shard, err)
+		}
+	}
+	return sum, nil
+}
+
+// VerifyGlobal verifies every part of a global statement as VerifyChecksum
+// does, and that the global checksum is their sum.  The parts are accepted
+// only if all of them are.  Comparing the statement's checksum with this
+// replica's GlobalChecksum of its Shards then checks the whole replica.
+func (db *Db) VerifyGlobal(g *GlobalStatement) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if len(g.Parts) == 0 {
+		return fmt.Errorf("no shards: %w", ErrUnknownShard)
+	}
+	for i, s := range g.Parts {
+		if i > 0 && s.Shard <= g.Parts[i-1].Shard {
+			return fmt.Errorf("shard %d is out of order: %w", s.Shard, ErrNonCanonical)
+		}
+		if err := db.verifyChecksum(s); err != nil {
+			return err
+		}
+	}
+	sum, err := sumParts(g.Parts)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(sum.Encode(), g.Checksum) {
+		return fmt.Errorf("global checksum is not the sum of its parts: %w", ErrMismatch)
+	}
+	for _, s := range g.Parts {
+		db.accepted[s.Shard] = s
+	}
+	return nil
+}
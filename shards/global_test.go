@@ -0,0 +1,109 @@
+package shards
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"errors"
+	"testing"
+)
+
+func TestGlobalChecksum(t *testing.T) {
+	keys := []*ecdsa.PrivateKey{testKey, newKey(), newKey()}
+	opts := []Option{WithAlgorithm(LtHash16)}
+	for i, kp := range keys {
+		opts = append(opts, WithKeyPair(Shard(i+1), kp))
+	}
+	writer, _ := NewDB(1, opts...)
+	var records []*DataRecord
+	for i := 0; i < 12; i++ {
+		v, err := writer.Insert(&DataRecord{Shard: Shard(i%3 + 1), Ints: map[string]int64{"n": 1}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, v)
+	}
+	// records alike but for their shard are different elements
+	want, _ := ChecksumOf(LtHash16, DefaultDigester, records)
+	sum, _ := NewMultisetHash(LtHash16)
+	for _, shard := range []Shard{1, 2, 3} {
+		sum.Combine(writer.State[shard].Checksum)
+	}
+	got, err := writer.GlobalChecksum(3, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Encode(), want.Encode()) || !bytes.Equal(got.Encode(), sum.Encode()) {
+		t.Fatal("the global checksum isn't the sum of the shards")
+	}
+
+	g, err := writer.GlobalStatement(3, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(g.Checksum, want.Encode()) || len(g.Parts) != 3 || g.Parts[0].Shard != 1 {
+		t.Fatal("the statement isn't of the global checksum")
+	}
+	verifier := func() *Db {
+		opts := []Option{WithAlgorithm(LtHash16)}
+		for i, kp := range keys {
+			opts = append(opts, WithPublicKey(Shard(i+1), &kp.PublicKey))
+		}
+		v, _ := NewVerifier(opts...)
+		return v
+	}
+	// tampered is a copy of g, changed by f
+	tampered := func(f func(g *GlobalStatement)) *GlobalStatement {
+		var c GlobalStatement
+		if err := c.UnmarshalBinary(canonical(g)); err != nil {
+			t.Fatal(err)
+		}
+		f(&c)
+		return &c
+	}
+	for _, c := range []struct {
+		name string
+		f    func(g *GlobalStatement)
+		err  error
+	}{
+		{"part", func(g *GlobalStatement) { g.Parts[1].Checksum[1] ^= 1 }, ErrBadSignature},
+		{"checksum", func(g *GlobalStatement) { g.Checksum[1] ^= 1 }, ErrMismatch},
+		{"order", func(g *GlobalStatement) { g.Parts[0], g.Parts[1] = g.Parts[1], g.Parts[0] }, ErrNonCanonical},
+		{"shard", func(g *GlobalStatement) { g.Parts[2].Shard = 4 }, ErrNoKey},
+		{"key", func(g *GlobalStatement) { g.Parts[0].KeyId = g.Parts[1].KeyId }, ErrWrongKey},
+		{"missing", func(g *GlobalStatement) { g.Parts = g.Parts[:2] }, ErrMismatch},
+	} {
+		v := verifier()
+		if err := v.VerifyGlobal(tampered(c.f)); !errors.Is(err, c.err) {
+			t.Fatalf("%s: got %v, expected %v", c.name, err, c.err)
+		}
+		if len(v.Accepted()) != 0 {
+			t.Fatalf("%s: parts were accepted", c.name)
+		}
+	}
+	v := verifier()
+	if err := v.VerifyGlobal(g); err != nil {
+		t.Fatal(err)
+	}
+	if len(v.Accepted()) != 3 {
+		t.Fatal("the parts weren't accepted")
+	}
+}
+
+func TestGlobalMixedAlgorithms(t *testing.T) {
+	db, _ := NewDB(1, WithAlgorithm(LtHash16), WithShardAlgorithm(2, MuHash3072), WithKeyPair(1, testKey), WithKeyPair(2, newKey()))
+	db.Insert(&DataRecord{Shard: 1})
+	db.Insert(&DataRecord{Shard: 2})
+	if _, err := db.GlobalChecksum(1, 2); !errors.Is(err, ErrAlgorithmMismatch) {
+		t.Fatalf("got %v", err)
+	}
+	// a shard that was never written is still of its own algorithm
+	if _, err := db.GlobalChecksum(1, 3, 2); !errors.Is(err, ErrAlgorithmMismatch) {
+		t.Fatalf("got %v", err)
+	}
+	if _, err := db.GlobalStatement(1, 2); !errors.Is(err, ErrAlgorithmMismatch) {
+		t.Fatalf("got %v", err)
+	}
+	if _, err := db.GlobalChecksum(1, 3); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,131 @@
+package shards
+
+import (
+	"crypto"
+	"crypto/elliptic"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"math/big"
+)
+
+// Records are mapped to curve points with the hash_to_curve construction of
+// RFC 9380, using the simplified SWU map for the NIST curves.  Unlike
+// ScalarBaseMult(hash), nobody knows the discrete log of the resulting point,
+// so the sum of points is a multiset hash (ECMH) that can't be forged by
+// solving a linear system over the hashes.
+
+// h2cSuite holds the RFC 9380 parameters for one curve.
+type h2cSuite struct {
+	ID    string      // suite identifier, eg: P256_XMD:SHA-256_SSWU_RO_
+	Hash  crypto.Hash // hash used by expand_message_xmd
+	L     int         // bytes per field element
+	Z     *big.Int    // non-square for the SWU map
+	curve elliptic.Curve
+}
+
+var h2cSuites = []*h2cSuite{
+	{ID: "P256_XMD:SHA-256_SSWU_RO_", Hash: crypto.SHA256, L: 48, Z: big.NewInt(-10), curve: elliptic.P256()},
+	{ID: "P384_XMD:SHA-384_SSWU_RO_", Hash: crypto.SHA384, L: 72, Z: big.NewInt(-12), curve: elliptic.P384()},
+	{ID: "P521_XMD:SHA-512_SSWU_RO_", Hash: crypto.SHA512, L: 98, Z: big.NewInt(-4), curve: elliptic.P521()},
+}
+
+// expandMessageXMD is expand_message_xmd from RFC 9380 section 5.3.1.
+func expandMessageXMD(h crypto.Hash, msg, dst []byte, n int) []byte {
+	hf := h.New()
+	b := hf.Size()
+	ell := (n + b - 1) / b
+	if ell > 255 || n > 65535 || len(dst) > 255 {
+		panic("expand_message_xmd: requested length or dst too long")
+	}
+	dstPrime := append(append([]byte{}, dst...), byte(len(dst)))
+
+	hf.Write(make([]byte, hf.BlockSize()))
+	hf.Write(msg)
+	hf.Write([]byte{byte(n >> 8), byte(n), 0})
+	hf.Write(dstPrime)
+	b0 := hf.Sum(nil)
+
+	out := make([]byte, 0, ell*b)
+	bi := make([]byte, b)
+	for i := 1; i <= ell; i++ {
+		for j := range bi {
+			bi[j] ^= b0[j]
+		}
+		hf.Reset()
+		hf.Write(bi)
+		hf.Write([]byte{byte(i)})
+		hf.Write(dstPrime)
+		bi = hf.Sum(nil)
+		out = append(out, bi...)
+	}
+	return out[:n]
+}
+
+// hashToField is hash_to_field from RFC 9380 section 5.2, with m = 1.
+func (s *h2cSuite) hashToField(msg, dst []byte, count int) []*big.Int {
+	p := s.curve.Params().P
+	uniform := expandMessageXMD(s.Hash, msg, dst, count*s.L)
+	u := make([]*big.Int, count)
+	for i := range u {
+		u[i] = new(big.Int).SetBytes(uniform[i*s.L : (i+1)*s.L])
+		u[i].Mod(u[i], p)
+	}
+	return u
+}
+
+// mapToCurve is the simplified SWU map (RFC 9380 section 6.6.2) for curves
+// with a = -3.  All of the NIST primes are 3 mod 4, so square roots are a
+// single exponentiation.
+func (s *h2cSuite) mapToCurve(u *big.Int) (*big.Int, *big.Int) {
+	params := s.curve.Params()
+	p := params.P
+	a := new(big.Int).Sub(p, big.NewInt(3))
+	b := params.B
+	z := new(big.Int).Mod(s.Z, p)
+
+	mul := func(x, y *big.Int) *big.Int { return new(big.Int).Mod(new(big.Int).Mul(x, y), p) }
+	add := func(x, y *big.Int) *big.Int { return new(big.Int).Mod(new(big.Int).Add(x, y), p) }
+	inv0 := func(x *big.Int) *big.Int {
+		if x.Sign() == 0 {
+			return new(big.Int)
+		}
+		return new(big.Int).ModInverse(x, p)
+	}
+	g := func(x *big.Int) *big.Int { return add(add(mul(mul(x, x), x), mul(a, x)), b) }
+	sqrtExp := new(big.Int).Rsh(new(big.Int).Add(p, big.NewInt(1)), 2)
+	legendreExp := new(big.Int).Rsh(new(big.Int).Sub(p, big.NewInt(1)), 1)
+	isSquare := func(x *big.Int) bool {
+		l := new(big.Int).Exp(x, legendreExp, p)
+		return l.Sign() == 0 || l.Cmp(big.NewInt(1)) == 0
+	}
+
+	u2 := mul(u, u)
+	zu2 := mul(z, u2)
+	tv1 := inv0(add(mul(zu2, zu2), zu2))
+	var x1 *big.Int
+	if tv1.Sign() == 0 {
+		x1 = mul(b, inv0(mul(z, a)))
+	} else {
+		negBOverA := mul(new(big.Int).Sub(p, b), inv0(a))
+		x1 = mul(negBOverA, add(big.NewInt(1), tv1))
+	}
+	x, gx := x1, g(x1)
+	if !isSquare(gx) {
+		x = mul(zu2, x1)
+		gx = g(x)
+	}
+	y := new(big.Int).Exp(gx, sqrtExp, p)
+	if u.Bit(0) != y.Bit(0) {
+		y.Sub(p, y).Mod(y, p)
+	}
+	return x, y
+}
+
+// hashToCurve is hash_to_curve from RFC 9380 section 3.  The NIST curves
+// have cofactor 1, so no clearing is needed.
+func (s *h2cSuite) hashToCurve(msg, dst []byte) (*big.Int, *big.Int) {
+	u := s.hashToField(msg, dst, 2)
+	x0, y0 := s.mapToCurve(u[0])
+	x1, y1 := s.mapToCurve(u[1])
+	return s.curve.Add(x0, y0, x1, y1)
+}
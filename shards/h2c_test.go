@@ -0,0 +1,155 @@
+package shards
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/hex"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+// The known-answer vectors of RFC 9380 appendices J.1 and K.1.
+
+var (
+	q128 = "q128_" + strings.Repeat("q", 128)
+	a512 = "a512_" + strings.Repeat("a", 512)
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.TrimPrefix(s, "0x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestHashToCurveVectors(t *testing.T) {
+	tests := []struct {
+		suite string
+		msg   string
+		x, y  string
+	}{
+		{"P256_XMD:SHA-256_SSWU_RO_", "",
+			"2c15230b26dbc6fc9a37051158c95b79656e17a1a920b11394ca91c44247d3e4",
+			"8a7a74985cc5c776cdfe4b1f19884970453912e9d31528c060be9ab5c43e8415"},
+		{"P256_XMD:SHA-256_SSWU_RO_", "abc",
+			"0bb8b87485551aa43ed54f009230450b492fead5f1cc91658775dac4a3388a0f",
+			"5c41b3d0731a27a7b14bc0bf0ccded2d8751f83493404c84a88e71ffd424212e"},
+		{"P256_XMD:SHA-256_SSWU_RO_", "abcdef0123456789",
+			"65038ac8f2b1def042a5df0b33b1f4eca6bff7cb0f9c6c1526811864e544ed80",
+			"cad44d40a656e7aff4002a8de287abc8ae0482b5ae825822bb870d6df9b56ca3"},
+		{"P256_XMD:SHA-256_SSWU_RO_", q128,
+			"4be61ee205094282ba8a2042bcb48d88dfbb609301c49aa8b078533dc65a0b5d",
+			"98f8df449a072c4721d241a3b1236d3caccba603f916ca680f4539d2bfb3c29e"},
+		{"P256_XMD:SHA-256_SSWU_RO_", a512,
+			"457ae2981f70ca85d8e24c308b14db22f3e3862c5ea0f652ca38b5e49cd64bc5",
+			"ecb9f0eadc9aeed232dabc53235368c1394c78de05dd96893eefa62b0f4757dc"},
+		{"P384_XMD:SHA-384_SSWU_RO_", "",
+			"eb9fe1b4f4e14e7140803c1d99d0a93cd823d2b024040f9c067a8eca1f5a2eeac9ad604973527a356f3fa3aeff0e4d83",
+			"0c21708cff382b7f4643c07b105c2eaec2cead93a917d825601e63c8f21f6abd9abc22c93c2bed6f235954b25048bb1a"},
+		{"P384_XMD:SHA-384_SSWU_RO_", "abc",
+			"e02fc1a5f44a7519419dd314e29863f30df55a514da2d655775a81d413003c4d4e7fd59af0826dfaad4200ac6f60abe1",
+			"01f638d04d98677d65bef99aef1a12a70a4cbb9270ec55248c04530d8bc1f8f90f8a6a859a7c1f1ddccedf8f96d675f6"},
+		{"P384_XMD:SHA-384_SSWU_RO_", "abcdef0123456789",
+			"bdecc1c1d870624965f19505be50459d363c71a699a496ab672f9a5d6b78676400926fbceee6fcd1780fe86e62b2aa89",
+			"57cf1f99b5ee00f3c201139b3bfe4dd30a653193778d89a0accc5e0f47e46e4e4b85a0595da29c9494c1814acafe183c"},
+		{"P384_XMD:SHA-384_SSWU_RO_", q128,
+			"03c3a9f401b78c6c36a52f07eeee0ec1289f178adf78448f43a3850e0456f5dd7f7633dd31676d990eda32882ab486c0",
+			"cc183d0d7bdfd0a3af05f50e16a3f2de4abbc523215bf57c848d5ea662482b8c1f43dc453a93b94a8026db58f3f5d878"},
+		{"P384_XMD:SHA-384_SSWU_RO_", a512,
+			"7b18d210b1f090ac701f65f606f6ca18fb8d081e3bc6cbd937c5604325f1cdea4c15c10a54ef303aabf2ea58bd9947a4",
+			"ea857285a33abb516732915c353c75c576bf82ccc96adb63c094dde580021eddeafd91f8c0bfee6f636528f3d0c47fd2"},
+		{"P521_XMD:SHA-512_SSWU_RO_", "",
+			"00fd767cebb2452030358d0e9cf907f525f50920c8f607889a6a35680727f64f4d66b161fafeb2654bea0d35086bec0a10b30b14adef3556ed9f7f1bc23cecc9c088",
+			"0169ba78d8d851e930680322596e39c78f4fe31b97e57629ef6460ddd68f8763fd7bd767a4e94a80d3d21a3c2ee98347e024fc73ee1c27166dc3fe5eeef782be411d"},
+		{"P521_XMD:SHA-512_SSWU_RO_", "abc",
+			"002f89a1677b28054b50d15e1f81ed6669b5a2158211118ebdef8a6efc77f8ccaa528f698214e4340155abc1fa08f8f613ef14a043717503d57e267d57155cf784a4",
+			"010e0be5dc8e753da8ce51091908b72396d3deed14ae166f66d8ebf0a4e7059ead169ea4bead0232e9b700dd380b316e9361cfdba55a08c73545563a80966ecbb86d"},
+		{"P521_XMD:SHA-512_SSWU_RO_", "abcdef0123456789",
+			"006e200e276a4a81760099677814d7f8794a4a5f3658442de63c18d2244dcc957c645e94cb0754f95fcf103b2aeaf94411847c24187b89fb7462ad3679066337cbc4",
+			"001dd8dfa9775b60b1614f6f169089d8140d4b3e4012949b52f98db2deff3e1d97bf73a1fa4d437d1dcdf39b6360cc518d8ebcc0f899018206fded7617b654f6b168"},
+		{"P521_XMD:SHA-512_SSWU_RO_", q128,
+			"01b264a630bd6555be537b000b99a06761a9325c53322b65bdc41bf196711f9708d58d34b3b90faf12640c27b91c70a507998e55940648caa8e71098bf2bc8d24664",
+			"01ea9f445bee198b3ee4c812dcf7b0f91e0881f0251aab272a12201fd89b1a95733fd2a699c162b639e9acdcc54fdc2f6536129b6beb0432be01aa8da02df5e59aaa"},
+		{"P521_XMD:SHA-512_SSWU_RO_", a512,
+			"00c12bc3e28db07b6b4d2a2b1167ab9e26fc2fa85c7b0498a17b0347edf52392856d7e28b8fa7a2dd004611159505835b687ecf1a764857e27e9745848c436ef3925",
+			"01cd287df9a50c22a9231beb452346720bb163344a41c5f5a24e8335b6ccc595fd436aea89737b1281aecb411eb835f0b939073fdd1dd4d5a2492e91ef4a3c55bcbd"},
+	}
+	for _, test := range tests {
+		var suite *h2cSuite
+		for _, s := range h2cSuites {
+			if s.ID == test.suite {
+				suite = s
+			}
+		}
+		if suite == nil {
+			t.Fatalf("no suite %s", test.suite)
+		}
+		x, y := suite.hashToCurve([]byte(test.msg), []byte("QUUX-V01-CS02-with-"+suite.ID))
+		if x.Cmp(new(big.Int).SetBytes(unhex(t, test.x))) != 0 || y.Cmp(new(big.Int).SetBytes(unhex(t, test.y))) != 0 {
+			t.Errorf("%s %.20q: got (%x, %x)", test.suite, test.msg, x, y)
+		}
+	}
+}
+
+func TestExpandMessageXMDVectors(t *testing.T) {
+	tests := []struct {
+		hash     crypto.Hash
+		msg      string
+		n        int
+		expected string
+	}{
+		{crypto.SHA256, "", 32,
+			"68a985b87eb6b46952128911f2a4412bbc302a9d759667f87f7a21d803f07235"},
+		{crypto.SHA256, "abc", 32,
+			"d8ccab23b5985ccea865c6c97b6e5b8350e794e603b4b97902f53a8a0d605615"},
+		{crypto.SHA256, "abcdef0123456789", 32,
+			"eff31487c770a893cfb36f912fbfcbff40d5661771ca4b2cb4eafe524333f5c1"},
+		{crypto.SHA256, q128, 32,
+			"b23a1d2b4d97b2ef7785562a7e8bac7eed54ed6e97e29aa51bfe3f12ddad1ff9"},
+		{crypto.SHA256, a512, 32,
+			"4623227bcc01293b8c130bf771da8c298dede7383243dc0993d2d94823958c4c"},
+		{crypto.SHA256, "", 128,
+			"af84c27ccfd45d41914fdff5df25293e221afc53d8ad2ac06d5e3e29485dadbee0d121587713a3e0dd4d5e69e93eb7cd4f5df4cd103e188cf60cb02edc3edf18eda8576c412b18ffb658e3dd6ec849469b979d444cf7b26911a08e63cf31f9dcc541708d3491184472c2c29bb749d4286b004ceb5ee6b9a7fa5b646c993f0ced"},
+		{crypto.SHA256, "abc", 128,
+			"abba86a6129e366fc877aab32fc4ffc70120d8996c88aee2fe4b32d6c7b6437a647e6c3163d40b76a73cf6a5674ef1d890f95b664ee0afa5359a5c4e07985635bbecbac65d747d3d2da7ec2b8221b17b0ca9dc8a1ac1c07ea6a1e60583e2cb00058e77b7b72a298425cd1b941ad4ec65e8afc50303a22c0f99b0509b4c895f40"},
+		{crypto.SHA256, "abcdef0123456789", 128,
+			"ef904a29bffc4cf9ee82832451c946ac3c8f8058ae97d8d629831a74c6572bd9ebd0df635cd1f208e2038e760c4994984ce73f0d55ea9f22af83ba4734569d4bc95e18350f740c07eef653cbb9f87910d833751825f0ebefa1abe5420bb52be14cf489b37fe1a72f7de2d10be453b2c9d9eb20c7e3f6edc5a60629178d9478df"},
+		{crypto.SHA256, q128, 128,
+			"80be107d0884f0d881bb460322f0443d38bd222db8bd0b0a5312a6fedb49c1bbd88fd75d8b9a09486c60123dfa1d73c1cc3169761b17476d3c6b7cbbd727acd0e2c942f4dd96ae3da5de368d26b32286e32de7e5a8cb2949f866a0b80c58116b29fa7fabb3ea7d520ee603e0c25bcaf0b9a5e92ec6a1fe4e0391d1cdbce8c68a"},
+		{crypto.SHA256, a512, 128,
+			"546aff5444b5b79aa6148bd81728704c32decb73a3ba76e9e75885cad9def1d06d6792f8a7d12794e90efed817d96920d728896a4510864370c207f99bd4a608ea121700ef01ed879745ee3e4ceef777eda6d9e5e38b90c86ea6fb0b36504ba4a45d22e86f6db5dd43d98a294bebb9125d5b794e9d2a81181066eb954966a487"},
+		{crypto.SHA512, "", 32,
+			"6b9a7312411d92f921c6f68ca0b6380730a1a4d982c507211a90964c394179ba"},
+		{crypto.SHA512, "abc", 32,
+			"0da749f12fbe5483eb066a5f595055679b976e93abe9be6f0f6318bce7aca8dc"},
+		{crypto.SHA512, "abcdef0123456789", 32,
+			"087e45a86e2939ee8b91100af1583c4938e0f5fc6c9db4b107b83346bc967f58"},
+		{crypto.SHA512, q128, 32,
+			"7336234ee9983902440f6bc35b348352013becd88938d2afec44311caf8356b3"},
+		{crypto.SHA512, a512, 32,
+			"57b5f7e766d5be68a6bfe1768e3c2b7f1228b3e4b3134956dd73a59b954c66f4"},
+		{crypto.SHA512, "", 128,
+			"41b037d1734a5f8df225dd8c7de38f851efdb45c372887be655212d07251b921b052b62eaed99b46f72f2ef4cc96bfaf254ebbbec091e1a3b9e4fb5e5b619d2e0c5414800a1d882b62bb5cd1778f098b8eb6cb399d5d9d18f5d5842cf5d13d7eb00a7cff859b605da678b318bd0e65ebff70bec88c753b159a805d2c89c55961"},
+		{crypto.SHA512, "abc", 128,
+			"7f1dddd13c08b543f2e2037b14cefb255b44c83cc397c1786d975653e36a6b11bdd7732d8b38adb4a0edc26a0cef4bb45217135456e58fbca1703cd6032cb1347ee720b87972d63fbf232587043ed2901bce7f22610c0419751c065922b488431851041310ad659e4b23520e1772ab29dcdeb2002222a363f0c2b1c972b3efe1"},
+		{crypto.SHA512, "abcdef0123456789", 128,
+			"3f721f208e6199fe903545abc26c837ce59ac6fa45733f1baaf0222f8b7acb0424814fcb5eecf6c1d38f06e9d0a6ccfbf85ae612ab8735dfdf9ce84c372a77c8f9e1c1e952c3a61b7567dd0693016af51d2745822663d0c2367e3f4f0bed827feecc2aaf98c949b5ed0d35c3f1023d64ad1407924288d366ea159f46287e61ac"},
+		{crypto.SHA512, q128, 128,
+			"b799b045a58c8d2b4334cf54b78260b45eec544f9f2fb5bd12fb603eaee70db7317bf807c406e26373922b7b8920fa29142703dd52bdf280084fb7ef69da78afdf80b3586395b433dc66cde048a258e476a561e9deba7060af40adf30c64249ca7ddea79806ee5beb9a1422949471d267b21bc88e688e4014087a0b592b695ed"},
+		{crypto.SHA512, a512, 128,
+			"05b0bfef265dcee87654372777b7c44177e2ae4c13a27f103340d9cd11c86cb2426ffcad5bd964080c2aee97f03be1ca18e30a1f14e27bc11ebbd650f305269cc9fb1db08bf90bfc79b42a952b46daf810359e7bc36452684784a64952c343c52e5124cd1f71d474d5197fefc571a92929c9084ffe1112cf5eea5192ebff330b"},
+	}
+	dst := map[crypto.Hash]string{
+		crypto.SHA256: "QUUX-V01-CS02-with-expander-SHA256-128",
+		crypto.SHA512: "QUUX-V01-CS02-with-expander-SHA512-256",
+	}
+	for _, test := range tests {
+		b := expandMessageXMD(test.hash, []byte(test.msg), []byte(dst[test.hash]), test.n)
+		if !bytes.Equal(b, unhex(t, test.expected)) {
+			t.Errorf("%v %.20q %d: got %x", test.hash, test.msg, test.n, b)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package shards
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Secondary indexes find records by the value of a named field of their Ints
+// or Strings, without scanning the shard.  An index is declared for the
+// database with WithIntIndex or WithStringIndex (or added later), and each
+// shard builds its own the first time it is queried.  From then on put and
+// del keep it in step with the shard's records, so whatever inserts, removes,
+// renews, replaces, expires or syncs a record updates it too.  An index is
+// the (value, id) of every record with the field, in order, which is also
+// the order that queries return records in and page through them.
+
+// WithIntIndex indexes the records of every shard by these Ints fields.
+func WithIntIndex(fields ...string) Option {
+	return func(db *Db) {
+		for _, field := range fields {
+			db.indexes[indexKey{field: field}] = true
+		}
+	}
+}
+
+// WithStringIndex indexes the records of every shard by these Strings
+// fields.
+func WithStringIndex(fields ...string) Option {
+	return func(db *Db) {
+		for _, field := range fields {
+			db.indexes[indexKey{field: field, strings: true}] = true
+		}
+	}
+}
+
+// AddIntIndex indexes the records of every shard by an Ints field.
+func (db *Db) AddIntIndex(field string) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.indexes[indexKey{field: field}] = true
+}
+
+// AddStringIndex indexes the records of every shard by a Strings field.
+func (db *Db) AddStringIndex(field string) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.indexes[indexKey{field: field, strings: true}] = true
+}
+
+type indexKey struct {
+	field   string
+	strings bool
+}
+
+// indexEntry is a record's value of an indexed field.
+type indexEntry struct {
+	i  int64
+	s  string
+	id Id
+}
+
+type index struct {
+	strings bool
+	entries []indexEntry
+}
+
+func (x *index) less(a, b indexEntry) bool {
+	if x.strings {
+		if a.s != b.s {
+			return a.s < b.s
+		}
+	} else if a.i != b.i {
+		return a.i < b.i
+	}
+	return a.id < b.id
+}
+
+// search returns the position of the first entry that isn't less than e.
+func (x *index) search(e indexEntry) int {
+	return sort.Search(len(x.entries), func(i int) bool { return !x.less(x.entries[i], e) })
+}
+
+func (x *index) insert(e indexEntry) {
+	i := x.search(e)
+	x.entries = append(x.entries, indexEntry{})
+	copy(x.entries[i+1:], x.entries[i:])
+	x.entries[i] = e
+}
+
+func (x *index) remove(e indexEntry) {
+	if i := x.search(e); i < len(x.entries) && x.entries[i] == e {
+		x.entries = append(x.entries[:i], x.entries[i+1:]...)
+	}
+}
+
+// entryOf returns a record's entry in an index, if it has the field.
+func (k indexKey) entryOf(v *DataRecord) (indexEntry, bool) {
+	if k.strings {
+		s, ok := v.Strings[k.field]
+		return indexEntry{s: s, id: v.Id}, ok
+	}
+	i, ok := v.Ints[k.field]
+	return indexEntry{i: i, id: v.Id}, ok
+}
+
+// index adds a record to the shard's indexes, or takes it out of them.
+func (st *State) index(v *DataRecord, add bool) {
+	for k, x := range st.indexes {
+		if e, ok := k.entryOf(v); !ok {
+			continue
+		} else if add {
+			x.insert(e)
+		} else {
+			x.remove(e)
+		}
+	}
+}
+
+// indexFor returns the shard's index of a field, building it the first time.
+func (db *Db) indexFor(st *State, k indexKey) (*index, error) {
+	if !db.indexes[k] {
+		return nil, fmt.Errorf("field %q: %w", k.field, ErrNoIndex)
+	}
+	if x, ok := st.indexes[k]; ok {
+		return x, nil
+	}
+	x := &index{strings: k.strings}
+	for _, v := range st.Data {
+		if e, ok := k.entryOf(v); ok {
+			x.entries = append(x.entries, e)
+		}
+	}
+	sort.Slice(x.entries, func(i, j int) bool { return x.less(x.entries[i], x.entries[j]) })
+	if st.indexes == nil {
+		st.indexes = make(map[indexKey]*index)
+	}
+	st.indexes[k] = x
+	return x, nil
+}
+
+// Filter selects the records whose value of an indexed field is in a range,
+// or has a prefix.
+type Filter struct {
+	key    indexKey
+	lo, hi indexEntry
+	// isPrefix filters on the prefix instead of hi
+	prefix   string
+	isPrefix bool
+}
+
+// IntEq selects records whose Ints field is v.
+func IntEq(field string, v int64) Filter {
+	return IntRange(field, v, v)
+}
+
+// IntRange selects records whose Ints field is from lo to hi, inclusive.
+func IntRange(field string, lo, hi int64) Filter {
+	return Filter{key: indexKey{field: field}, lo: indexEntry{i: lo}, hi: indexEntry{i: hi}}
+}
+
+// StringEq selects records whose Strings field is s.
+func StringEq(field string, s string) Filter {
+	return StringRange(field, s, s)
+}
+
+// StringRange selects records whose Strings field is from lo to hi,
+// inclusive.
+func StringRange(field string, lo, hi string) Filter {
+	return Filter{key: indexKey{field: field, strings: true}, lo: indexEntry{s: lo}, hi: indexEntry{s: hi}}
+}
+
+// StringPrefix selects records whose Strings field starts with prefix.
+func StringPrefix(field string, prefix string) Filter {
+	return Filter{key: indexKey{field: field, strings: true}, lo: indexEntry{s: prefix}, prefix: prefix, isPrefix: true}
+}
+
+// matches tells whether an entry at or after the filter's start is still in
+// it; once one isn't, none after it are.
+func (f *Filter) matches(e indexEntry) bool {
+	if f.isPrefix {
+		return strings.HasPrefix(e.s, f.prefix)
+	}
+	if f.key.strings {
+		return e.s <= f.hi.s
+	}
+	return e.i <= f.hi.i
+}
+
+// Cursor is where a page of a query ended, and the next one starts after.
+type Cursor struct {
+	Int    int64  `json:"int,omitempty"`
+	String string `json:"string,omitempty"`
+	Id     Id     `json:"id,omitempty"`
+}
+
+// Query returns up to limit records of a shard that f selects, in the order
+// of the field's value and then id, starting after the cursor if it isn't
+// nil.  It returns the cursor of the next page, or nil if this is the last.
+func (db *Db) Query(shard Shard, f Filter, after *Cursor, limit int) ([]*DataRecord, *Cursor, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if !db.indexes[f.key] {
+		return nil, nil, fmt.Errorf("field %q: %w", f.key.field, ErrNoIndex)
+	}
+	st, ok := db.State[shard]
+	if !ok || limit <= 0 {
+		return nil, nil, nil
+	}
+	x, err := db.indexFor(st, f.key)
+	if err != nil {
+		return nil, nil, err
+	}
+	i := x.search(f.lo)
+	if after != nil {
+		c := indexEntry{i: after.Int, s: after.String, id: after.Id}
+		if j := x.search(c); j > i {
+			i = j
+		}
+		if i < len(x.entries) && x.entries[i] == c {
+			i++
+		}
+	}
+	var records []*DataRecord
+	for ; i < len(x.entries) && f.matches(x.entries[i]); i++ {
+		if len(records) == limit {
+			e := x.entries[i-1]
+			return records, &Cursor{Int: e.i, String: e.s, Id: e.id}, nil
+		}
+		records = append(records, st.Data[x.entries[i].id])
+	}
+	return records, nil, nil
+}
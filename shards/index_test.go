@@ -0,0 +1,148 @@
+package shards
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// brute is what a filter selects, found by scanning the shard.
+func brute(db *Db, field string, strings bool, match func(v *DataRecord) bool) []Id {
+	var records []*DataRecord
+	for _, v := range db.List(1, 0, 1<<20) {
+		if match(v) {
+			records = append(records, v)
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		a, b := records[i], records[j]
+		if strings {
+			return a.Strings[field] < b.Strings[field]
+		}
+		return a.Ints[field] < b.Ints[field]
+	})
+	ids := []Id{}
+	for _, v := range records {
+		ids = append(ids, v.Id)
+	}
+	return ids
+}
+
+// paged runs a query a page at a time.
+func paged(t *testing.T, db *Db, f Filter, limit int) []Id {
+	t.Helper()
+	ids := []Id{}
+	var after *Cursor
+	for {
+		records, next, err := db.Query(1, f, after, limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) > limit || (next != nil && len(records) != limit) {
+			t.Fatalf("a page of %d records, limit %d, cursor %v", len(records), limit, next)
+		}
+		for _, v := range records {
+			ids = append(ids, v.Id)
+		}
+		if next == nil {
+			return ids
+		}
+		after = next
+	}
+}
+
+// checkQueries compares every kind of filter with a scan of the shard.
+func checkQueries(t *testing.T, db *Db) {
+	t.Helper()
+	ints := func(lo, hi int64) func(v *DataRecord) bool {
+		return func(v *DataRecord) bool {
+			n, ok := v.Ints["n"]
+			return ok && lo <= n && n <= hi
+		}
+	}
+	strs := func(lo, hi string) func(v *DataRecord) bool {
+		return func(v *DataRecord) bool {
+			s, ok := v.Strings["name"]
+			return ok && lo <= s && s <= hi
+		}
+	}
+	for _, c := range []struct {
+		f     Filter
+		match func(v *DataRecord) bool
+	}{
+		{IntEq("n", 5), ints(5, 5)},
+		{IntRange("n", 3, 9), ints(3, 9)},
+		{IntRange("n", -5, -1), ints(-5, -1)},
+		{IntRange("n", 0, 100), ints(0, 100)},
+		{StringEq("name", "b07"), strs("b07", "b07")},
+		{StringRange("name", "a05", "b10"), strs("a05", "b10")},
+		{StringPrefix("name", "b1"), strs("b1", "b1\xff")},
+		{StringPrefix("name", ""), strs("", "\xff")},
+	} {
+		want := brute(db, c.f.key.field, c.f.key.strings, c.match)
+		for _, limit := range []int{1, 7, 1000} {
+			if got := paged(t, db, c.f, limit); fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Fatalf("%+v limit %d: %v, expected %v", c.f, limit, got, want)
+			}
+		}
+	}
+}
+
+func TestQuery(t *testing.T) {
+	db, _ := NewDB(1, WithAlgorithm(LtHash16), WithIntIndex("n"), WithStringIndex("name"))
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		v := &DataRecord{Shard: 1}
+		if i%10 != 0 {
+			v.Ints = map[string]int64{"n": int64(r.Intn(20))}
+		}
+		if i%10 != 5 {
+			v.Strings = map[string]string{"name": fmt.Sprintf("%c%02d", 'a'+r.Intn(3), r.Intn(17))}
+		}
+		if _, err := db.Insert(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkQueries(t, db)
+
+	// the indexes follow removes, replaces and failed batches
+	for id := Id(1); id <= 200; id += 9 {
+		if _, err := db.Remove(db.Get(1, id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for id := Id(3); id <= 200; id += 11 {
+		old := db.Get(1, id)
+		if old == nil {
+			continue
+		}
+		v := *old
+		v.Ints = map[string]int64{"n": int64(r.Intn(20))}
+		v.Strings = map[string]string{"name": fmt.Sprintf("c%02d", r.Intn(17))}
+		if _, err := db.Replace(&v, db.Digest(old)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b := Batch{Commands: []Command{
+		{Action: ActionInsert, Record: &DataRecord{Shard: 1, Ints: map[string]int64{"n": 5}, Strings: map[string]string{"name": "b07"}}},
+		{Action: ActionRemove, Record: db.Get(1, 2)},
+		{Action: ActionInsert, Record: &DataRecord{Shard: 1, Id: 4}},
+	}}
+	if _, err := db.DoBatch(b); !errors.Is(err, ErrExists) {
+		t.Fatalf("got %v", err)
+	}
+	checkQueries(t, db)
+
+	if _, _, err := db.Query(1, IntEq("missing", 1), nil, 10); !errors.Is(err, ErrNoIndex) {
+		t.Fatalf("got %v", err)
+	}
+	if _, _, err := db.Query(1, StringEq("n", "1"), nil, 10); !errors.Is(err, ErrNoIndex) {
+		t.Fatalf("got %v", err)
+	}
+	db.AddIntIndex("missing")
+	if records, next, err := db.Query(1, IntEq("missing", 1), nil, 10); err != nil || len(records) != 0 || next != nil {
+		t.Fatalf("got %v %v %v", records, next, err)
+	}
+}
@@ -0,0 +1,283 @@
+package shards
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"fmt"
+)
+
+// A shard's writer key can change.  A KeyHandoff names the key that signs
+// for the shard from a version on, and is signed by the key before it, so
+// the handoffs form a chain from the shard's registered key to its current
+// one.  Every key in the chain signs for the versions from its handoff up to
+// the next, so an old statement is checked against the key that was valid
+// when it was made.
+//
+// A key that is compromised is revoked by a handoff signed by an earlier key
+// in the chain, which the writer can keep offline for the purpose.  The
+// revoked key, and every key after it, can no longer sign anything at all,
+// since nobody can tell what they signed from what an attacker did.
+//
+// A handoff is applied as an ActionRotate command, so it is logged, replayed
+// and snapshotted like any other.  It is encoded like a record, as kind 9:
+//
+//  1 shard, 2 seq, 3 key, 4 signer, 5 revoke, 6 and 7 the r and s of the
+//  signature
+//
+// The keys are PKIX encoded, and the signature is over the SHA-256 of the
+// encoding without it.
+
+type KeyHandoff struct {
+	Shard Shard `json:"shard,omitempty"`
+	// Seq is the shard's version from which Key signs for it
+	Seq    int64  `json:"seq,omitempty"`
+	Key    []byte `json:"key,omitempty"`
+	Signer []byte `json:"signer,omitempty"`
+	// Revoke is a key in the chain that is compromised, if any
+	Revoke []byte `json:"revoke,omitempty"`
+	Sig    Point  `json:"sig,omitempty"`
+}
+
+const kindKeyHandoff = byte(9)
+
+// KeyHandoff field tags
+const (
+	tagHandoffShard  = byte(1)
+	tagHandoffSeq    = byte(2)
+	tagHandoffKey    = byte(3)
+	tagHandoffSigner = byte(4)
+	tagHandoffRevoke = byte(5)
+	tagHandoffSigR   = byte(6)
+	tagHandoffSigS   = byte(7)
+)
+
+// MarshalBinary returns the canonical encoding of the handoff.
+func (h *KeyHandoff) MarshalBinary() ([]byte, error) {
+	e := &encBuf{b: []byte{EncodingVersion, kindKeyHandoff}}
+	e.intField(tagHandoffShard, int64(h.Shard))
+	e.intField(tagHandoffSeq, h.Seq)
+	e.bytesField(tagHandoffKey, h.Key)
+	e.bytesField(tagHandoffSigner, h.Signer)
+	e.bytesField(tagHandoffRevoke, h.Revoke)
+	e.sigFields(tagHandoffSigR, h.Sig)
+	return e.b, nil
+}
+
+// UnmarshalBinary parses a canonical encoding of a handoff.
+func (h *KeyHandoff) UnmarshalBinary(b []byte) error {
+	*h = KeyHandoff{}
+	d := &decBuf{b: b}
+	d.header(kindKeyHandoff)
+	d.fields(func(tag byte, f *decBuf) bool {
+		switch tag {
+		case tagHandoffShard:
+			h.Shard = Shard(f.nonZero(tag, f.i64()))
+		case tagHandoffSeq:
+			h.Seq = f.nonZero(tag, f.i64())
+		case tagHandoffKey:
+			h.Key, f.b = f.b, nil
+		case tagHandoffSigner:
+			h.Signer, f.b = f.b, nil
+		case tagHandoffRevoke:
+			h.Revoke, f.b = f.b, nil
+		case tagHandoffSigR:
+			h.Sig.X = f.bigInt(tag)
+		case tagHandoffSigS:
+			h.Sig.Y = f.bigInt(tag)
+		default:
+			return false
+		}
+		return true
+	})
+	return d.err
+}
+
+func (h *KeyHandoff) message() []byte {
+	unsigned := *h
+	unsigned.Sig = Point{}
+	s := sha256.Sum256(canonical(&unsigned))
+	return s[:]
+}
+
+// chainKey is a key of a shard's chain, and the versions it signs for.
+type chainKey struct {
+	pub     *ecdsa.PublicKey
+	der     []byte
+	from    int64
+	until   int64 // 0 while it is the current key
+	revoked bool
+}
+
+func (k *chainKey) signsFor(seq int64) bool {
+	return !k.revoked && k.from <= seq && (k.until == 0 || seq < k.until)
+}
+
+// keyChain walks the handoffs from root, checking their signatures if
+// verify is set, and returns every key of the chain, the current one last.
+func keyChain(root *ecdsa.PublicKey, handoffs []*KeyHandoff, verify bool) ([]*chainKey, error) {
+	der, err := x509.MarshalPKIXPublicKey(root)
+	if err != nil {
+		return nil, err
+	}
+	keys := []*chainKey{{pub: root, der: der}}
+	find := func(der []byte) int {
+		for i, k := range keys {
+			if bytes.Equal(k.der, der) {
+				return i
+			}
+		}
+		return -1
+	}
+	for n, h := range handoffs {
+		current := keys[len(keys)-1]
+		signer := find(h.Signer)
+		if signer < 0 || keys[signer].revoked {
+			return nil, fmt.Errorf("shard %d handoff %d is not signed by the chain: %w", h.Shard, n, ErrWrongKey)
+		}
+		if h.Seq <= current.from {
+			return nil, fmt.Errorf("shard %d handoff %d at %d, after %d: %w", h.Shard, n, h.Seq, current.from, ErrStale)
+		}
+		if verify && (h.Sig.X == nil || h.Sig.Y == nil || !ecdsa.Verify(keys[signer].pub, h.message(), h.Sig.X, h.Sig.Y)) {
+			return nil, fmt.Errorf("shard %d handoff %d: %w", h.Shard, n, ErrBadSignature)
+		}
+		next, err := parsePublicKey(h.Key)
+		if err != nil {
+			return nil, fmt.Errorf("shard %d handoff %d: %w", h.Shard, n, err)
+		}
+		if len(h.Revoke) == 0 {
+			if signer != len(keys)-1 {
+				return nil, fmt.Errorf("shard %d handoff %d is not signed by the current key: %w", h.Shard, n, ErrWrongKey)
+			}
+		} else {
+			revoked := find(h.Revoke)
+			if revoked <= signer {
+				return nil, fmt.Errorf("shard %d handoff %d revokes a key it doesn't come before: %w", h.Shard, n, ErrWrongKey)
+			}
+			for _, k := range keys[revoked:] {
+				k.revoked = true
+			}
+		}
+		current.until = h.Seq
+		keys = append(keys, &chainKey{pub: next, der: h.Key, from: h.Seq})
+	}
+	return keys, nil
+}
+
+// chain returns the keys of a shard's chain, from its registered key.
+func (db *Db) chain(shard Shard) ([]*chainKey, error) {
+	root, ok := db.pubs[shard]
+	if !ok {
+		return nil, fmt.Errorf("shard %d: %w", shard, ErrNoKey)
+	}
+	var handoffs []*KeyHandoff
+	if st, ok := db.State[shard]; ok {
+		handoffs = st.Keys
+	}
+	return keyChain(root, handoffs, false)
+}
+
+// currentKey is the public key that signs for a shard now, or nil.
+func (db *Db) currentKey(shard Shard) *ecdsa.PublicKey {
+	keys, err := db.chain(shard)
+	if err != nil {
+		return nil
+	}
+	return keys[len(keys)-1].pub
+}
+
+// signer returns the shard's private key, if it is the current key.
+func (db *Db) signer(shard Shard) (*ecdsa.PrivateKey, error) {
+	st, ok := db.State[shard]
+	if !ok || st.KeyPair == nil {
+		return nil, fmt.Errorf("shard %d: %w", shard, ErrNoKey)
+	}
+	if pub := db.currentKey(shard); pub == nil || !samePublicKey(pub, &st.KeyPair.PublicKey) {
+		return nil, fmt.Errorf("shard %d is no longer signed for by this key: %w", shard, ErrWrongKey)
+	}
+	return st.KeyPair, nil
+}
+
+// KeyChain returns the handoffs of a shard, oldest first.
+func (db *Db) KeyChain(shard Shard) []*KeyHandoff {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	st, ok := db.State[shard]
+	if !ok {
+		return nil
+	}
+	return append([]*KeyHandoff(nil), st.Keys...)
+}
+
+// RotateKey hands a shard over from its current key to next, which signs
+// for it from then on.
+func (db *Db) RotateKey(shard Shard, next *ecdsa.PrivateKey) (*KeyHandoff, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	kp, err := db.signer(shard)
+	if err != nil {
+		return nil, err
+	}
+	return db.handoff(shard, kp, nil, next)
+}
+
+// RevokeKey revokes a compromised key of a shard's chain, and every key
+// after it, handing the shard over to next.  It is signed by signer, which
+// must be a key of the chain from before the compromised one.
+func (db *Db) RevokeKey(shard Shard, signer *ecdsa.PrivateKey, revoked *ecdsa.PublicKey, next *ecdsa.PrivateKey) (*KeyHandoff, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	der, err := x509.MarshalPKIXPublicKey(revoked)
+	if err != nil {
+		return nil, err
+	}
+	return db.handoff(shard, signer, der, next)
+}
+
+func (db *Db) handoff(shard Shard, signer *ecdsa.PrivateKey, revoke []byte, next *ecdsa.PrivateKey) (*KeyHandoff, error) {
+	st, err := db.state(shard)
+	if err != nil {
+		return nil, err
+	}
+	h := &KeyHandoff{Shard: shard, Seq: st.Version + 1, Revoke: revoke}
+	if h.Key, err = x509.MarshalPKIXPublicKey(&next.PublicKey); err != nil {
+		return nil, err
+	}
+	if h.Signer, err = x509.MarshalPKIXPublicKey(&signer.PublicKey); err != nil {
+		return nil, err
+	}
+	r, s, err := ecdsa.Sign(rand.Reader, signer, h.message())
+	if err != nil {
+		return nil, err
+	}
+	h.Sig = Point{X: r, Y: s}
+	if _, err := db.do(Command{Action: ActionRotate, Handoff: h}, db.clock.Now()); err != nil {
+		return nil, err
+	}
+	db.keys[shard] = next
+	st.KeyPair = next
+	return h, nil
+}
+
+func (db *Db) rotate(t *tx, h *KeyHandoff) error {
+	st, err := db.state(h.Shard)
+	if err != nil {
+		return err
+	}
+	if h.Seq != st.Version+1 {
+		return fmt.Errorf("shard %d handoff at %d, at version %d: %w", h.Shard, h.Seq, st.Version, ErrStale)
+	}
+	if !t.replay {
+		root, ok := db.pubs[h.Shard]
+		if !ok {
+			return fmt.Errorf("shard %d: %w", h.Shard, ErrNoKey)
+		}
+		if _, err := keyChain(root, append(st.Keys[:len(st.Keys):len(st.Keys)], h), true); err != nil {
+			return err
+		}
+	}
+	st.addHandoff(t, h)
+	return nil
+}
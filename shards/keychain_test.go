@@ -0,0 +1,154 @@
+package shards
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func newKey() *ecdsa.PrivateKey {
+	kp, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	return kp
+}
+
+// signAs makes a statement for a shard's current checksum, signed by any key.
+func signAs(t *testing.T, db *Db, kp *ecdsa.PrivateKey) *SignedChecksum {
+	t.Helper()
+	st := db.State[1]
+	id, _ := KeyId(&kp.PublicKey)
+	s := &SignedChecksum{Shard: 1, Algorithm: st.Algorithm, Checksum: st.Checksum.Encode(), Seq: st.Version, KeyId: id}
+	r, sig, err := ecdsa.Sign(rand.Reader, kp, s.message())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Sig = Point{X: r, Y: sig}
+	return s
+}
+
+func TestRotateKey(t *testing.T) {
+	dir := tempDir(t)
+	writer, wal := testDb(t, dir)
+	writer.Insert(&DataRecord{Shard: 1})
+	before, _ := writer.SignChecksum(1)
+	next := newKey()
+	if _, err := writer.RotateKey(1, next); err != nil {
+		t.Fatal(err)
+	}
+	writer.Insert(&DataRecord{Shard: 1})
+	after, err := writer.SignChecksum(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := KeyId(&next.PublicKey); string(after.KeyId) != string(id) {
+		t.Fatal("the statement isn't signed by the new key")
+	}
+
+	// a replica that only knows the first key follows the chain
+	replica := testReplica()
+	if err := replica.SyncFrom(http.DefaultClient, serve(t, writer.ReplicationHandler())); err != nil {
+		t.Fatal(err)
+	}
+	if last := replica.LastChecksum(1); last == nil || last.Seq != after.Seq {
+		t.Fatalf("the replica accepted %v", last)
+	}
+	// the old key signed for the old versions only
+	if err := replica.VerifyChecksum(signAs(t, writer, testKey)); !errors.Is(err, ErrWrongKey) {
+		t.Fatalf("got %v", err)
+	}
+	if err := writer.VerifyChecksum(before); err != nil {
+		t.Fatal(err)
+	}
+
+	// the chain survives a snapshot and a replay
+	if err := writer.Compact(1); err != nil {
+		t.Fatal(err)
+	}
+	wal.Close()
+	again, wal := testDb(t, dir, WithPublicKey(1, &testKey.PublicKey), WithKeyPair(1, next))
+	defer wal.Close()
+	sameShard(t, writer, again, 1)
+	if len(again.KeyChain(1)) != 1 {
+		t.Fatalf("%d handoffs after a replay", len(again.KeyChain(1)))
+	}
+	again.Insert(&DataRecord{Shard: 1})
+	s, err := again.SignChecksum(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := replica.VerifyChecksum(s); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRevokeKey(t *testing.T) {
+	writer := testWriter(t, 1)
+	stolen, compromised, next := newKey(), newKey(), newKey()
+	if _, err := writer.RotateKey(1, stolen); err != nil {
+		t.Fatal(err)
+	}
+	writer.Insert(&DataRecord{Shard: 1})
+	// the thief rotates to a key of their own
+	if _, err := writer.RotateKey(1, compromised); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.RevokeKey(1, testKey, &stolen.PublicKey, next); err != nil {
+		t.Fatal(err)
+	}
+	writer.Insert(&DataRecord{Shard: 1})
+	replica := testReplica()
+	if err := replica.SyncFrom(http.DefaultClient, serve(t, writer.ReplicationHandler())); err != nil {
+		t.Fatal(err)
+	}
+	// the revoked key and the ones after it sign nothing, even the versions
+	// they once signed for
+	for _, kp := range []*ecdsa.PrivateKey{stolen, compromised} {
+		if err := replica.VerifyChecksum(signAs(t, writer, kp)); !errors.Is(err, ErrWrongKey) {
+			t.Fatalf("got %v", err)
+		}
+	}
+	if err := replica.VerifyChecksum(signAs(t, writer, next)); err != nil {
+		t.Fatal(err)
+	}
+	// only a key from before the revoked one can revoke it
+	if _, err := writer.RevokeKey(1, next, &testKey.PublicKey, newKey()); !errors.Is(err, ErrWrongKey) {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestForgedHandoff(t *testing.T) {
+	writer := testWriter(t, 1)
+	stranger, next := newKey(), newKey()
+	handoff := func(signer *ecdsa.PrivateKey, claimed *ecdsa.PublicKey) *KeyHandoff {
+		h := &KeyHandoff{Shard: 1, Seq: writer.State[1].Version + 1}
+		h.Key, _ = x509.MarshalPKIXPublicKey(&next.PublicKey)
+		h.Signer, _ = x509.MarshalPKIXPublicKey(claimed)
+		r, s, err := ecdsa.Sign(rand.Reader, signer, h.message())
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.Sig = Point{X: r, Y: s}
+		return h
+	}
+	before := writer.Checksum(1)
+	for _, c := range []struct {
+		h   *KeyHandoff
+		err error
+	}{
+		{handoff(stranger, &stranger.PublicKey), ErrWrongKey},
+		{handoff(stranger, &testKey.PublicKey), ErrBadSignature},
+	} {
+		if _, err := writer.Do(Command{Action: ActionRotate, Handoff: c.h}); !errors.Is(err, c.err) {
+			t.Fatalf("got %v, expected %v", err, c.err)
+		}
+	}
+	if len(writer.KeyChain(1)) != 0 || writer.Checksum(1) != before {
+		t.Fatal("a forged handoff was applied")
+	}
+	if _, err := writer.Do(Command{Action: ActionRotate, Handoff: handoff(testKey, &testKey.PublicKey)}); err != nil {
+		t.Fatal(err)
+	}
+}
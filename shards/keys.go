@@ -0,0 +1,194 @@
+package shards
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+)
+
+// The key registry maps each shard to the public key of its writer.  A
+// database that holds a shard's private key registers its public key too,
+// unless it is given one, and a verifier only has the registry.  Once a shard
+// has rotated its key, the registry holds the first key of its chain, which
+// the later keys are verified from.  Keys are exchanged as PEM encoded PKIX
+// public keys, with the shard in a "Shard" header.
+
+const pemPublicKey = "PUBLIC KEY"
+const pemPrivateKey = "EC PRIVATE KEY"
+const pemShardHeader = "Shard"
+
+func pointOf(pub *ecdsa.PublicKey) *Point {
+	if pub == nil {
+		return nil
+	}
+	return &Point{X: pub.X, Y: pub.Y}
+}
+
+func samePublicKey(a, b *ecdsa.PublicKey) bool {
+	return a.Curve.Params().Name == b.Curve.Params().Name &&
+		a.X.Cmp(b.X) == 0 && a.Y.Cmp(b.Y) == 0
+}
+
+// PublicKey returns the registered public key of a shard's writer, or nil.
+func (db *Db) PublicKey(shard Shard) *ecdsa.PublicKey {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return db.pubs[shard]
+}
+
+// SetPublicKey registers the public key of a shard's writer.  The key of a
+// shard that this database writes can't be replaced with another.
+func (db *Db) SetPublicKey(shard Shard, pub *ecdsa.PublicKey) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if err := db.checkPublicKey(shard, pub); err != nil {
+		return err
+	}
+	db.setPublicKey(shard, pub)
+	return nil
+}
+
+// checkPublicKey refuses a key for a shard that this database writes, unless
+// it is the one already registered.
+func (db *Db) checkPublicKey(shard Shard, pub *ecdsa.PublicKey) error {
+	if _, ok := db.keys[shard]; !ok {
+		return nil
+	}
+	if old := db.pubs[shard]; old != nil && !samePublicKey(old, pub) {
+		return fmt.Errorf("shard %d is written with another key: %w", shard, ErrWrongKey)
+	}
+	return nil
+}
+
+func (db *Db) setPublicKey(shard Shard, pub *ecdsa.PublicKey) {
+	db.pubs[shard] = pub
+	if st, ok := db.State[shard]; ok {
+		st.PublicKey = pointOf(pub)
+	}
+}
+
+// MarshalPublicKeyPEM encodes a public key as a PEM "PUBLIC KEY" block.
+func MarshalPublicKeyPEM(pub *ecdsa.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: pemPublicKey, Bytes: der}), nil
+}
+
+// ParsePublicKeyPEM decodes the first PEM "PUBLIC KEY" block in b, which
+// must hold an ECDSA key.
+func ParsePublicKeyPEM(b []byte) (*ecdsa.PublicKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != pemPublicKey {
+		return nil, fmt.Errorf("no %s block: %w", pemPublicKey, ErrNoKey)
+	}
+	return parsePublicKey(block.Bytes)
+}
+
+func parsePublicKey(der []byte) (*ecdsa.PublicKey, error) {
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	k, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%T is not an ECDSA key: %w", pub, ErrNoKey)
+	}
+	return k, nil
+}
+
+// MarshalPrivateKeyPEM encodes a shard's signing key as a PEM
+// "EC PRIVATE KEY" block, so a writer can be restarted with WithKeyPair.
+func MarshalPrivateKeyPEM(kp *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(kp)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: pemPrivateKey, Bytes: der}), nil
+}
+
+// ParsePrivateKeyPEM decodes the first PEM "EC PRIVATE KEY" block in b.
+func ParsePrivateKeyPEM(b []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != pemPrivateKey {
+		return nil, fmt.Errorf("no %s block: %w", pemPrivateKey, ErrNoKey)
+	}
+	return x509.ParseECPrivateKey(block.Bytes)
+}
+
+// ExportPublicKeys writes the registry to w as PEM blocks, in shard order.
+func (db *Db) ExportPublicKeys(w io.Writer) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	ids := make([]Shard, 0, len(db.pubs))
+	for shard := range db.pubs {
+		ids = append(ids, shard)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, shard := range ids {
+		der, err := x509.MarshalPKIXPublicKey(db.pubs[shard])
+		if err != nil {
+			return fmt.Errorf("shard %d: %v", shard, err)
+		}
+		block := &pem.Block{
+			Type:    pemPublicKey,
+			Headers: map[string]string{pemShardHeader: strconv.FormatInt(int64(shard), 10)},
+			Bytes:   der,
+		}
+		if err := pem.Encode(w, block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportPublicKeys registers every key in r, as written by ExportPublicKeys.
+// Nothing is registered unless all of them are good, and none replaces the
+// key of a shard that this database writes.
+func (db *Db) ImportPublicKeys(r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	pubs := make(map[Shard]*ecdsa.PublicKey)
+	var ids []Shard
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		if block.Type != pemPublicKey {
+			continue
+		}
+		n, err := strconv.ParseInt(block.Headers[pemShardHeader], 10, 64)
+		if err != nil {
+			return fmt.Errorf("public key without a shard: %w", ErrUnknownShard)
+		}
+		shard := Shard(n)
+		if pubs[shard] != nil {
+			return fmt.Errorf("shard %d has two keys: %w", shard, ErrExists)
+		}
+		if pubs[shard], err = parsePublicKey(block.Bytes); err != nil {
+			return fmt.Errorf("shard %d: %w", shard, err)
+		}
+		ids = append(ids, shard)
+	}
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	for _, shard := range ids {
+		if err := db.checkPublicKey(shard, pubs[shard]); err != nil {
+			return err
+		}
+	}
+	for _, shard := range ids {
+		db.setPublicKey(shard, pubs[shard])
+	}
+	return nil
+}
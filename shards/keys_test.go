@@ -0,0 +1,124 @@
+package shards
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+func TestKeyPEM(t *testing.T) {
+	b, err := MarshalPrivateKeyPEM(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kp, err := ParsePrivateKeyPEM(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kp.D.Cmp(testKey.D) != 0 || !samePublicKey(&kp.PublicKey, &testKey.PublicKey) {
+		t.Fatal("the private key didn't survive PEM")
+	}
+	b, err = MarshalPublicKeyPEM(&testKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ParsePublicKeyPEM(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !samePublicKey(pub, &testKey.PublicKey) {
+		t.Fatal("the public key didn't survive PEM")
+	}
+	// each only reads its own kind of block
+	if _, err := ParsePrivateKeyPEM(b); !errors.Is(err, ErrNoKey) {
+		t.Fatalf("got %v", err)
+	}
+	if _, err := ParsePublicKeyPEM([]byte("nothing")); !errors.Is(err, ErrNoKey) {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestExportImportPublicKeys(t *testing.T) {
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	writer, _ := NewDB(1, WithAlgorithm(LtHash16), WithKeyPair(1, testKey), WithKeyPair(2, other))
+	var exported bytes.Buffer
+	if err := writer.ExportPublicKeys(&exported); err != nil {
+		t.Fatal(err)
+	}
+	v, _ := NewVerifier(WithAlgorithm(LtHash16))
+	if err := v.ImportPublicKeys(bytes.NewReader(exported.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if !samePublicKey(v.PublicKey(1), &testKey.PublicKey) || !samePublicKey(v.PublicKey(2), &other.PublicKey) {
+		t.Fatal("the verifier doesn't have the writer's keys")
+	}
+	var again bytes.Buffer
+	if err := v.ExportPublicKeys(&again); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again.Bytes(), exported.Bytes()) {
+		t.Fatal("the keys exported again are different")
+	}
+	// the writer can take its own keys back
+	if err := writer.ImportPublicKeys(bytes.NewReader(exported.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+
+	// two keys for one shard register neither
+	var two bytes.Buffer
+	for _, kp := range []*ecdsa.PrivateKey{testKey, other} {
+		db, _ := NewDB(1, WithAlgorithm(LtHash16), WithKeyPair(3, kp))
+		if err := db.ExportPublicKeys(&two); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := v.ImportPublicKeys(&two); !errors.Is(err, ErrExists) {
+		t.Fatalf("got %v", err)
+	}
+	if v.PublicKey(3) != nil {
+		t.Fatal("a key was registered")
+	}
+}
+
+func TestWriterKeepsItsKey(t *testing.T) {
+	writer, _ := NewDB(1, WithAlgorithm(LtHash16), WithKeyPair(1, testKey))
+	stranger, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err := writer.SetPublicKey(1, &stranger.PublicKey); !errors.Is(err, ErrWrongKey) {
+		t.Fatalf("got %v", err)
+	}
+	// an import that would replace it registers nothing
+	db, _ := NewDB(1, WithAlgorithm(LtHash16), WithKeyPair(1, stranger), WithKeyPair(2, stranger))
+	var b bytes.Buffer
+	if err := db.ExportPublicKeys(&b); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.ImportPublicKeys(&b); !errors.Is(err, ErrWrongKey) {
+		t.Fatalf("got %v", err)
+	}
+	if !samePublicKey(writer.PublicKey(1), &testKey.PublicKey) || writer.PublicKey(2) != nil {
+		t.Fatal("the import changed the registry")
+	}
+	if err := writer.SetPublicKey(2, &stranger.PublicKey); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifierIsReadOnly(t *testing.T) {
+	v, err := NewVerifier(WithAlgorithm(LtHash16), WithPublicKey(1, &testKey.PublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.Insert(&DataRecord{Shard: 1}); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("got %v", err)
+	}
+	b := Batch{Commands: []Command{{Record: &DataRecord{Shard: 1}}}}
+	if _, err := v.DoBatch(b); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("got %v", err)
+	}
+	if v.Get(1, 1) != nil {
+		t.Fatal("the verifier wrote a record")
+	}
+}
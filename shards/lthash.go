@@ -0,0 +1,80 @@
+package shards
+
+import (
+	"crypto"
+	"encoding/binary"
+)
+
+// ltHash is LtHash with 1024 lanes of 16 bits: each element is expanded to a
+// vector, and vectors are added lane by lane mod 2^16.  It is much faster
+// than point addition, at the cost of a 2KB checksum.  Its security rests on
+// the short integer solution problem over the lattice of lane vectors.
+type ltHash struct {
+	lanes [ltHashLanes]uint16
+}
+
+const ltHashLanes = 1024
+
+var ltHashDST = []byte("BC-SHARDS-V01-LTHASH16")
+
+func newLtHash() *ltHash {
+	return &ltHash{}
+}
+
+func (h *ltHash) Algorithm() Algorithm {
+	return LtHash16
+}
+
+func ltHashVector(element []byte) []byte {
+	return expandMessageXMD(crypto.SHA256, element, ltHashDST, 2*ltHashLanes)
+}
+
+func (h *ltHash) Add(element []byte) {
+	v := ltHashVector(element)
+	for i := range h.lanes {
+		h.lanes[i] += binary.LittleEndian.Uint16(v[2*i:])
+	}
+}
+
+func (h *ltHash) Remove(element []byte) {
+	v := ltHashVector(element)
+	for i := range h.lanes {
+		h.lanes[i] -= binary.LittleEndian.Uint16(v[2*i:])
+	}
+}
+
+func (h *ltHash) Combine(other MultisetHash) error {
+	o, ok := other.(*ltHash)
+	if !ok {
+		return ErrAlgorithmMismatch
+	}
+	for i := range h.lanes {
+		h.lanes[i] += o.lanes[i]
+	}
+	return nil
+}
+
+// Encode is the algorithm byte, then the lanes in little-endian order.
+func (h *ltHash) Encode() []byte {
+	b := make([]byte, 1+2*ltHashLanes)
+	b[0] = byte(LtHash16)
+	for i := range h.lanes {
+		binary.LittleEndian.PutUint16(b[1+2*i:], h.lanes[i])
+	}
+	return b
+}
+
+func (h *ltHash) decode(b []byte) error {
+	if len(b) != 2*ltHashLanes {
+		return ErrBadEncoding
+	}
+	for i := range h.lanes {
+		h.lanes[i] = binary.LittleEndian.Uint16(b[2*i:])
+	}
+	return nil
+}
+
+func (h *ltHash) Clone() MultisetHash {
+	c := *h
+	return &c
+}
@@ -0,0 +1,95 @@
+package shards
+
+import (
+	"crypto"
+	"math/big"
+)
+
+// muHash multiplies elements together modulo the prime 2^3072 - 1103717.
+// Removal needs an inverse, which is expensive, so the removed elements are
+// kept in a separate denominator that is only inverted on Encode.
+type muHash struct {
+	num, den *big.Int
+}
+
+const muHashBytes = 384
+
+var muHashPrime = new(big.Int).Sub(
+	new(big.Int).Lsh(big.NewInt(1), 8*muHashBytes),
+	big.NewInt(1103717),
+)
+
+var muHashDST = []byte("BC-SHARDS-V01-MUHASH3072")
+
+func newMuHash() *muHash {
+	return &muHash{num: big.NewInt(1), den: big.NewInt(1)}
+}
+
+func (h *muHash) Algorithm() Algorithm {
+	return MuHash3072
+}
+
+func muHashElement(element []byte) *big.Int {
+	v := new(big.Int).SetBytes(expandMessageXMD(crypto.SHA512, element, muHashDST, muHashBytes))
+	v.Mod(v, muHashPrime)
+	if v.Sign() == 0 {
+		// not going to happen, but zero would wipe out the whole set
+		v.SetInt64(1)
+	}
+	return v
+}
+
+func (h *muHash) mul(acc, v *big.Int) {
+	acc.Mul(acc, v)
+	acc.Mod(acc, muHashPrime)
+}
+
+func (h *muHash) Add(element []byte) {
+	h.mul(h.num, muHashElement(element))
+}
+
+func (h *muHash) Remove(element []byte) {
+	h.mul(h.den, muHashElement(element))
+}
+
+func (h *muHash) Combine(other MultisetHash) error {
+	o, ok := other.(*muHash)
+	if !ok {
+		return ErrAlgorithmMismatch
+	}
+	h.mul(h.num, o.num)
+	h.mul(h.den, o.den)
+	return nil
+}
+
+func (h *muHash) value() *big.Int {
+	v := new(big.Int).ModInverse(h.den, muHashPrime)
+	return v.Mul(v, h.num).Mod(v, muHashPrime)
+}
+
+// Encode is the algorithm byte, then num/den as 384 big-endian bytes.
+func (h *muHash) Encode() []byte {
+	b := make([]byte, 1+muHashBytes)
+	b[0] = byte(MuHash3072)
+	fillBytes(h.value(), b[1:])
+	return b
+}
+
+func (h *muHash) decode(b []byte) error {
+	if len(b) != muHashBytes {
+		return ErrBadEncoding
+	}
+	v := new(big.Int).SetBytes(b)
+	if v.Sign() == 0 || v.Cmp(muHashPrime) >= 0 {
+		return ErrBadEncoding
+	}
+	h.num, h.den = v, big.NewInt(1)
+	return nil
+}
+
+func (h *muHash) Clone() MultisetHash {
+	return &muHash{
+		num: new(big.Int).Set(h.num),
+		den: new(big.Int).Set(h.den),
+	}
+}
@@ -0,0 +1,111 @@
+package shards
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// MultisetHash is a running hash over a multiset of byte strings.  Adding and
+// removing elements commute, so the hash only depends on which elements are
+// in the set, not on the order they came and went in.
+type MultisetHash interface {
+	Algorithm() Algorithm
+	// Add an element to the set
+	Add(element []byte)
+	// Remove an element from the set.  Removing an element that was never
+	// added leaves it with a negative count.
+	Remove(element []byte)
+	// Combine adds every element of other, which must use the same algorithm
+	Combine(other MultisetHash) error
+	// Encode is the algorithm byte followed by the value of the hash
+	Encode() []byte
+	Clone() MultisetHash
+}
+
+// Algorithm identifies a MultisetHash implementation.  It is the first byte
+// of every encoded checksum.
+type Algorithm byte
+
+const (
+	ECMHP256   = Algorithm(1)
+	ECMHP384   = Algorithm(2)
+	ECMHP521   = Algorithm(3)
+	LtHash16   = Algorithm(4)
+	MuHash3072 = Algorithm(5)
+)
+
+var ErrUnknownAlgorithm = errors.New("unknown multiset hash algorithm")
+var ErrAlgorithmMismatch = errors.New("multiset hash algorithms differ")
+
+var algorithmNames = map[Algorithm]string{
+	ECMHP256:   "ecmh-p256",
+	ECMHP384:   "ecmh-p384",
+	ECMHP521:   "ecmh-p521",
+	LtHash16:   "lthash16",
+	MuHash3072: "muhash3072",
+}
+
+func (a Algorithm) String() string {
+	if n, ok := algorithmNames[a]; ok {
+		return n
+	}
+	return fmt.Sprintf("algorithm(%d)", byte(a))
+}
+
+// ParseAlgorithm is the inverse of Algorithm.String
+func ParseAlgorithm(s string) (Algorithm, error) {
+	for a, n := range algorithmNames {
+		if n == s {
+			return a, nil
+		}
+	}
+	return 0, fmt.Errorf("%q: %w", s, ErrUnknownAlgorithm)
+}
+
+// NewMultisetHash returns the hash of the empty set.
+func NewMultisetHash(alg Algorithm) (MultisetHash, error) {
+	switch alg {
+	case ECMHP256:
+		return newECMH(alg, h2cSuites[0]), nil
+	case ECMHP384:
+		return newECMH(alg, h2cSuites[1]), nil
+	case ECMHP521:
+		return newECMH(alg, h2cSuites[2]), nil
+	case LtHash16:
+		return newLtHash(), nil
+	case MuHash3072:
+		return newMuHash(), nil
+	}
+	return nil, fmt.Errorf("%v: %w", alg, ErrUnknownAlgorithm)
+}
+
+// DecodeMultisetHash parses the output of Encode.
+func DecodeMultisetHash(b []byte) (MultisetHash, error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("empty checksum: %w", ErrUnknownAlgorithm)
+	}
+	h, err := NewMultisetHash(Algorithm(b[0]))
+	if err != nil {
+		return nil, err
+	}
+	if err := h.(decoder).decode(b[1:]); err != nil {
+		return nil, fmt.Errorf("%v: %w", h.Algorithm(), err)
+	}
+	return h, nil
+}
+
+type decoder interface {
+	decode(b []byte) error
+}
+
+var ErrBadEncoding = errors.New("bad encoding")
+
+// fillBytes writes x into buf as big-endian, zero padded on the left.
+func fillBytes(x *big.Int, buf []byte) {
+	for i := range buf {
+		buf[i] = 0
+	}
+	b := x.Bytes()
+	copy(buf[len(buf)-len(b):], b)
+}
@@ -0,0 +1,147 @@
+package shards
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"testing"
+)
+
+// algorithms is every Algorithm, in order.
+func algorithms() []Algorithm {
+	var algs []Algorithm
+	for a := range algorithmNames {
+		algs = append(algs, a)
+	}
+	sort.Slice(algs, func(i, j int) bool { return algs[i] < algs[j] })
+	return algs
+}
+
+func TestMultisetHash(t *testing.T) {
+	var records []*DataRecord
+	for id := Id(1); id <= 20; id++ {
+		records = append(records, &DataRecord{Shard: 1, Id: id, Ints: map[string]int64{"n": int64(id)}})
+	}
+	for _, alg := range algorithms() {
+		if a, err := ParseAlgorithm(alg.String()); err != nil || a != alg {
+			t.Fatalf("%v parses as %v, %v", alg, a, err)
+		}
+		empty, err := NewMultisetHash(alg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if empty.Algorithm() != alg || empty.Encode()[0] != byte(alg) {
+			t.Fatalf("%v: the hash is %v", alg, empty.Algorithm())
+		}
+		h := empty.Clone()
+		for _, v := range records {
+			h.Add(DefaultDigester.Record(v))
+		}
+		want, _ := ChecksumOf(alg, DefaultDigester, records)
+		if !bytes.Equal(h.Encode(), want.Encode()) {
+			t.Fatalf("%v: differs from ChecksumOf", alg)
+		}
+		decoded, err := DecodeMultisetHash(h.Encode())
+		if err != nil {
+			t.Fatalf("%v: %v", alg, err)
+		}
+		if !bytes.Equal(decoded.Encode(), h.Encode()) {
+			t.Fatalf("%v: doesn't survive Encode and Decode", alg)
+		}
+
+		// removing in another order gets back to the empty set, and a
+		// decoded hash carries on like the original
+		for i := len(records) - 1; i >= 0; i-- {
+			h.Remove(DefaultDigester.Record(records[i]))
+			decoded.Remove(DefaultDigester.Record(records[i]))
+		}
+		if !bytes.Equal(h.Encode(), empty.Encode()) || !bytes.Equal(decoded.Encode(), empty.Encode()) {
+			t.Fatalf("%v: removing everything isn't empty", alg)
+		}
+		if e, err := DecodeMultisetHash(empty.Encode()); err != nil || !bytes.Equal(e.Encode(), empty.Encode()) {
+			t.Fatalf("%v: the empty set doesn't decode: %v", alg, err)
+		}
+	}
+}
+
+func TestMultisetHashCommutes(t *testing.T) {
+	a, b, c := []byte("a"), []byte("b"), []byte("c")
+	for _, alg := range algorithms() {
+		// {a, b} + {c} - {a}
+		x, _ := NewMultisetHash(alg)
+		x.Add(a)
+		x.Add(b)
+		y, _ := NewMultisetHash(alg)
+		y.Add(c)
+		y.Remove(a)
+		if err := x.Combine(y); err != nil {
+			t.Fatal(err)
+		}
+		// {c} - {a} + {a} + {b}, the same in another order
+		z, _ := NewMultisetHash(alg)
+		z.Remove(a)
+		z.Add(c)
+		z.Add(a)
+		z.Add(b)
+		w, _ := NewMultisetHash(alg)
+		w.Add(b)
+		w.Add(c)
+		if !bytes.Equal(x.Encode(), w.Encode()) || !bytes.Equal(z.Encode(), w.Encode()) {
+			t.Fatalf("%v: the order of adds, removes and combines matters", alg)
+		}
+		// a clone is independent of the original
+		clone := w.Clone()
+		clone.Add(a)
+		if bytes.Equal(clone.Encode(), w.Encode()) {
+			t.Fatalf("%v: a clone shares state", alg)
+		}
+
+		for _, other := range algorithms() {
+			if other == alg {
+				continue
+			}
+			o, _ := NewMultisetHash(other)
+			if err := x.Combine(o); !errors.Is(err, ErrAlgorithmMismatch) {
+				t.Fatalf("%v with %v: got %v", alg, other, err)
+			}
+		}
+	}
+}
+
+func TestMultisetHashMalformed(t *testing.T) {
+	if _, err := DecodeMultisetHash(nil); !errors.Is(err, ErrUnknownAlgorithm) {
+		t.Fatalf("got %v", err)
+	}
+	if _, err := DecodeMultisetHash([]byte{99, 0}); !errors.Is(err, ErrUnknownAlgorithm) {
+		t.Fatalf("got %v", err)
+	}
+	if _, err := ParseAlgorithm("md5"); !errors.Is(err, ErrUnknownAlgorithm) {
+		t.Fatalf("got %v", err)
+	}
+	for _, alg := range algorithms() {
+		h, _ := NewMultisetHash(alg)
+		h.Add([]byte("a"))
+		b := h.Encode()
+		for _, bad := range [][]byte{b[:1], b[:len(b)-1], append(b, 0)} {
+			if _, err := DecodeMultisetHash(bad); !errors.Is(err, ErrBadEncoding) {
+				t.Fatalf("%v: %d bytes, got %v", alg, len(bad), err)
+			}
+		}
+		if alg == LtHash16 {
+			// every value of the lanes is a hash
+			continue
+		}
+		// not on the curve, or not a unit mod the prime
+		for i := 1; i < len(b); i++ {
+			b[i] = 0xff
+		}
+		if _, err := DecodeMultisetHash(b); !errors.Is(err, ErrBadEncoding) {
+			t.Fatalf("%v: got %v", alg, err)
+		}
+	}
+	zero := make([]byte, 1+muHashBytes)
+	zero[0] = byte(MuHash3072)
+	if _, err := DecodeMultisetHash(zero); !errors.Is(err, ErrBadEncoding) {
+		t.Fatalf("got %v", err)
+	}
+}
@@ -0,0 +1,409 @@
+package shards
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"fmt"
+	"math/big"
+	"sort"
+)
+
+// An offer proposes commands on a shard.  It is signed by the party making
+// it (From) and is for another party (To) to accept before it expires.
+// While it is open, the offer's digest counts in the shard's checksum.
+// Accepting it, signed by To, applies its commands and subtracts the offer's
+// digest, so the checksum goes from S + offer to S + effects: the offer
+// cancels out, and only what it did remains.  A settled offer counts for
+// nothing, but it is kept until it expires, so that the same signed offer
+// can't be made and accepted twice; after that it can be collected without
+// changing the checksum.  A settled offer that never expires is collected
+// right away, and the shard only takes offers that never expire with ids
+// above the highest one it collected.  An offer that expires unaccepted is
+// withdrawn, which subtracts its digest again.
+//
+// Offers and acceptances are encoded like records, with their own kinds:
+//
+//  offer   1 shard, 2 id, 3 expires, 4 commands (as in a batch),
+//          5 from, 6 to, 7 and 8 the r and s of the signature
+//  accept  1 shard, 2 offer id, 3 and 4 the r and s of the signature
+//
+// From signs the SHA-256 of the offer's encoding without its signature.  To
+// signs the SHA-256 of BC-SHARDS-V01-ACCEPT\0 followed by the encoding of the
+// signed offer.
+
+type Offer struct {
+	Shard Shard `json:"shard,omitempty"`
+	Id    Id    `json:"id,omitempty"`
+	// Expires is the time on the database's clock from which the offer
+	// can no longer be accepted.  0 means never.
+	Expires int64 `json:"expires,omitempty"`
+	// Commands are applied when the offer is accepted.  They must be on
+	// the offer's shard.
+	Commands []Command `json:"commands,omitempty"`
+	// From and To are the PKIX encoded public keys of the parties
+	From []byte `json:"from,omitempty"`
+	To   []byte `json:"to,omitempty"`
+	Sig  Point  `json:"sig,omitempty"`
+}
+
+// Accept is To's acceptance of an offer.
+type Accept struct {
+	Shard Shard `json:"shard,omitempty"`
+	Id    Id    `json:"id,omitempty"`
+	Sig   Point `json:"sig,omitempty"`
+}
+
+const (
+	kindOffer  = byte(6)
+	kindAccept = byte(7)
+)
+
+// Offer field tags
+const (
+	tagOfferShard    = byte(1)
+	tagOfferId       = byte(2)
+	tagOfferExpires  = byte(3)
+	tagOfferCommands = byte(4)
+	tagOfferFrom     = byte(5)
+	tagOfferTo       = byte(6)
+	tagOfferSigR     = byte(7)
+	tagOfferSigS     = byte(8)
+)
+
+// Accept field tags
+const (
+	tagAcceptShard = byte(1)
+	tagAcceptId    = byte(2)
+	tagAcceptSigR  = byte(3)
+	tagAcceptSigS  = byte(4)
+)
+
+var acceptDomain = []byte("BC-SHARDS-V01-ACCEPT\x00")
+
+// sigFields appends a signature as its r and s, under tag and tag+1.
+func (e *encBuf) sigFields(tag byte, sig Point) {
+	if sig.X != nil && sig.Y != nil {
+		e.bytesField(tag, sig.X.Bytes())
+		e.bytesField(tag+1, sig.Y.Bytes())
+	}
+}
+
+// bigInt reads an unsigned integer, which mustn't have leading zeros.
+func (d *decBuf) bigInt(tag byte) *big.Int {
+	if len(d.b) == 0 || d.b[0] == 0 {
+		d.fail("field %d is not minimal", tag)
+	}
+	n := new(big.Int).SetBytes(d.b)
+	d.b = nil
+	return n
+}
+
+// MarshalBinary returns the canonical encoding of the offer.
+func (o *Offer) MarshalBinary() ([]byte, error) {
+	e := &encBuf{b: []byte{EncodingVersion, kindOffer}}
+	e.intField(tagOfferShard, int64(o.Shard))
+	e.intField(tagOfferId, int64(o.Id))
+	e.intField(tagOfferExpires, o.Expires)
+	if len(o.Commands) > 0 {
+		if err := e.commandsField(tagOfferCommands, o.Commands); err != nil {
+			return nil, err
+		}
+	}
+	e.bytesField(tagOfferFrom, o.From)
+	e.bytesField(tagOfferTo, o.To)
+	e.sigFields(tagOfferSigR, o.Sig)
+	return e.b, nil
+}
+
+// UnmarshalBinary parses a canonical encoding of an offer.
+func (o *Offer) UnmarshalBinary(b []byte) error {
+	*o = Offer{}
+	d := &decBuf{b: b}
+	d.header(kindOffer)
+	d.fields(func(tag byte, f *decBuf) bool {
+		switch tag {
+		case tagOfferShard:
+			o.Shard = Shard(f.nonZero(tag, f.i64()))
+		case tagOfferId:
+			o.Id = Id(f.nonZero(tag, f.i64()))
+		case tagOfferExpires:
+			o.Expires = f.nonZero(tag, f.i64())
+		case tagOfferCommands:
+			o.Commands = f.commands(tag)
+		case tagOfferFrom:
+			o.From, f.b = f.b, nil
+		case tagOfferTo:
+			o.To, f.b = f.b, nil
+		case tagOfferSigR:
+			o.Sig.X = f.bigInt(tag)
+		case tagOfferSigS:
+			o.Sig.Y = f.bigInt(tag)
+		default:
+			return false
+		}
+		return true
+	})
+	return d.err
+}
+
+// MarshalBinary returns the canonical encoding of the acceptance.
+func (a *Accept) MarshalBinary() ([]byte, error) {
+	e := &encBuf{b: []byte{EncodingVersion, kindAccept}}
+	e.intField(tagAcceptShard, int64(a.Shard))
+	e.intField(tagAcceptId, int64(a.Id))
+	e.sigFields(tagAcceptSigR, a.Sig)
+	return e.b, nil
+}
+
+// UnmarshalBinary parses a canonical encoding of an acceptance.
+func (a *Accept) UnmarshalBinary(b []byte) error {
+	*a = Accept{}
+	d := &decBuf{b: b}
+	d.header(kindAccept)
+	d.fields(func(tag byte, f *decBuf) bool {
+		switch tag {
+		case tagAcceptShard:
+			a.Shard = Shard(f.nonZero(tag, f.i64()))
+		case tagAcceptId:
+			a.Id = Id(f.nonZero(tag, f.i64()))
+		case tagAcceptSigR:
+			a.Sig.X = f.bigInt(tag)
+		case tagAcceptSigS:
+			a.Sig.Y = f.bigInt(tag)
+		default:
+			return false
+		}
+		return true
+	})
+	return d.err
+}
+
+// message is what From signs: the offer without its signature.
+func (o *Offer) message() []byte {
+	unsigned := *o
+	unsigned.Sig = Point{}
+	h := sha256.Sum256(canonical(&unsigned))
+	return h[:]
+}
+
+// acceptMessage is what To signs to accept the offer.
+func (o *Offer) acceptMessage() []byte {
+	h := sha256.New()
+	h.Write(acceptDomain)
+	h.Write(canonical(o))
+	return h.Sum(nil)
+}
+
+func (o *Offer) expired(now int64) bool {
+	return o.Expires != 0 && o.Expires <= now
+}
+
+// Sign sets From to the public key of kp, and signs the offer with it.
+func (o *Offer) Sign(kp *ecdsa.PrivateKey) error {
+	from, err := x509.MarshalPKIXPublicKey(&kp.PublicKey)
+	if err != nil {
+		return err
+	}
+	o.From = from
+	r, s, err := ecdsa.Sign(rand.Reader, kp, o.message())
+	if err != nil {
+		return err
+	}
+	o.Sig = Point{X: r, Y: s}
+	return nil
+}
+
+// AcceptOffer signs the acceptance of o with kp, which must be the key that
+// the offer is to.
+func AcceptOffer(o *Offer, kp *ecdsa.PrivateKey) (*Accept, error) {
+	r, s, err := ecdsa.Sign(rand.Reader, kp, o.acceptMessage())
+	if err != nil {
+		return nil, err
+	}
+	return &Accept{Shard: o.Shard, Id: o.Id, Sig: Point{X: r, Y: s}}, nil
+}
+
+// verifyPKIX checks sig over msg against a PKIX encoded ECDSA public key.
+func verifyPKIX(key []byte, msg []byte, sig Point) bool {
+	k, err := parsePublicKey(key)
+	return err == nil && sig.X != nil && sig.Y != nil && ecdsa.Verify(k, msg, sig.X, sig.Y)
+}
+
+// Offer makes an offer on its shard.  It must be signed, and its commands
+// are checked now but only applied when it is accepted.
+func (db *Db) Offer(o *Offer) error {
+	_, err := db.Do(Command{Action: ActionOffer, Offer: o})
+	return err
+}
+
+// Accept an open offer, applying its commands.
+func (db *Db) Accept(a *Accept) error {
+	_, err := db.Do(Command{Action: ActionAccept, Accept: a})
+	return err
+}
+
+// Withdraw an offer that expired without being accepted.
+func (db *Db) Withdraw(o *Offer) error {
+	_, err := db.Do(Command{Action: ActionWithdraw, Offer: o})
+	return err
+}
+
+// GetOffer returns an open offer, or nil if there is none.
+func (db *Db) GetOffer(shard Shard, id Id) *Offer {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	st, ok := db.State[shard]
+	if !ok {
+		return nil
+	}
+	return st.Offers[id]
+}
+
+func (db *Db) offer(t *tx, o *Offer, at int64) error {
+	st, err := db.state(o.Shard)
+	if err != nil {
+		return err
+	}
+	if o.Id <= 0 {
+		return fmt.Errorf("offer on shard %d has no id: %w", o.Shard, ErrNoRecord)
+	}
+	if st.Offers[o.Id] != nil || st.Settled[o.Id] != nil {
+		return fmt.Errorf("offer %d:%d: %w", o.Shard, o.Id, ErrExists)
+	}
+	if o.expired(at) {
+		return fmt.Errorf("offer %d:%d expired at %d: %w", o.Shard, o.Id, o.Expires, ErrOfferExpired)
+	}
+	if o.Expires == 0 && o.Id <= st.Collected && !t.replay {
+		return fmt.Errorf("offer %d:%d never expires, and offers up to %d may have been collected: %w", o.Shard, o.Id, st.Collected, ErrExists)
+	}
+	for i := range o.Commands {
+		cmd := &o.Commands[i]
+		if err := cmd.validate(); err != nil {
+			return fmt.Errorf("offer %d:%d command %d: %w", o.Shard, o.Id, i, err)
+		}
+		switch cmd.Action {
+		case ActionInsert, ActionRemove, ActionRenew, ActionReplace:
+		default:
+			return fmt.Errorf("offer %d:%d command %d action %d: %w", o.Shard, o.Id, i, cmd.Action, ErrUnknownAction)
+		}
+		if cmd.Cascade {
+			return fmt.Errorf("offer %d:%d command %d cascades: %w", o.Shard, o.Id, i, ErrUnknownAction)
+		}
+		if cmd.Record.Shard != o.Shard {
+			return fmt.Errorf("offer %d:%d command %d is on shard %d: %w", o.Shard, o.Id, i, cmd.Record.Shard, ErrUnknownShard)
+		}
+	}
+	if !t.replay {
+		if _, err := parsePublicKey(o.To); err != nil {
+			return fmt.Errorf("offer %d:%d is to no key: %v: %w", o.Shard, o.Id, err, ErrBadSignature)
+		}
+		if !verifyPKIX(o.From, o.message(), o.Sig) {
+			return fmt.Errorf("offer %d:%d: %w", o.Shard, o.Id, ErrBadSignature)
+		}
+	}
+	st.putOffer(t, o, db.digester.Offer(o))
+	return nil
+}
+
+func (db *Db) accept(t *tx, a *Accept, at int64) error {
+	st, err := db.state(a.Shard)
+	if err != nil {
+		return err
+	}
+	o, ok := st.Offers[a.Id]
+	if !ok {
+		if st.Settled[a.Id] != nil {
+			return fmt.Errorf("offer %d:%d is already accepted: %w", a.Shard, a.Id, ErrExists)
+		}
+		return fmt.Errorf("offer %d:%d cannot be accepted: %w", a.Shard, a.Id, ErrNotFound)
+	}
+	if o.expired(at) {
+		return fmt.Errorf("offer %d:%d expired at %d: %w", a.Shard, a.Id, o.Expires, ErrOfferExpired)
+	}
+	if !t.replay && !verifyPKIX(o.To, o.acceptMessage(), a.Sig) {
+		return fmt.Errorf("acceptance of offer %d:%d: %w", a.Shard, a.Id, ErrBadSignature)
+	}
+	h := db.digester.Offer(o)
+	for i, cmd := range o.Commands {
+		// apply a copy, so that the offer keeps its digest
+		v := *cmd.Record
+		cmd.Record = &v
+		cmd.At = at
+		if _, err := db.apply(t, cmd); err != nil {
+			return fmt.Errorf("offer %d:%d command %d: %w", a.Shard, a.Id, i, err)
+		}
+	}
+	st.settle(t, o, h)
+	return nil
+}
+
+func (db *Db) withdraw(t *tx, o *Offer, at int64) error {
+	st, err := db.state(o.Shard)
+	if err != nil {
+		return err
+	}
+	open, ok := st.Offers[o.Id]
+	if !ok {
+		return fmt.Errorf("offer %d:%d cannot be withdrawn: %w", o.Shard, o.Id, ErrNotFound)
+	}
+	h := db.digester.Offer(open)
+	if !bytes.Equal(h, db.digester.Offer(o)) {
+		return fmt.Errorf("offer %d:%d: %w", o.Shard, o.Id, ErrMismatch)
+	}
+	if !open.expired(at) {
+		return fmt.Errorf("offer %d:%d: %w", o.Shard, o.Id, ErrNotExpired)
+	}
+	st.delOffer(t, open, h)
+	return nil
+}
+
+// withdrawAt withdraws the open offers of a shard that expired by now, in id
+// order.
+func (db *Db) withdrawAt(st *State, now int64) error {
+	var ids []Id
+	for id, o := range st.Offers {
+		if o.expired(now) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		if _, err := db.do(Command{Action: ActionWithdraw, Offer: st.Offers[id]}, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CollectOffers drops the settled offers of a shard that have expired or
+// never expire, and returns them.  Accepting an offer subtracted exactly the
+// digest that making it added, so a settled offer counts for nothing in the
+// checksum, and collecting it can't change it.  It isn't logged: a replayed
+// log brings the offers back, settled, and they are collected again.
+func (db *Db) CollectOffers(shard Shard) []*Offer {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	st, ok := db.State[shard]
+	if !ok {
+		return nil
+	}
+	return st.collectOffers(db.clock.Now())
+}
+
+func (st *State) collectOffers(now int64) []*Offer {
+	var collected []*Offer
+	for id, o := range st.Settled {
+		if o.Expires == 0 && id > st.Collected {
+			st.Collected = id
+		}
+		if o.Expires == 0 || o.expired(now) {
+			collected = append(collected, o)
+			delete(st.Settled, id)
+		}
+	}
+	sort.Slice(collected, func(i, j int) bool { return collected[i].Id < collected[j].Id })
+	return collected
+}
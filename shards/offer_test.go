@@ -0,0 +1,113 @@
+package shards
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"testing"
+)
+
+// testOffer makes a signed offer of an insert on shard 1, and its acceptance.
+func testOffer(t *testing.T, id Id, expires int64) (*Offer, *Accept) {
+	t.Helper()
+	from, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	to, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	pkix, err := x509.MarshalPKIXPublicKey(&to.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := &Offer{
+		Shard:    1,
+		Id:       id,
+		Expires:  expires,
+		Commands: []Command{{Action: ActionInsert, Record: &DataRecord{Shard: 1, Id: 100 + id}}},
+		To:       pkix,
+	}
+	if err := o.Sign(from); err != nil {
+		t.Fatal(err)
+	}
+	a, err := AcceptOffer(o, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o, a
+}
+
+func TestCollectOffersKeepsChecksum(t *testing.T) {
+	clock := &LogicalClock{}
+	db, _ := NewDB(1, WithAlgorithm(LtHash16), WithClock(clock))
+	forever, acceptForever := testOffer(t, 1, 0)
+	until, acceptUntil := testOffer(t, 2, 50)
+	for _, o := range []*Offer{forever, until} {
+		if err := db.Offer(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, a := range []*Accept{acceptForever, acceptUntil} {
+		if err := db.Accept(a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// only the effects of the offers count
+	want, _ := ChecksumOf(LtHash16, DefaultDigester, []*DataRecord{{Shard: 1, Id: 101}, {Shard: 1, Id: 102}})
+	before := db.Checksum(1)
+	if before != FormatChecksum(1, want) {
+		t.Fatalf("checksum %s, expected %s", before, FormatChecksum(1, want))
+	}
+
+	collected := db.CollectOffers(1)
+	if len(collected) != 1 || collected[0].Id != 1 || db.Checksum(1) != before {
+		t.Fatalf("collected %v, checksum %s", collected, db.Checksum(1))
+	}
+	clock.Set(50)
+	collected = db.CollectOffers(1)
+	if len(collected) != 1 || collected[0].Id != 2 || db.Checksum(1) != before {
+		t.Fatalf("collected %v, checksum %s", collected, db.Checksum(1))
+	}
+	if len(db.State[1].Settled) != 0 {
+		t.Fatal("settled offers are left")
+	}
+
+	// the collected offer can't be made and accepted again
+	if err := db.Offer(forever); !errors.Is(err, ErrExists) {
+		t.Fatalf("got %v", err)
+	}
+	var b bytes.Buffer
+	if err := db.WriteSnapshot(1, &b); err != nil {
+		t.Fatal(err)
+	}
+	again, _ := NewDB(1, WithAlgorithm(LtHash16), WithKeyPair(1, db.State[1].KeyPair))
+	if _, err := again.LoadSnapshot(&b); err != nil {
+		t.Fatal(err)
+	}
+	if err := again.Offer(forever); !errors.Is(err, ErrExists) {
+		t.Fatalf("after a snapshot, got %v", err)
+	}
+	next, _ := testOffer(t, 3, 0)
+	if err := again.Offer(next); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCallerTimeIgnored(t *testing.T) {
+	clock := &LogicalClock{}
+	db, _ := NewDB(1, WithAlgorithm(LtHash16), WithClock(clock))
+	o, a := testOffer(t, 1, 50)
+	if err := db.Offer(o); err != nil {
+		t.Fatal(err)
+	}
+	clock.Set(100)
+	// an accept that claims an earlier time is still too late
+	if _, err := db.Do(Command{Action: ActionAccept, Accept: a, At: 1}); !errors.Is(err, ErrOfferExpired) {
+		t.Fatalf("got %v", err)
+	}
+	if _, err := db.DoBatch(Batch{Commands: []Command{{Action: ActionAccept, Accept: a, At: 1}}}); !errors.Is(err, ErrOfferExpired) {
+		t.Fatalf("in a batch, got %v", err)
+	}
+	if db.Get(1, 101) != nil {
+		t.Fatal("the expired offer was accepted")
+	}
+}
@@ -0,0 +1,95 @@
+package shards
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+func TestPendingRemovesConverge(t *testing.T) {
+	// every record is inserted, and the odd ones are removed again
+	var cmds []Command
+	var kept []*DataRecord
+	for id := Id(1); id <= 20; id++ {
+		v := &DataRecord{Shard: 1, Id: id, Ints: map[string]int64{"n": int64(id) * 7}}
+		cmds = append(cmds, Command{Action: ActionInsert, Record: v})
+		if id%2 == 1 {
+			cmds = append(cmds, Command{Action: ActionRemove, Record: v})
+		} else {
+			kept = append(kept, v)
+		}
+	}
+	want, err := ChecksumOf(LtHash16, DefaultDigester, kept)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := rand.New(rand.NewSource(1))
+	for round := 0; round < 20; round++ {
+		db, _ := NewDB(1, WithAlgorithm(LtHash16), WithPendingRemoves())
+		for _, i := range r.Perm(len(cmds)) {
+			// each replica gets its own copy of the record
+			cmd := cmds[i]
+			v := *cmd.Record
+			cmd.Record = &v
+			if _, err := db.Do(cmd); err != nil {
+				t.Fatalf("round %d: %v", round, err)
+			}
+		}
+		if got := db.Checksum(1); got != FormatChecksum(1, want) {
+			t.Fatalf("round %d: checksum %s, expected %s", round, got, FormatChecksum(1, want))
+		}
+		if len(db.State[1].Data) != len(kept) || len(db.State[1].Pending) != 0 {
+			t.Fatalf("round %d: %d records and %d pending", round, len(db.State[1].Data), len(db.State[1].Pending))
+		}
+	}
+}
+
+func TestPendingRemoveMismatch(t *testing.T) {
+	db, _ := NewDB(1, WithAlgorithm(LtHash16), WithPendingRemoves())
+	empty := db.Checksum(1)
+	if _, err := db.Remove(&DataRecord{Shard: 1, Id: 5, TTL: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if db.Checksum(1) == empty {
+		t.Fatal("a pending removal doesn't count")
+	}
+	if _, err := db.Insert(&DataRecord{Shard: 1, Id: 5, TTL: 2}); err == nil {
+		t.Fatal("a different record cancelled the removal")
+	}
+	if _, err := db.Insert(&DataRecord{Shard: 1, Id: 5, TTL: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if db.Checksum(1) != empty || db.Get(1, 5) != nil {
+		t.Fatal("the insert didn't cancel the removal")
+	}
+}
+
+func TestReplayPendsOnlyWithPendingRemoves(t *testing.T) {
+	dir := tempDir(t)
+	db, wal := testDb(t, dir, WithPendingRemoves())
+	if _, err := db.Remove(&DataRecord{Shard: 1, Id: 5}); err != nil {
+		t.Fatal(err)
+	}
+	wal.Close()
+
+	// a database without pending removes can't make sense of the log
+	wal, err := OpenWAL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	strict, _ := NewDB(1, WithAlgorithm(LtHash16), WithWAL(wal), WithKeyPair(1, testKey))
+	if err := strict.Replay(wal); !errors.Is(err, ErrCorruptLog) {
+		t.Fatalf("got %v", err)
+	}
+	if st := strict.State[1]; st != nil && len(st.Pending) != 0 {
+		t.Fatal("the removal is pending without pending removes")
+	}
+	wal.Close()
+
+	again, wal := testDb(t, dir, WithPendingRemoves())
+	defer wal.Close()
+	sameShard(t, db, again, 1)
+	if len(again.State[1].Pending) != 1 {
+		t.Fatal("the removal isn't pending after a replay")
+	}
+}
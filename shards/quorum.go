@@ -0,0 +1,191 @@
+package shards
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"fmt"
+)
+
+// A shard can be signed for by a quorum instead of a single writer: k of n
+// registered co-signers each sign the same statement of its checksum and
+// version, and the statement only verifies with k good signatures from
+// different co-signers.  Each co-signer checks the statement against its own
+// replica of the shard before signing, so no single key, and no k-1 of them,
+// can vouch for a checksum.  Quorum statements carry no key id or signature
+// of their own; the co-signatures are over the same SHA-256 as a writer's.
+// A co-signature is encoded like a record, with its own kind:
+//
+//  1 key id, 2 and 3 the r and s of the signature
+
+// Quorum is the k of n public keys that must sign for a shard.
+type Quorum struct {
+	K    int
+	Keys []*ecdsa.PublicKey
+}
+
+// CoSignature is one co-signer's signature on a statement.
+type CoSignature struct {
+	// KeyId is the SHA-256 of the co-signer's PKIX public key
+	KeyId []byte `json:"keyid,omitempty"`
+	Sig   Point  `json:"sig,omitempty"`
+}
+
+const kindCoSignature = byte(12)
+
+// CoSignature field tags
+const (
+	tagCoSignKeyId = byte(1)
+	tagCoSignSigR  = byte(2)
+	tagCoSignSigS  = byte(3)
+)
+
+// MarshalBinary returns the canonical encoding of the co-signature.
+func (cs *CoSignature) MarshalBinary() ([]byte, error) {
+	e := &encBuf{b: []byte{EncodingVersion, kindCoSignature}}
+	e.bytesField(tagCoSignKeyId, cs.KeyId)
+	e.sigFields(tagCoSignSigR, cs.Sig)
+	return e.b, nil
+}
+
+// UnmarshalBinary parses a canonical encoding of a co-signature.
+func (cs *CoSignature) UnmarshalBinary(b []byte) error {
+	*cs = CoSignature{}
+	d := &decBuf{b: b}
+	d.header(kindCoSignature)
+	d.fields(func(tag byte, f *decBuf) bool {
+		switch tag {
+		case tagCoSignKeyId:
+			cs.KeyId, f.b = f.b, nil
+		case tagCoSignSigR:
+			cs.Sig.X = f.bigInt(tag)
+		case tagCoSignSigS:
+			cs.Sig.Y = f.bigInt(tag)
+		default:
+			return false
+		}
+		return true
+	})
+	return d.err
+}
+
+// QuorumChecksum is a statement and the co-signatures collected for it.
+type QuorumChecksum struct {
+	Statement *SignedChecksum `json:"statement,omitempty"`
+	Sigs      []CoSignature   `json:"sigs,omitempty"`
+}
+
+// WithQuorum requires k of the keys to sign for a shard.
+func WithQuorum(shard Shard, k int, keys ...*ecdsa.PublicKey) Option {
+	return func(db *Db) {
+		db.quorums[shard] = &Quorum{K: k, Keys: keys}
+	}
+}
+
+// SetQuorum requires k of the keys to sign for a shard.
+func (db *Db) SetQuorum(shard Shard, k int, keys ...*ecdsa.PublicKey) error {
+	if k < 1 || k > len(keys) {
+		return fmt.Errorf("shard %d quorum of %d from %d keys: %w", shard, k, len(keys), ErrQuorum)
+	}
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.quorums[shard] = &Quorum{K: k, Keys: keys}
+	return nil
+}
+
+// Statement returns an unsigned statement of the current checksum and version
+// of a shard, for co-signers to sign.
+func (db *Db) Statement(shard Shard) (*SignedChecksum, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	st, ok := db.State[shard]
+	if !ok {
+		return nil, fmt.Errorf("shard %d: %w", shard, ErrUnknownShard)
+	}
+	return &SignedChecksum{
+		Shard:     shard,
+		Algorithm: st.Algorithm,
+		Checksum:  st.Checksum.Encode(),
+		Seq:       st.Version,
+		Time:      db.clock.Now(),
+	}, nil
+}
+
+// CoSign signs a statement with kp, but only if it matches this replica of
+// the shard: the same checksum at the same version.
+func (db *Db) CoSign(s *SignedChecksum, kp *ecdsa.PrivateKey) (*CoSignature, error) {
+	db.lock.Lock()
+	st, ok := db.State[s.Shard]
+	match := ok && st.Version == s.Seq && bytes.Equal(st.Checksum.Encode(), s.Checksum)
+	db.lock.Unlock()
+	if !match {
+		return nil, fmt.Errorf("shard %d statement %d: %w", s.Shard, s.Seq, ErrMismatch)
+	}
+	id, err := KeyId(&kp.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	r, sig, err := ecdsa.Sign(rand.Reader, kp, s.message())
+	if err != nil {
+		return nil, err
+	}
+	return &CoSignature{KeyId: id, Sig: Point{X: r, Y: sig}}, nil
+}
+
+// Add a co-signature to the ones collected.
+func (q *QuorumChecksum) Add(cs *CoSignature) {
+	q.Sigs = append(q.Sigs, *cs)
+}
+
+// VerifyQuorum checks that a statement is signed by a quorum of its shard's
+// co-signers, and accepts it unless it is older than the last statement
+// accepted for the shard, which fails with ErrStale.  The co-signatures are
+// kept to vouch for the shard's snapshots while it stays at that version.
+func (db *Db) VerifyQuorum(q *QuorumChecksum) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if err := db.verifyQuorum(q); err != nil {
+		return err
+	}
+	db.accepted[q.Statement.Shard] = q.Statement
+	db.cosigned[q.Statement.Shard] = q
+	return nil
+}
+
+func (db *Db) verifyQuorum(q *QuorumChecksum) error {
+	s := q.Statement
+	if s == nil {
+		return fmt.Errorf("no statement: %w", ErrQuorum)
+	}
+	quorum, ok := db.quorums[s.Shard]
+	if !ok {
+		return fmt.Errorf("shard %d has no quorum: %w", s.Shard, ErrNoKey)
+	}
+	keys := make(map[[sha256.Size]byte]*ecdsa.PublicKey)
+	for _, pub := range quorum.Keys {
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			return err
+		}
+		keys[sha256.Sum256(der)] = pub
+	}
+	msg := s.message()
+	signed := make(map[[sha256.Size]byte]bool)
+	for _, cs := range q.Sigs {
+		var id [sha256.Size]byte
+		copy(id[:], cs.KeyId)
+		pub, ok := keys[id]
+		if !ok || len(cs.KeyId) != sha256.Size || signed[id] {
+			continue
+		}
+		if cs.Sig.X != nil && cs.Sig.Y != nil && ecdsa.Verify(pub, msg, cs.Sig.X, cs.Sig.Y) {
+			signed[id] = true
+		}
+	}
+	if len(signed) < quorum.K {
+		return fmt.Errorf("shard %d statement %d has %d of %d signatures: %w", s.Shard, s.Seq, len(signed), quorum.K, ErrQuorum)
+	}
+	return db.checkFresh(s)
+}
@@ -0,0 +1,134 @@
+package shards
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+// cosigners makes n co-signer keys for a quorum.
+func cosigners(n int) ([]*ecdsa.PrivateKey, []*ecdsa.PublicKey) {
+	var keys []*ecdsa.PrivateKey
+	var pubs []*ecdsa.PublicKey
+	for i := 0; i < n; i++ {
+		kp, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		keys = append(keys, kp)
+		pubs = append(pubs, &kp.PublicKey)
+	}
+	return keys, pubs
+}
+
+// cosign collects the co-signatures of keys on shard 1's statement.
+func cosign(t *testing.T, db *Db, keys ...*ecdsa.PrivateKey) *QuorumChecksum {
+	t.Helper()
+	s, err := db.Statement(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := &QuorumChecksum{Statement: s}
+	for _, kp := range keys {
+		cs, err := db.CoSign(s, kp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q.Add(cs)
+	}
+	return q
+}
+
+func TestQuorumRefusesSingleKey(t *testing.T) {
+	keys, pubs := cosigners(3)
+	db, _ := NewDB(1, WithAlgorithm(LtHash16), WithKeyPair(1, testKey), WithQuorum(1, 2, pubs...))
+	if _, err := db.Insert(&DataRecord{Shard: 1}); err != nil {
+		t.Fatal(err)
+	}
+	sig, err := db.Sign(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Verify(1, sig) {
+		t.Fatal("a single key verified for a quorum shard")
+	}
+	s, err := db.SignChecksum(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.VerifyChecksum(s); !errors.Is(err, ErrQuorum) {
+		t.Fatalf("got %v", err)
+	}
+	if err := db.VerifyQuorum(cosign(t, db, keys[0])); !errors.Is(err, ErrQuorum) {
+		t.Fatalf("got %v", err)
+	}
+
+	// a snapshot vouched for by the writer's key alone is refused
+	single, _ := NewDB(1, WithAlgorithm(LtHash16), WithKeyPair(1, testKey))
+	if _, err := single.Insert(&DataRecord{Shard: 1}); err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := single.WriteSnapshot(1, &b); err != nil {
+		t.Fatal(err)
+	}
+	v, _ := NewVerifier(WithAlgorithm(LtHash16), WithPublicKey(1, &testKey.PublicKey), WithQuorum(1, 2, pubs...))
+	if _, err := v.LoadSnapshot(&b); !errors.Is(err, ErrBadSnapshot) {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestQuorumSnapshot(t *testing.T) {
+	keys, pubs := cosigners(3)
+	db, _ := NewDB(1, WithAlgorithm(LtHash16), WithKeyPair(1, testKey), WithQuorum(1, 2, pubs...))
+	if _, err := db.Insert(&DataRecord{Shard: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.WriteSnapshot(1, &bytes.Buffer{}); !errors.Is(err, ErrQuorum) {
+		t.Fatalf("without a quorum statement, got %v", err)
+	}
+	if err := db.VerifyQuorum(cosign(t, db, keys[0], keys[2])); err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := db.WriteSnapshot(1, &b); err != nil {
+		t.Fatal(err)
+	}
+	v, _ := NewVerifier(WithAlgorithm(LtHash16), WithPublicKey(1, &testKey.PublicKey), WithQuorum(1, 2, pubs...))
+	if _, err := v.LoadSnapshot(bytes.NewReader(b.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	sameShard(t, db, v, 1)
+	// the verifier can pass the snapshot on
+	var again bytes.Buffer
+	if err := v.WriteSnapshot(1, &again); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again.Bytes(), b.Bytes()) {
+		t.Fatal("the verifier's snapshot differs")
+	}
+
+	// one co-signature isn't enough
+	r := bytes.NewReader(b.Bytes())
+	payload, _, err := readFrame(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var h snapshotHeader
+	if err := h.UnmarshalBinary(payload); err != nil {
+		t.Fatal(err)
+	}
+	if len(h.CoSigs) != 2 {
+		t.Fatalf("%d co-signatures", len(h.CoSigs))
+	}
+	h.CoSigs = h.CoSigs[:1]
+	var short bytes.Buffer
+	if err := writeFrame(&short, canonical(&h)); err != nil {
+		t.Fatal(err)
+	}
+	short.ReadFrom(r)
+	other, _ := NewVerifier(WithAlgorithm(LtHash16), WithQuorum(1, 2, pubs...))
+	if _, err := other.LoadSnapshot(&short); !errors.Is(err, ErrBadSnapshot) {
+		t.Fatalf("got %v", err)
+	}
+}
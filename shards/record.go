@@ -0,0 +1,80 @@
+package shards
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+type Action int
+
+const ActionInsert = Action(0)
+const ActionRemove = Action(1)
+const ActionRenew = Action(2)
+const ActionReplace = Action(3)
+const ActionOffer = Action(4)
+const ActionAccept = Action(5)
+const ActionWithdraw = Action(6)
+const ActionRotate = Action(7)
+
+// ActionTouch is logged in a record's shard when a record in another shard
+// refers to it, so that its idle time replays with its own shard.  It can't
+// be submitted.
+const ActionTouch = Action(8)
+
+type Id int64
+type Shard int64
+
+type Reference struct {
+	Shard Shard `json:"shard,omitempty"`
+	Id    Id    `json:"id,omitempty"`
+}
+
+type Command struct {
+	Action Action      `json:"action,omitempty"`
+	Record *DataRecord `json:"record,omitempty"`
+	// At is the time on the database's clock that the command was applied.
+	// Do sets it, and only a replay of the log trusts what it was given.
+	At int64 `json:"at,omitempty"`
+	// Cascade a remove to everything that refers to the record
+	Cascade bool `json:"cascade,omitempty"`
+	// Expect is the digest of the record that a replace expects to find
+	Expect []byte `json:"expect,omitempty"`
+	// Offer is what an offer makes, or a withdrawal withdraws
+	Offer *Offer `json:"offer,omitempty"`
+	// Accept is the acceptance of an offer
+	Accept *Accept `json:"accept,omitempty"`
+	// Handoff hands a shard over to a new writer key
+	Handoff *KeyHandoff `json:"handoff,omitempty"`
+}
+
+// shard is the shard a command applies to.
+func (cmd *Command) shard() (Shard, bool) {
+	switch {
+	case cmd.Record != nil:
+		return cmd.Record.Shard, true
+	case cmd.Offer != nil:
+		return cmd.Offer.Shard, true
+	case cmd.Accept != nil:
+		return cmd.Accept.Shard, true
+	case cmd.Handoff != nil:
+		return cmd.Handoff.Shard, true
+	}
+	return 0, false
+}
+
+type DataRecord struct {
+	Shard   Shard                `json:"shard,omitempty"`
+	Id      Id                   `json:"id,omitempty"`
+	TTL     int64                `json:"ttl,omitempty"`
+	Refs    map[string]Reference `json:"refs,omitempty"`
+	Ints    map[string]int64     `json:"ints,omitempty"`
+	Strings map[string]string    `json:"strings,omitempty"`
+}
+
+func AsJson(v interface{}) string {
+	s, err := json.Marshal(v)
+	if err != nil {
+		panic(fmt.Sprintf("cannot marshal data: %v", err))
+	}
+	return string(s)
+}
@@ -0,0 +1,104 @@
+package shards
+
+import (
+	"fmt"
+	"sort"
+)
+
+// All pointers must point back to existing data.  Insert refuses records
+// whose Refs dangle, and Remove refuses records that something still refers
+// to, unless the command cascades.  The reverse index from each record to the
+// records that refer to it makes both checks cheap.
+
+type refIndex map[Reference]map[Reference]int
+
+func refOf(v *DataRecord) Reference {
+	return Reference{Shard: v.Shard, Id: v.Id}
+}
+
+func (db *Db) exists(ref Reference) bool {
+	st, ok := db.State[ref.Shard]
+	return ok && st.Data[ref.Id] != nil
+}
+
+// checkRefs returns an error if any of v's refs point at nothing.
+func (db *Db) checkRefs(v *DataRecord) error {
+	for name, ref := range v.Refs {
+		if !db.exists(ref) {
+			return fmt.Errorf(
+				"object %d:%d ref %q to %d:%d: %w",
+				v.Shard, v.Id, name, ref.Shard, ref.Id, ErrDanglingRef,
+			)
+		}
+	}
+	return nil
+}
+
+// referrers returns the records that refer to ref, in order.
+func (db *Db) referrers(ref Reference) []Reference {
+	from := make([]Reference, 0, len(db.refs[ref]))
+	for r := range db.refs[ref] {
+		from = append(from, r)
+	}
+	sort.Slice(from, func(i, j int) bool {
+		if from[i].Shard != from[j].Shard {
+			return from[i].Shard < from[j].Shard
+		}
+		return from[i].Id < from[j].Id
+	})
+	return from
+}
+
+// link adds v's refs to the reverse index.
+func (db *Db) link(t *tx, v *DataRecord) {
+	db.relink(v, 1)
+	t.onUndo(func() { db.relink(v, -1) })
+}
+
+// unlink removes v's refs from the reverse index.
+func (db *Db) unlink(t *tx, v *DataRecord) {
+	db.relink(v, -1)
+	t.onUndo(func() { db.relink(v, 1) })
+}
+
+func (db *Db) relink(v *DataRecord, n int) {
+	from := refOf(v)
+	for _, to := range v.Refs {
+		if db.refs[to] == nil {
+			db.refs[to] = make(map[Reference]int)
+		}
+		db.refs[to][from] += n
+		if db.refs[to][from] == 0 {
+			delete(db.refs[to], from)
+		}
+		if len(db.refs[to]) == 0 {
+			delete(db.refs, to)
+		}
+	}
+}
+
+// cascade expands a remove into removes of everything that refers to the
+// record, directly or not, ordered so that referrers go before what they
+// refer to.  The expansion is what gets logged, so replay doesn't depend on
+// the order that shards are replayed in.
+func (db *Db) cascade(cmd Command) []Command {
+	var cmds []Command
+	seen := make(map[Reference]bool)
+	var visit func(ref Reference)
+	visit = func(ref Reference) {
+		if seen[ref] {
+			return
+		}
+		seen[ref] = true
+		for _, from := range db.referrers(ref) {
+			visit(from)
+		}
+		if db.exists(ref) && ref != refOf(cmd.Record) {
+			v := db.State[ref.Shard].Data[ref.Id]
+			cmds = append(cmds, Command{Action: ActionRemove, Record: v, At: cmd.At})
+		}
+	}
+	visit(refOf(cmd.Record))
+	cmd.Cascade = false
+	return append(cmds, cmd)
+}
@@ -0,0 +1,123 @@
+package shards
+
+import (
+	"errors"
+	"testing"
+)
+
+func ref(shard Shard, id Id) map[string]Reference {
+	return map[string]Reference{"to": {Shard: shard, Id: id}}
+}
+
+func TestDanglingRef(t *testing.T) {
+	db, _ := NewDB(1, WithAlgorithm(LtHash16))
+	if _, err := db.Insert(&DataRecord{Shard: 1}); err != nil {
+		t.Fatal(err)
+	}
+	before := db.Checksum(1)
+	if _, err := db.Insert(&DataRecord{Shard: 1, Refs: ref(2, 1)}); !errors.Is(err, ErrDanglingRef) {
+		t.Fatalf("got %v", err)
+	}
+	old := db.Get(1, 1)
+	v := *old
+	v.Refs = ref(1, 9)
+	if _, err := db.Replace(&v, db.Digest(old)); !errors.Is(err, ErrDanglingRef) {
+		t.Fatalf("replace got %v", err)
+	}
+	if db.Checksum(1) != before || len(db.State[1].Data) != 1 || len(db.refs) != 0 {
+		t.Fatal("a dangling ref changed the shard")
+	}
+}
+
+func TestCascadeAcrossShards(t *testing.T) {
+	dir := tempDir(t)
+	db, wal := testDb(t, dir)
+	target, _ := db.Insert(&DataRecord{Shard: 1})
+	if _, err := db.Insert(&DataRecord{Shard: 2, Refs: ref(1, target.Id)}); err != nil {
+		t.Fatal(err)
+	}
+	// a record that refers to the referrer, in a third shard
+	if _, err := db.Insert(&DataRecord{Shard: 3, Refs: ref(2, 1)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Remove(db.Get(1, 1)); !errors.Is(err, ErrReferenced) {
+		t.Fatalf("got %v", err)
+	}
+	if _, err := db.RemoveCascade(db.Get(1, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if db.Get(1, 1) != nil || db.Get(2, 1) != nil || db.Get(3, 1) != nil || len(db.refs) != 0 {
+		t.Fatal("the cascade left records behind")
+	}
+	wal.Close()
+	again, wal := testDb(t, dir)
+	defer wal.Close()
+	for _, shard := range []Shard{1, 2, 3} {
+		sameShard(t, db, again, shard)
+	}
+}
+
+func TestRefsRolledBack(t *testing.T) {
+	db, _ := NewDB(1, WithAlgorithm(LtHash16))
+	db.Insert(&DataRecord{Shard: 1})
+	db.Insert(&DataRecord{Shard: 2, Refs: ref(1, 1)})
+	referrers := func() int {
+		db.lock.Lock()
+		defer db.lock.Unlock()
+		return len(db.referrers(Reference{Shard: 1, Id: 1}))
+	}
+
+	// a new referrer, then a failure
+	b := Batch{Commands: []Command{
+		{Action: ActionInsert, Record: &DataRecord{Shard: 2, Refs: ref(1, 1)}},
+		{Action: ActionInsert, Record: &DataRecord{Shard: 1, Id: 1}},
+	}}
+	if _, err := db.DoBatch(b); !errors.Is(err, ErrExists) {
+		t.Fatalf("got %v", err)
+	}
+	if n := referrers(); n != 1 {
+		t.Fatalf("%d referrers after a rollback", n)
+	}
+	// a cascade, then a failure
+	b = Batch{Commands: []Command{
+		{Action: ActionRemove, Record: db.Get(1, 1), Cascade: true},
+		{Action: ActionInsert, Record: &DataRecord{Shard: 2, Refs: ref(1, 1)}},
+	}}
+	if _, err := db.DoBatch(b); !errors.Is(err, ErrDanglingRef) {
+		t.Fatalf("got %v", err)
+	}
+	if n := referrers(); n != 1 || db.Get(2, 1) == nil {
+		t.Fatalf("%d referrers after a rollback", n)
+	}
+	if _, err := db.Remove(db.Get(1, 1)); !errors.Is(err, ErrReferenced) {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestCascadeCycle(t *testing.T) {
+	dir := tempDir(t)
+	db, wal := testDb(t, dir)
+	db.Insert(&DataRecord{Shard: 1})
+	db.Insert(&DataRecord{Shard: 1, Refs: ref(1, 1)})
+	old := db.Get(1, 1)
+	v := *old
+	v.Refs = ref(1, 2)
+	if _, err := db.Replace(&v, db.Digest(old)); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []Id{1, 2} {
+		if _, err := db.Remove(db.Get(1, id)); !errors.Is(err, ErrReferenced) {
+			t.Fatalf("remove %d got %v", id, err)
+		}
+	}
+	if _, err := db.RemoveCascade(db.Get(1, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.State[1].Data) != 0 || len(db.refs) != 0 {
+		t.Fatal("the cascade left records behind")
+	}
+	wal.Close()
+	again, wal := testDb(t, dir)
+	defer wal.Close()
+	sameShard(t, db, again, 1)
+}
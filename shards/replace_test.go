@@ -0,0 +1,58 @@
+package shards
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestReplace(t *testing.T) {
+	db, _ := NewDB(1, WithAlgorithm(LtHash16))
+	old, err := db.Insert(&DataRecord{Shard: 1, Ints: map[string]int64{"n": 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := &DataRecord{Shard: 1, Id: old.Id, Ints: map[string]int64{"n": 2}}
+	if _, err := db.Replace(v, db.Digest(old)); err != nil {
+		t.Fatal(err)
+	}
+	want, _ := ChecksumOf(LtHash16, DefaultDigester, []*DataRecord{v})
+	if db.Checksum(1) != FormatChecksum(1, want) || db.Get(1, 1).Ints["n"] != 2 {
+		t.Fatal("the replace didn't take the record's place")
+	}
+
+	// expecting the record that was replaced
+	before, version := db.Checksum(1), db.State[1].Version
+	stale := &DataRecord{Shard: 1, Id: 1, Ints: map[string]int64{"n": 3}}
+	if _, err := db.Replace(stale, db.Digest(old)); !errors.Is(err, ErrConflict) {
+		t.Fatalf("got %v", err)
+	}
+	if _, err := db.Replace(stale, nil); !errors.Is(err, ErrConflict) {
+		t.Fatalf("without an expected digest, got %v", err)
+	}
+	if _, err := db.Replace(&DataRecord{Shard: 1, Id: 9}, db.Digest(v)); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("a missing record, got %v", err)
+	}
+	if db.Checksum(1) != before || db.State[1].Version != version || db.Get(1, 1).Ints["n"] != 2 {
+		t.Fatal("a failed replace changed the shard")
+	}
+}
+
+func TestReplaceRolledBack(t *testing.T) {
+	db, _ := NewDB(1, WithAlgorithm(LtHash16))
+	old, _ := db.Insert(&DataRecord{Shard: 1, Ints: map[string]int64{"n": 1}})
+	before := db.Checksum(1)
+	b := Batch{Commands: []Command{
+		{Action: ActionReplace, Record: &DataRecord{Shard: 1, Id: 1, Ints: map[string]int64{"n": 2}}, Expect: db.Digest(old)},
+		{Action: ActionInsert, Record: &DataRecord{Shard: 1, Id: 1}},
+	}}
+	if _, err := db.DoBatch(b); !errors.Is(err, ErrExists) {
+		t.Fatalf("got %v", err)
+	}
+	if db.Checksum(1) != before || db.Get(1, 1).Ints["n"] != 1 {
+		t.Fatal("the replace wasn't rolled back")
+	}
+	// the record can still be replaced as it was
+	if _, err := db.Replace(&DataRecord{Shard: 1, Id: 1}, db.Digest(old)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,515 @@
+package shards
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// Replicas reach eventual consistency per shard by anti-entropy over HTTP.
+// A replica asks a peer for a shard's signed statement and the digest of
+// everything that counts in its checksum: records, pending removals and open
+// offers.  It fetches the entries it is missing or has different, drops the
+// ones the peer doesn't have, and keeps the result only if its checksum is
+// then exactly the one the shard's writer signed.  Shards that a database
+// writes are never synced into it; it is their authority, and shards signed
+// for by a quorum aren't synced.
+//
+// The peer serves, under ReplicationHandler:
+//
+//  GET  /replication/shards             every shard's version and checksum
+//  GET  /replication/shard?shard=N      statement, key handoffs and digests
+//  POST /replication/entries?shard=N    the entries named in the body
+//  POST /replication/buckets?shard=N    the children of the buckets in the body
+//  GET  /replication/sketch?shard=N&cells=M  statement, handoffs and sketch
+//
+// A peer that doesn't write a shard only serves it if its replica is exactly
+// the last statement it accepted.
+
+const (
+	entryRecord  = 1
+	entryPending = 2
+	entryOffer   = 3
+)
+
+type entryKey struct {
+	Kind int `json:"kind"`
+	Id   Id  `json:"id"`
+}
+
+type syncEntry struct {
+	entryKey
+	Digest []byte      `json:"digest,omitempty"`
+	Record *DataRecord `json:"record,omitempty"`
+	Offer  *Offer      `json:"offer,omitempty"`
+}
+
+// ShardSummary is a shard's version and encoded checksum.
+type ShardSummary struct {
+	Shard    Shard  `json:"shard"`
+	Version  int64  `json:"version,omitempty"`
+	Checksum []byte `json:"checksum,omitempty"`
+}
+
+type syncShard struct {
+	Statement *SignedChecksum `json:"statement,omitempty"`
+	Handoffs  []*KeyHandoff   `json:"handoffs,omitempty"`
+	Digests   []syncEntry     `json:"digests,omitempty"`
+}
+
+// entries returns the digest of everything that counts in a shard's
+// checksum.
+func (db *Db) entries(st *State) map[entryKey][]byte {
+	m := make(map[entryKey][]byte, len(st.Data)+len(st.Pending)+len(st.Offers))
+	for id, v := range st.Data {
+		m[entryKey{entryRecord, id}] = db.digester.Record(v)
+	}
+	for id, v := range st.Pending {
+		m[entryKey{entryPending, id}] = db.digester.Record(v)
+	}
+	for id, o := range st.Offers {
+		m[entryKey{entryOffer, id}] = db.digester.Offer(o)
+	}
+	return m
+}
+
+func (e *syncEntry) digest(d Digester) []byte {
+	switch {
+	case e.Kind == entryOffer && e.Offer != nil:
+		return d.Offer(e.Offer)
+	case e.Kind != entryOffer && e.Record != nil:
+		return d.Record(e.Record)
+	}
+	return nil
+}
+
+// MaxReplicationBody is the largest request body that ReplicationHandler
+// reads, which is room for the keys of half a million entries.
+const MaxReplicationBody = 16 << 20
+
+// ReplicationHandler serves this database's shards to replicas.
+func (db *Db) ReplicationHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/replication/shards", db.serveShards)
+	mux.HandleFunc("/replication/shard", db.serveShard)
+	mux.HandleFunc("/replication/entries", db.serveEntries)
+	mux.HandleFunc("/replication/buckets", db.serveBuckets)
+	mux.HandleFunc("/replication/sketch", db.serveSketch)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, MaxReplicationBody)
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func shardParam(r *http.Request) (Shard, error) {
+	n, err := strconv.ParseInt(r.URL.Query().Get("shard"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("shard %q: %w", r.URL.Query().Get("shard"), ErrUnknownShard)
+	}
+	return Shard(n), nil
+}
+
+func (db *Db) serveShards(w http.ResponseWriter, r *http.Request) {
+	db.lock.Lock()
+	ids := make([]Shard, 0, len(db.State))
+	for shard := range db.State {
+		ids = append(ids, shard)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	summaries := make([]ShardSummary, len(ids))
+	for i, shard := range ids {
+		st := db.State[shard]
+		summaries[i] = ShardSummary{Shard: shard, Version: st.Version, Checksum: st.Checksum.Encode()}
+	}
+	db.lock.Unlock()
+	writeJSON(w, summaries)
+}
+
+func (db *Db) serveShard(w http.ResponseWriter, r *http.Request) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	st, s, ok := db.serving(w, r)
+	if !ok {
+		return
+	}
+	reply := syncShard{Statement: s, Handoffs: st.Keys}
+	for k, h := range db.entries(st) {
+		reply.Digests = append(reply.Digests, syncEntry{entryKey: k, Digest: h})
+	}
+	sort.Slice(reply.Digests, func(i, j int) bool {
+		a, b := reply.Digests[i], reply.Digests[j]
+		return a.Kind < b.Kind || (a.Kind == b.Kind && a.Id < b.Id)
+	})
+	writeJSON(w, reply)
+}
+
+func (db *Db) serveEntries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST a list of entries", http.StatusMethodNotAllowed)
+		return
+	}
+	shard, err := shardParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var keys []entryKey
+	if err := json.NewDecoder(r.Body).Decode(&keys); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	st, ok := db.State[shard]
+	if !ok {
+		http.Error(w, fmt.Sprintf("shard %d: %v", shard, ErrUnknownShard), http.StatusNotFound)
+		return
+	}
+	reply := make([]syncEntry, 0, len(keys))
+	for _, k := range keys {
+		e := syncEntry{entryKey: k}
+		switch k.Kind {
+		case entryRecord:
+			e.Record = st.Data[k.Id]
+		case entryPending:
+			e.Record = st.Pending[k.Id]
+		case entryOffer:
+			e.Offer = st.Offers[k.Id]
+		}
+		if e.Record != nil || e.Offer != nil {
+			reply = append(reply, e)
+		}
+	}
+	writeJSON(w, reply)
+}
+
+func getJSON(client *http.Client, url string, v interface{}) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func postJSON(client *http.Client, url string, body interface{}, v interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("POST %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// SyncFrom brings every shard that peer has, and this database doesn't
+// write, up to date with it.  It carries on past a shard that fails, and
+// returns the first error.
+func (db *Db) SyncFrom(client *http.Client, peer string) error {
+	var summaries []ShardSummary
+	if err := getJSON(client, peer+"/replication/shards", &summaries); err != nil {
+		return err
+	}
+	var first error
+	for _, s := range summaries {
+		db.lock.Lock()
+		st, ok := db.State[s.Shard]
+		writer := db.keys[s.Shard] != nil
+		same := ok && st.Version == s.Version && bytes.Equal(st.Checksum.Encode(), s.Checksum)
+		db.lock.Unlock()
+		if writer || same {
+			continue
+		}
+		if err := db.SyncShard(client, peer, s.Shard); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// SyncShard brings a shard up to date with peer.  The shard's public key
+// must be registered, and the result is only kept if it has exactly the
+// checksum in the statement that the shard's writer signed.
+func (db *Db) SyncShard(client *http.Client, peer string, shard Shard) error {
+	var remote syncShard
+	if err := getJSON(client, fmt.Sprintf("%s/replication/shard?shard=%d", peer, shard), &remote); err != nil {
+		return err
+	}
+	db.lock.Lock()
+	want := db.missing(shard, remote.Digests)
+	db.lock.Unlock()
+
+	fetched, err := fetch(client, peer, shard, want)
+	if err != nil {
+		return err
+	}
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return db.merge(shard, remote.Statement, remote.Handoffs, func(t *tx, st *State) error {
+		peer := make(map[entryKey][]byte, len(remote.Digests))
+		for _, e := range remote.Digests {
+			peer[e.entryKey] = e.Digest
+		}
+		drops := make(map[entryKey][]byte)
+		for k, h := range db.entries(st) {
+			if !bytes.Equal(peer[k], h) {
+				drops[k] = h
+			}
+		}
+		var adds []syncEntry
+		for _, e := range remote.Digests {
+			if h := db.entryDigest(st, e.entryKey); h == nil || drops[e.entryKey] != nil {
+				adds = append(adds, e)
+			}
+		}
+		return db.patch(t, shard, st, drops, adds, fetched)
+	})
+}
+
+// fetch gets the entries named by want from peer.
+func fetch(client *http.Client, peer string, shard Shard, want []entryKey) (map[entryKey]*syncEntry, error) {
+	fetched := make(map[entryKey]*syncEntry)
+	if len(want) == 0 {
+		return fetched, nil
+	}
+	var entries []syncEntry
+	if err := postJSON(client, fmt.Sprintf("%s/replication/entries?shard=%d", peer, shard), want, &entries); err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		fetched[entries[i].entryKey] = &entries[i]
+	}
+	return fetched, nil
+}
+
+// serving finds the shard a request is for, and the statement to serve
+// with it.  It writes the error itself if there isn't one.
+func (db *Db) serving(w http.ResponseWriter, r *http.Request) (*State, *SignedChecksum, bool) {
+	shard, err := shardParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, nil, false
+	}
+	st, ok := db.State[shard]
+	if !ok {
+		http.Error(w, fmt.Sprintf("shard %d: %v", shard, ErrUnknownShard), http.StatusNotFound)
+		return nil, nil, false
+	}
+	var s *SignedChecksum
+	if st.KeyPair != nil {
+		if s, err = db.signChecksum(shard); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return nil, nil, false
+		}
+	} else if s = db.accepted[shard]; s == nil || s.Seq != st.Version || !bytes.Equal(s.Checksum, st.Checksum.Encode()) {
+		http.Error(w, fmt.Sprintf("shard %d: %v", shard, ErrStale), http.StatusConflict)
+		return nil, nil, false
+	}
+	return st, s, true
+}
+
+// missing lists the entries of the peer that this replica doesn't have.
+func (db *Db) missing(shard Shard, digests []syncEntry) []entryKey {
+	var local map[entryKey][]byte
+	if st, ok := db.State[shard]; ok {
+		local = db.entries(st)
+	}
+	var want []entryKey
+	for _, e := range digests {
+		if !bytes.Equal(local[e.entryKey], e.Digest) {
+			want = append(want, e.entryKey)
+		}
+	}
+	return want
+}
+
+// merge verifies a peer's statement and key handoffs for a shard, and patches
+// the shard to match the peer, keeping the result only if its checksum is
+// then the one in the statement.
+func (db *Db) merge(shard Shard, s *SignedChecksum, handoffs []*KeyHandoff, patch func(t *tx, st *State) error) error {
+	if s == nil || s.Shard != shard {
+		return fmt.Errorf("shard %d: no statement: %w", shard, ErrMismatch)
+	}
+	if db.keys[shard] != nil {
+		return fmt.Errorf("shard %d is written here: %w", shard, ErrReadOnly)
+	}
+	root, ok := db.pubs[shard]
+	if !ok {
+		return fmt.Errorf("shard %d: %w", shard, ErrNoKey)
+	}
+	st, had := db.State[shard]
+	if had && s.Seq < st.Version {
+		return fmt.Errorf("shard %d peer is at %d, replica at %d: %w", shard, s.Seq, st.Version, ErrStale)
+	}
+	if !had {
+		var err error
+		if st, err = newState(db.algorithmFor(shard)); err != nil {
+			return fmt.Errorf("shard %d: %w", shard, err)
+		}
+		st.PublicKey = pointOf(root)
+	}
+	t := &tx{replay: true}
+	ok = false
+	defer func() {
+		if !ok {
+			t.rollback()
+		}
+	}()
+	// a shard new to this replica is only kept if the sync succeeds
+	if !had {
+		db.State[shard] = st
+		t.onUndo(func() { delete(db.State, shard) })
+	}
+
+	// the peer's chain of keys must extend ours
+	if len(handoffs) < len(st.Keys) {
+		return fmt.Errorf("shard %d peer has %d handoffs, replica %d: %w", shard, len(handoffs), len(st.Keys), ErrStale)
+	}
+	for i, h := range handoffs {
+		if i < len(st.Keys) {
+			if !bytes.Equal(canonical(h), canonical(st.Keys[i])) {
+				return fmt.Errorf("shard %d handoff %d differs: %w", shard, i, ErrMismatch)
+			}
+			continue
+		}
+		st.addHandoff(t, h)
+	}
+	if _, err := keyChain(root, st.Keys, true); err != nil {
+		return err
+	}
+	if err := db.verifyChecksum(s); err != nil {
+		return err
+	}
+
+	if err := patch(t, st); err != nil {
+		return err
+	}
+
+	if !bytes.Equal(st.Checksum.Encode(), s.Checksum) {
+		return fmt.Errorf("shard %d does not have the signed checksum after syncing: %w", shard, ErrMismatch)
+	}
+	version := st.Version
+	st.Version = s.Seq
+	t.onUndo(func() { st.Version = version })
+	last, had := db.accepted[shard]
+	db.accepted[shard] = s
+	t.onUndo(func() {
+		if had {
+			db.accepted[shard] = last
+		} else {
+			delete(db.accepted, shard)
+		}
+	})
+	// a replica's snapshot is vouched for by the writer's statement, so
+	// the synced shard survives a restart
+	if db.wal != nil {
+		if err := db.wal.compact(shard, func(w io.Writer) error {
+			return db.writeSnapshot(shard, w)
+		}); err != nil {
+			return err
+		}
+	}
+	ok = true
+	return nil
+}
+
+// patch drops entries from a shard and adds ones fetched from a peer, each of
+// which must have the digest the peer gave for it.
+func (db *Db) patch(t *tx, shard Shard, st *State, drops map[entryKey][]byte, adds []syncEntry, fetched map[entryKey]*syncEntry) error {
+	for k, h := range drops {
+		if !bytes.Equal(db.entryDigest(st, k), h) {
+			return fmt.Errorf("shard %d has no entry %d:%d to drop: %w", shard, k.Kind, k.Id, ErrMismatch)
+		}
+		db.drop(t, st, k, h)
+	}
+	for _, e := range adds {
+		if db.entryDigest(st, e.entryKey) != nil {
+			return fmt.Errorf("shard %d already has entry %d:%d: %w", shard, e.Kind, e.Id, ErrMismatch)
+		}
+		got := fetched[e.entryKey]
+		if got == nil || !bytes.Equal(got.digest(db.digester), e.Digest) {
+			return fmt.Errorf("shard %d entry %d:%d did not arrive intact: %w", shard, e.Kind, e.Id, ErrMismatch)
+		}
+		if err := db.keep(t, shard, st, got, e.Digest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// entryDigest is the digest of an entry of a shard, or nil if it has none.
+func (db *Db) entryDigest(st *State, k entryKey) []byte {
+	switch k.Kind {
+	case entryRecord:
+		if v, ok := st.Data[k.Id]; ok {
+			return db.digester.Record(v)
+		}
+	case entryPending:
+		if v, ok := st.Pending[k.Id]; ok {
+			return db.digester.Record(v)
+		}
+	case entryOffer:
+		if o, ok := st.Offers[k.Id]; ok {
+			return db.digester.Offer(o)
+		}
+	}
+	return nil
+}
+
+// drop removes an entry whose digest is h from a shard.
+func (db *Db) drop(t *tx, st *State, k entryKey, h []byte) {
+	switch k.Kind {
+	case entryRecord:
+		v := st.Data[k.Id]
+		st.del(t, v, h)
+		db.unlink(t, v)
+	case entryPending:
+		st.unpend(t, st.Pending[k.Id], h)
+	case entryOffer:
+		st.delOffer(t, st.Offers[k.Id], h)
+	}
+}
+
+// keep adds an entry whose digest is h to a shard.
+func (db *Db) keep(t *tx, shard Shard, st *State, e *syncEntry, h []byte) error {
+	if e.Kind == entryOffer {
+		if e.Offer.Shard != shard || e.Offer.Id != e.Id {
+			return fmt.Errorf("offer %d:%d is out of place: %w", e.Offer.Shard, e.Offer.Id, ErrMismatch)
+		}
+		st.putOffer(t, e.Offer, h)
+		return nil
+	}
+	v := e.Record
+	if v.Shard != shard || v.Id != e.Id {
+		return fmt.Errorf("object %d:%d is out of place: %w", v.Shard, v.Id, ErrMismatch)
+	}
+	if st.HighestId < v.Id {
+		st.setHighest(t, v.Id)
+	}
+	if e.Kind == entryPending {
+		st.pend(t, v, h)
+		return nil
+	}
+	st.put(t, v, h)
+	db.link(t, v)
+	return nil
+}
@@ -0,0 +1,160 @@
+package shards
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// testWriter makes a database that writes shard 1, with n records.
+func testWriter(t *testing.T, n int) *Db {
+	t.Helper()
+	db, _ := NewDB(1, WithAlgorithm(LtHash16), WithKeyPair(1, testKey))
+	for i := 0; i < n; i++ {
+		if _, err := db.Insert(&DataRecord{Shard: 1, Ints: map[string]int64{"n": int64(i)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func testReplica() *Db {
+	db, _ := NewVerifier(WithAlgorithm(LtHash16), WithPublicKey(1, &testKey.PublicKey))
+	return db
+}
+
+func serve(t *testing.T, h http.Handler) string {
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func TestSyncConverges(t *testing.T) {
+	writer := testWriter(t, 20)
+	peer := serve(t, writer.ReplicationHandler())
+	a, b := testReplica(), testReplica()
+	if err := a.SyncFrom(http.DefaultClient, peer); err != nil {
+		t.Fatal(err)
+	}
+	sameShard(t, writer, a, 1)
+
+	// the writer moves on, and a falls behind
+	for id := Id(1); id <= 10; id += 3 {
+		if _, err := writer.Remove(writer.Get(1, id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := writer.Insert(&DataRecord{Shard: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SyncFrom(http.DefaultClient, peer); err != nil {
+		t.Fatal(err)
+	}
+	if a.Checksum(1) == b.Checksum(1) {
+		t.Fatal("the replicas didn't diverge")
+	}
+
+	// b serves what it synced, and a catches up from it
+	if err := a.SyncFrom(http.DefaultClient, serve(t, b.ReplicationHandler())); err != nil {
+		t.Fatal(err)
+	}
+	sameShard(t, writer, a, 1)
+	sameShard(t, writer, b, 1)
+	for id := Id(1); id <= 10; id += 3 {
+		if a.Get(1, id) != nil {
+			t.Fatalf("record %d was not dropped", id)
+		}
+	}
+	// a peer behind the replica is refused
+	old := testWriter(t, 20)
+	if err := b.SyncShard(http.DefaultClient, serve(t, old.ReplicationHandler()), 1); !errors.Is(err, ErrStale) {
+		t.Fatalf("got %v", err)
+	}
+}
+
+// tamper serves h, but passes the statement of each shard through f.
+func tamper(h http.Handler, f func(s *SignedChecksum)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/replication/shard" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		var reply syncShard
+		if err := json.Unmarshal(rec.Body.Bytes(), &reply); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		f(reply.Statement)
+		writeJSON(w, reply)
+	})
+}
+
+func TestSyncRejectsTamperedStatement(t *testing.T) {
+	writer := testWriter(t, 5)
+	replica := testReplica()
+	if err := replica.SyncFrom(http.DefaultClient, serve(t, writer.ReplicationHandler())); err != nil {
+		t.Fatal(err)
+	}
+	before := replica.Checksum(1)
+	if _, err := writer.Insert(&DataRecord{Shard: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name string
+		f    func(s *SignedChecksum)
+		err  error
+	}{
+		{"seq", func(s *SignedChecksum) { s.Seq++ }, ErrBadSignature},
+		{"checksum", func(s *SignedChecksum) { s.Checksum[len(s.Checksum)-1] ^= 1 }, ErrBadSignature},
+		{"key", func(s *SignedChecksum) { s.KeyId[0] ^= 1 }, ErrWrongKey},
+	} {
+		peer := serve(t, tamper(writer.ReplicationHandler(), c.f))
+		if err := replica.SyncFrom(http.DefaultClient, peer); !errors.Is(err, c.err) {
+			t.Fatalf("%s: got %v", c.name, err)
+		}
+		if replica.Checksum(1) != before || replica.State[1].Version != 5 {
+			t.Fatalf("%s: the replica changed to %s", c.name, replica.Checksum(1))
+		}
+	}
+	if err := replica.SyncFrom(http.DefaultClient, serve(t, writer.ReplicationHandler())); err != nil {
+		t.Fatal(err)
+	}
+	sameShard(t, writer, replica, 1)
+}
+
+func TestFailedSyncLeavesNoShard(t *testing.T) {
+	writer := testWriter(t, 5)
+	replica := testReplica()
+	peer := serve(t, tamper(writer.ReplicationHandler(), func(s *SignedChecksum) { s.Seq++ }))
+	if err := replica.SyncFrom(http.DefaultClient, peer); !errors.Is(err, ErrBadSignature) {
+		t.Fatalf("got %v", err)
+	}
+	if _, ok := replica.State[1]; ok {
+		t.Fatal("a failed sync left the shard behind")
+	}
+	var summaries []ShardSummary
+	if err := getJSON(http.DefaultClient, serve(t, replica.ReplicationHandler())+"/replication/shards", &summaries); err != nil || len(summaries) != 0 {
+		t.Fatalf("the replica serves %v, %v", summaries, err)
+	}
+}
+
+func TestReplicationBodyLimit(t *testing.T) {
+	peer := serve(t, testWriter(t, 1).ReplicationHandler())
+	for _, path := range []string{"/replication/entries?shard=1", "/replication/buckets?shard=1"} {
+		body := strings.Repeat(" ", MaxReplicationBody) + "[]"
+		resp, err := http.Post(peer+path, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("%s: %s", path, resp.Status)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package shards
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// A shard with millions of entries and a few differences can be reconciled
+// in one exchange with an invertible Bloom lookup table.  Every entry that
+// counts in the checksum, as its kind, id and digest, is XORed into three
+// cells of a table of a fixed size, one in each third, with a count and a
+// check hash.  Subtracting the peer's table from a replica's cancels what
+// they share, and if there are no more differences than about two thirds of
+// the cells, peeling the cells that hold a single entry recovers every one:
+// a count of 1 is an entry only the replica has, and -1 one only the peer
+// has.  The replica then fetches the entries it lacks as SyncShard does, and
+// keeps the result only if it has the checksum the shard's writer signed.
+//
+// The peer serves its table, statement and key handoffs under
+// ReplicationHandler, at
+//
+//  GET /replication/sketch?shard=N&cells=M
+
+const sketchHashes = 3
+
+// MaxSketchCells is the largest table a peer will build.
+const MaxSketchCells = 1 << 20
+
+var ErrSketchFull = errors.New("sketch has too many differences to decode")
+
+type sketchCell struct {
+	Count int64  `json:"count,omitempty"`
+	Key   []byte `json:"key,omitempty"`
+	Hash  uint64 `json:"hash,omitempty"`
+}
+
+// Sketch is an invertible Bloom lookup table of a shard's entries.
+type Sketch struct {
+	Cells []sketchCell `json:"cells"`
+}
+
+type syncSketch struct {
+	Statement *SignedChecksum `json:"statement,omitempty"`
+	Handoffs  []*KeyHandoff   `json:"handoffs,omitempty"`
+	Sketch    *Sketch         `json:"sketch,omitempty"`
+}
+
+// newSketch returns an empty table of at least cells cells.
+func newSketch(cells int) *Sketch {
+	if cells < sketchHashes {
+		cells = sketchHashes
+	}
+	cells += (sketchHashes - cells%sketchHashes) % sketchHashes
+	return &Sketch{Cells: make([]sketchCell, cells)}
+}
+
+func sketchElement(k entryKey, h []byte) []byte {
+	b := make([]byte, 9, 9+len(h))
+	b[0] = byte(k.Kind)
+	binary.BigEndian.PutUint64(b[1:], uint64(k.Id))
+	return append(b, h...)
+}
+
+func parseElement(b []byte) (entryKey, []byte) {
+	return entryKey{Kind: int(b[0]), Id: Id(binary.BigEndian.Uint64(b[1:9]))}, b[9:]
+}
+
+func sketchHash(salt byte, element []byte) uint64 {
+	h := sha256.New()
+	h.Write([]byte{salt})
+	h.Write(element)
+	return binary.BigEndian.Uint64(h.Sum(nil))
+}
+
+func (c *sketchCell) toggle(element []byte, count int64, check uint64) {
+	if c.Key == nil {
+		c.Key = make([]byte, len(element))
+	}
+	for i, x := range element {
+		c.Key[i] ^= x
+	}
+	c.Count += count
+	c.Hash ^= check
+}
+
+func (c *sketchCell) empty() bool {
+	return c.Count == 0 && c.Hash == 0 && len(bytes.Trim(c.Key, "\x00")) == 0
+}
+
+func (c *sketchCell) pure() bool {
+	return (c.Count == 1 || c.Count == -1) && c.Hash == sketchHash(0xff, c.Key)
+}
+
+// insert adds an element to the table count times.
+func (s *Sketch) insert(element []byte, count int64) {
+	check := sketchHash(0xff, element)
+	n := len(s.Cells) / sketchHashes
+	for i := 0; i < sketchHashes; i++ {
+		cell := i*n + int(sketchHash(byte(i), element)%uint64(n))
+		s.Cells[cell].toggle(element, count, check)
+	}
+}
+
+// subtract takes other's elements out of the table.
+func (s *Sketch) subtract(other *Sketch, width int) error {
+	if len(other.Cells) != len(s.Cells) {
+		return fmt.Errorf("sketch of %d cells from one of %d: %w", len(other.Cells), len(s.Cells), ErrMismatch)
+	}
+	for i := range other.Cells {
+		c := &other.Cells[i]
+		if c.Key == nil {
+			continue
+		}
+		if len(c.Key) != width {
+			return fmt.Errorf("sketch cell %d is %d bytes, not %d: %w", i, len(c.Key), width, ErrMismatch)
+		}
+		s.Cells[i].toggle(c.Key, -c.Count, c.Hash)
+	}
+	return nil
+}
+
+// decode peels the table, and returns the elements it has a count of 1 and
+// -1 of.  It fails with ErrSketchFull if it can't recover all of them.
+func (s *Sketch) decode() (plus, minus [][]byte, err error) {
+	for progress := true; progress; {
+		progress = false
+		for i := range s.Cells {
+			c := &s.Cells[i]
+			if !c.pure() {
+				continue
+			}
+			if len(plus)+len(minus) == len(s.Cells) {
+				return nil, nil, ErrSketchFull
+			}
+			element := append([]byte(nil), c.Key...)
+			if c.Count > 0 {
+				plus = append(plus, element)
+			} else {
+				minus = append(minus, element)
+			}
+			s.insert(element, -c.Count)
+			progress = true
+		}
+	}
+	for i := range s.Cells {
+		if !s.Cells[i].empty() {
+			return nil, nil, ErrSketchFull
+		}
+	}
+	return plus, minus, nil
+}
+
+// sketch builds a table of a shard's entries.
+func (db *Db) sketch(st *State, cells int) *Sketch {
+	s := newSketch(cells)
+	if st != nil {
+		for k, h := range db.entries(st) {
+			s.insert(sketchElement(k, h), 1)
+		}
+	}
+	return s
+}
+
+func (db *Db) serveSketch(w http.ResponseWriter, r *http.Request) {
+	cells, err := strconv.Atoi(r.URL.Query().Get("cells"))
+	if err != nil || cells < 1 || cells > MaxSketchCells {
+		http.Error(w, fmt.Sprintf("cells %q is not from 1 to %d", r.URL.Query().Get("cells"), MaxSketchCells), http.StatusBadRequest)
+		return
+	}
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	st, s, ok := db.serving(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, syncSketch{Statement: s, Handoffs: st.Keys, Sketch: db.sketch(st, cells)})
+}
+
+// SyncSketch brings a shard up to date with peer as SyncShard does, but
+// finds the differences by subtracting the replica's sketch of the shard
+// from the peer's one.  A sketch of cells cells decodes up to about
+// 2*cells/3 differences, counting a changed entry twice; with more it fails
+// with ErrSketchFull, and can be retried with a larger sketch or SyncShard.
+func (db *Db) SyncSketch(client *http.Client, peer string, shard Shard, cells int) error {
+	var remote syncSketch
+	if err := getJSON(client, fmt.Sprintf("%s/replication/sketch?shard=%d&cells=%d", peer, shard, cells), &remote); err != nil {
+		return err
+	}
+	if remote.Sketch == nil {
+		return fmt.Errorf("shard %d: no sketch: %w", shard, ErrMismatch)
+	}
+	width := 9 + db.digester.Hash.Size()
+	db.lock.Lock()
+	local := db.sketch(db.State[shard], len(remote.Sketch.Cells))
+	db.lock.Unlock()
+	if err := local.subtract(remote.Sketch, width); err != nil {
+		return err
+	}
+	// what is left is the replica's entries less the peer's
+	minus, plus, err := local.decode()
+	if err != nil {
+		return fmt.Errorf("shard %d sketch of %d cells: %w", shard, len(remote.Sketch.Cells), err)
+	}
+
+	drops := make(map[entryKey][]byte, len(minus))
+	for _, element := range minus {
+		if len(element) != width {
+			return fmt.Errorf("shard %d sketch: %w", shard, ErrMismatch)
+		}
+		k, h := parseElement(element)
+		drops[k] = h
+	}
+	adds := make([]syncEntry, 0, len(plus))
+	want := make([]entryKey, 0, len(plus))
+	for _, element := range plus {
+		if len(element) != width {
+			return fmt.Errorf("shard %d sketch: %w", shard, ErrMismatch)
+		}
+		k, h := parseElement(element)
+		adds = append(adds, syncEntry{entryKey: k, Digest: h})
+		want = append(want, k)
+	}
+	fetched, err := fetch(client, peer, shard, want)
+	if err != nil {
+		return err
+	}
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return db.merge(shard, remote.Statement, remote.Handoffs, func(t *tx, st *State) error {
+		return db.patch(t, shard, st, drops, adds, fetched)
+	})
+}
@@ -0,0 +1,98 @@
+package shards
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"testing"
+)
+
+func TestSketchDecode(t *testing.T) {
+	element := func(id Id) []byte {
+		return sketchElement(entryKey{entryRecord, id}, DefaultDigester.Record(&DataRecord{Shard: 1, Id: id}))
+	}
+	a, b := newSketch(30), newSketch(30)
+	for id := Id(1); id <= 500; id++ {
+		if id%100 != 7 {
+			a.insert(element(id), 1)
+		}
+		if id%100 != 9 {
+			b.insert(element(id), 1)
+		}
+	}
+	if err := a.subtract(b, len(element(1))); err != nil {
+		t.Fatal(err)
+	}
+	plus, minus, err := a.decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := func(elements [][]byte) []Id {
+		var out []Id
+		for _, e := range elements {
+			k, _ := parseElement(e)
+			out = append(out, k.Id)
+		}
+		sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+		return out
+	}
+	// a has what b doesn't, and the other way around
+	if got := ids(plus); len(got) != 5 || got[0] != 9 || got[4] != 409 {
+		t.Fatalf("plus %v", got)
+	}
+	if got := ids(minus); len(got) != 5 || got[0] != 7 || got[4] != 407 {
+		t.Fatalf("minus %v", got)
+	}
+
+	full := newSketch(6)
+	for id := Id(1); id <= 50; id++ {
+		full.insert(element(id), 1)
+	}
+	if _, _, err := full.decode(); !errors.Is(err, ErrSketchFull) {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestSyncSketch(t *testing.T) {
+	writer := testWriter(t, 1000)
+	peer := serve(t, writer.ReplicationHandler())
+	replica := testReplica()
+	if err := replica.SyncSketch(http.DefaultClient, peer, 1, 3000); err != nil {
+		t.Fatal(err)
+	}
+	sameShard(t, writer, replica, 1)
+
+	// a few differences: removals, inserts and a replaced record
+	for _, id := range []Id{3, 500, 999} {
+		if _, err := writer.Remove(writer.Get(1, id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := writer.Insert(&DataRecord{Shard: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := writer.Get(1, 10)
+	v := *old
+	v.Ints = map[string]int64{"n": -1}
+	if _, err := writer.Replace(&v, writer.Digest(old)); err != nil {
+		t.Fatal(err)
+	}
+
+	// 7 differences don't decode from 6 cells, and nothing changes
+	before := replica.Checksum(1)
+	if err := replica.SyncSketch(http.DefaultClient, peer, 1, 6); !errors.Is(err, ErrSketchFull) {
+		t.Fatalf("got %v", err)
+	}
+	if replica.Checksum(1) != before {
+		t.Fatal("a failed sync changed the replica")
+	}
+	if err := replica.SyncSketch(http.DefaultClient, peer, 1, 30); err != nil {
+		t.Fatal(err)
+	}
+	sameShard(t, writer, replica, 1)
+	if replica.Get(1, 500) != nil || replica.Get(1, 10).Ints["n"] != -1 || replica.Get(1, 1002) == nil {
+		t.Fatal("the replica doesn't have the writer's records")
+	}
+}
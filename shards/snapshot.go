@@ -0,0 +1,448 @@
+package shards
+
+import (
+	"bytes"
+	"crypto"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// A snapshot is a shard's live records, its highest id and a signed
+// statement of its checksum.  Because the checksum only depends on which
+// records are live, the snapshot hashes to exactly what the full event stream
+// did, so the log that led up to it can be thrown away.  It is a sequence of
+// frames: a header, then one canonically encoded record per frame, then the
+// pending removals the same way, then the open offers and the settled ones,
+// then the key handoffs, then the times the records were last touched, for
+// the idle timeout.  The header is encoded like a record, with its own kind
+// and tags:
+//
+//  1 shard, 2 highest id, 3 algorithm, 4 digest hash (crypto.Hash),
+//  5 encoded checksum, 8 number of records, 9 number of touch times,
+//  10 number of pending removals, 11 number of open offers, 12 number of
+//  settled offers, 13 version, 14 number of key handoffs, 15 the encoded
+//  SignedChecksum that vouches for the snapshot, 16 the highest id of the
+//  collected offers that never expire, 17 the co-signatures on the
+//  statement, each a 4 byte length and an encoded CoSignature, for a shard
+//  signed for by a quorum
+//
+// Tags 6 and 7 were a bare signature over the checksum.  It didn't cover the
+// version, so an old snapshot could roll a shard back; they are refused now.
+//
+// The touch times are a single frame of the version, kindTouched, then the
+// 8 byte id and 8 byte time of each, in id order.
+
+const kindSnapshot = byte(3)
+const kindTouched = byte(4)
+
+const (
+	tagSnapshotShard     = byte(1)
+	tagSnapshotHighestId = byte(2)
+	tagSnapshotAlgorithm = byte(3)
+	tagSnapshotDigest    = byte(4)
+	tagSnapshotChecksum  = byte(5)
+	tagSnapshotCount     = byte(8)
+	tagSnapshotTouched   = byte(9)
+	tagSnapshotPending   = byte(10)
+	tagSnapshotOffers    = byte(11)
+	tagSnapshotSettled   = byte(12)
+	tagSnapshotVersion   = byte(13)
+	tagSnapshotHandoffs  = byte(14)
+	tagSnapshotStatement = byte(15)
+	tagSnapshotCollected = byte(16)
+	tagSnapshotCoSigs    = byte(17)
+)
+
+var ErrBadSnapshot = errors.New("snapshot does not verify")
+var ErrNoWAL = errors.New("database has no WAL")
+
+type snapshotHeader struct {
+	Shard     Shard
+	HighestId Id
+	Algorithm Algorithm
+	Digest    crypto.Hash
+	Checksum  []byte
+	Count     int64
+	Touched   int64
+	Pending   int64
+	Offers    int64
+	Settled   int64
+	Version   int64
+	Handoffs  int64
+	Statement []byte
+	Collected Id
+	CoSigs    []CoSignature
+}
+
+func (h *snapshotHeader) MarshalBinary() ([]byte, error) {
+	e := &encBuf{b: []byte{EncodingVersion, kindSnapshot}}
+	e.intField(tagSnapshotShard, int64(h.Shard))
+	e.intField(tagSnapshotHighestId, int64(h.HighestId))
+	e.intField(tagSnapshotAlgorithm, int64(h.Algorithm))
+	e.intField(tagSnapshotDigest, int64(h.Digest))
+	e.bytesField(tagSnapshotChecksum, h.Checksum)
+	e.intField(tagSnapshotCount, h.Count)
+	e.intField(tagSnapshotTouched, h.Touched)
+	e.intField(tagSnapshotPending, h.Pending)
+	e.intField(tagSnapshotOffers, h.Offers)
+	e.intField(tagSnapshotSettled, h.Settled)
+	e.intField(tagSnapshotVersion, h.Version)
+	e.intField(tagSnapshotHandoffs, h.Handoffs)
+	e.bytesField(tagSnapshotStatement, h.Statement)
+	e.intField(tagSnapshotCollected, int64(h.Collected))
+	if len(h.CoSigs) > 0 {
+		e.field(tagSnapshotCoSigs, func(e *encBuf) {
+			for i := range h.CoSigs {
+				e.str(string(canonical(&h.CoSigs[i])))
+			}
+		})
+	}
+	return e.b, nil
+}
+
+func (h *snapshotHeader) UnmarshalBinary(b []byte) error {
+	*h = snapshotHeader{}
+	d := &decBuf{b: b}
+	d.header(kindSnapshot)
+	d.fields(func(tag byte, f *decBuf) bool {
+		switch tag {
+		case tagSnapshotShard:
+			h.Shard = Shard(f.nonZero(tag, f.i64()))
+		case tagSnapshotHighestId:
+			h.HighestId = Id(f.nonZero(tag, f.i64()))
+		case tagSnapshotAlgorithm:
+			h.Algorithm = Algorithm(f.nonZero(tag, f.i64()))
+		case tagSnapshotDigest:
+			h.Digest = crypto.Hash(f.nonZero(tag, f.i64()))
+		case tagSnapshotChecksum:
+			h.Checksum, f.b = f.b, nil
+		case tagSnapshotCount:
+			h.Count = f.nonZero(tag, f.i64())
+		case tagSnapshotTouched:
+			h.Touched = f.nonZero(tag, f.i64())
+		case tagSnapshotPending:
+			h.Pending = f.nonZero(tag, f.i64())
+		case tagSnapshotOffers:
+			h.Offers = f.nonZero(tag, f.i64())
+		case tagSnapshotSettled:
+			h.Settled = f.nonZero(tag, f.i64())
+		case tagSnapshotVersion:
+			h.Version = f.nonZero(tag, f.i64())
+		case tagSnapshotHandoffs:
+			h.Handoffs = f.nonZero(tag, f.i64())
+		case tagSnapshotStatement:
+			h.Statement, f.b = f.b, nil
+		case tagSnapshotCollected:
+			h.Collected = Id(f.nonZero(tag, f.i64()))
+		case tagSnapshotCoSigs:
+			if f.done() {
+				f.fail("field %d is empty", tag)
+			}
+			for !f.done() {
+				var cs CoSignature
+				if err := cs.UnmarshalBinary([]byte(f.str())); err != nil {
+					f.fail("field %d: %v", tag, err)
+				}
+				h.CoSigs = append(h.CoSigs, cs)
+			}
+		default:
+			return false
+		}
+		return true
+	})
+	return d.err
+}
+
+// WriteSnapshot writes the live contents of a shard to w, with a statement
+// of its checksum signed with the shard's key if the database has it, or
+// else the last one it accepted if that is still current.  A shard signed
+// for by a quorum needs an accepted quorum statement of its current version.
+func (db *Db) WriteSnapshot(shard Shard, w io.Writer) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return db.writeSnapshot(shard, w)
+}
+
+func (db *Db) writeSnapshot(shard Shard, w io.Writer) error {
+	st, err := db.state(shard)
+	if err != nil {
+		return err
+	}
+	ids := make([]Id, 0, len(st.Data))
+	for id := range st.Data {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	pending := make([]Id, 0, len(st.Pending))
+	for id := range st.Pending {
+		pending = append(pending, id)
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i] < pending[j] })
+	offers := sortedOffers(st.Offers)
+	settled := sortedOffers(st.Settled)
+
+	h := &snapshotHeader{
+		Shard:     shard,
+		HighestId: st.HighestId,
+		Algorithm: st.Algorithm,
+		Digest:    db.digester.Hash,
+		Checksum:  st.Checksum.Encode(),
+		Count:     int64(len(ids)),
+		Touched:   int64(len(st.Touched)),
+		Pending:   int64(len(st.Pending)),
+		Offers:    int64(len(offers)),
+		Settled:   int64(len(settled)),
+		Version:   st.Version,
+		Handoffs:  int64(len(st.Keys)),
+		Collected: st.Collected,
+	}
+	if _, ok := db.quorums[shard]; ok {
+		q := db.cosigned[shard]
+		if q == nil || q.Statement.Seq != st.Version || !bytes.Equal(q.Statement.Checksum, h.Checksum) {
+			return fmt.Errorf("shard %d has no quorum statement of version %d: %w", shard, st.Version, ErrQuorum)
+		}
+		h.Statement, h.CoSigs = canonical(q.Statement), q.Sigs
+	} else if st.KeyPair != nil {
+		s, err := db.signChecksum(shard)
+		if err != nil {
+			return err
+		}
+		h.Statement = canonical(s)
+	} else if s := db.accepted[shard]; s != nil && s.Seq == st.Version && bytes.Equal(s.Checksum, h.Checksum) {
+		h.Statement = canonical(s)
+	}
+	if err := writeFrame(w, canonical(h)); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := writeFrame(w, canonical(st.Data[id])); err != nil {
+			return err
+		}
+	}
+	for _, id := range pending {
+		if err := writeFrame(w, canonical(st.Pending[id])); err != nil {
+			return err
+		}
+	}
+	for _, o := range append(offers, settled...) {
+		if err := writeFrame(w, canonical(o)); err != nil {
+			return err
+		}
+	}
+	for _, k := range st.Keys {
+		if err := writeFrame(w, canonical(k)); err != nil {
+			return err
+		}
+	}
+	if len(st.Touched) == 0 {
+		return nil
+	}
+	e := &encBuf{b: []byte{EncodingVersion, kindTouched}}
+	for _, id := range ids {
+		if at, ok := st.Touched[id]; ok {
+			e.i64(int64(id))
+			e.i64(at)
+		}
+	}
+	return writeFrame(w, e.b)
+}
+
+func sortedOffers(m map[Id]*Offer) []*Offer {
+	offers := make([]*Offer, 0, len(m))
+	for _, o := range m {
+		offers = append(offers, o)
+	}
+	sort.Slice(offers, func(i, j int) bool { return offers[i].Id < offers[j].Id })
+	return offers
+}
+
+func (st *State) readTouched(r io.Reader, count int64) error {
+	payload, _, err := readFrame(r)
+	if err != nil {
+		return err
+	}
+	d := &decBuf{b: payload}
+	d.header(kindTouched)
+	last := Id(0)
+	for i := int64(0); i < count && d.err == nil; i++ {
+		id := Id(d.i64())
+		at := d.i64()
+		if id <= last || st.Data[id] == nil {
+			d.fail("touch time for %d", id)
+		}
+		last = id
+		st.Touched[id] = at
+	}
+	if d.err == nil && len(d.b) > 0 {
+		d.fail("trailing touch times")
+	}
+	return d.err
+}
+
+// LoadSnapshot replaces a shard with the contents of a snapshot.  The
+// checksum is recomputed from the records, and the snapshot is refused if it
+// doesn't match the one in the snapshot, or if the database has the shard's
+// public key or quorum and the snapshot's statement doesn't verify, isn't for
+// its version or is older than the last statement accepted for the shard.
+func (db *Db) LoadSnapshot(r io.Reader) (Shard, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return db.loadSnapshot(r)
+}
+
+func (db *Db) loadSnapshot(r io.Reader) (Shard, error) {
+	payload, _, err := readFrame(r)
+	if err != nil {
+		return 0, fmt.Errorf("header: %v: %w", err, ErrBadSnapshot)
+	}
+	var h snapshotHeader
+	if err := h.UnmarshalBinary(payload); err != nil {
+		return 0, fmt.Errorf("header: %v: %w", err, ErrBadSnapshot)
+	}
+	if h.Digest != db.digester.Hash {
+		return h.Shard, fmt.Errorf("shard %d digests with %v, not %v: %w", h.Shard, h.Digest, db.digester.Hash, ErrBadSnapshot)
+	}
+	if alg := db.algorithmFor(h.Shard); h.Algorithm != alg {
+		return h.Shard, fmt.Errorf("shard %d is summed with %v, not %v: %w", h.Shard, h.Algorithm, alg, ErrBadSnapshot)
+	}
+
+	st, err := newState(h.Algorithm)
+	if err != nil {
+		return h.Shard, err
+	}
+	st.HighestId = h.HighestId
+	st.Version = h.Version
+	st.Collected = h.Collected
+	for i := int64(0); i < h.Count+h.Pending; i++ {
+		payload, _, err := readFrame(r)
+		if err != nil {
+			return h.Shard, fmt.Errorf("shard %d record %d: %v: %w", h.Shard, i, err, ErrBadSnapshot)
+		}
+		v := &DataRecord{}
+		if err := v.UnmarshalBinary(payload); err != nil {
+			return h.Shard, fmt.Errorf("shard %d record %d: %v: %w", h.Shard, i, err, ErrBadSnapshot)
+		}
+		if v.Shard != h.Shard || v.Id <= 0 || v.Id > h.HighestId || st.Data[v.Id] != nil || st.Pending[v.Id] != nil {
+			return h.Shard, fmt.Errorf("shard %d record %d is out of place: %w", h.Shard, v.Id, ErrBadSnapshot)
+		}
+		if i < h.Count {
+			st.Data[v.Id] = v
+			st.Checksum.Add(db.digester.Record(v))
+		} else {
+			st.Pending[v.Id] = v
+			st.Checksum.Remove(db.digester.Record(v))
+		}
+	}
+	for i := int64(0); i < h.Offers+h.Settled; i++ {
+		payload, _, err := readFrame(r)
+		if err != nil {
+			return h.Shard, fmt.Errorf("shard %d offer %d: %v: %w", h.Shard, i, err, ErrBadSnapshot)
+		}
+		o := &Offer{}
+		if err := o.UnmarshalBinary(payload); err != nil {
+			return h.Shard, fmt.Errorf("shard %d offer %d: %v: %w", h.Shard, i, err, ErrBadSnapshot)
+		}
+		if o.Shard != h.Shard || o.Id <= 0 || st.Offers[o.Id] != nil || st.Settled[o.Id] != nil {
+			return h.Shard, fmt.Errorf("shard %d offer %d is out of place: %w", h.Shard, o.Id, ErrBadSnapshot)
+		}
+		if i < h.Offers {
+			st.Offers[o.Id] = o
+			st.Checksum.Add(db.digester.Offer(o))
+		} else {
+			st.Settled[o.Id] = o
+		}
+	}
+	for i := int64(0); i < h.Handoffs; i++ {
+		payload, _, err := readFrame(r)
+		if err != nil {
+			return h.Shard, fmt.Errorf("shard %d handoff %d: %v: %w", h.Shard, i, err, ErrBadSnapshot)
+		}
+		k := &KeyHandoff{}
+		if err := k.UnmarshalBinary(payload); err != nil || k.Shard != h.Shard {
+			return h.Shard, fmt.Errorf("shard %d handoff %d: %v: %w", h.Shard, i, err, ErrBadSnapshot)
+		}
+		st.Keys = append(st.Keys, k)
+	}
+	if h.Touched > 0 {
+		if err := st.readTouched(r, h.Touched); err != nil {
+			return h.Shard, fmt.Errorf("shard %d touch times: %v: %w", h.Shard, err, ErrBadSnapshot)
+		}
+	}
+	if _, _, err := readFrame(r); err != io.EOF {
+		return h.Shard, fmt.Errorf("shard %d has trailing data: %w", h.Shard, ErrBadSnapshot)
+	}
+	if !bytes.Equal(st.Checksum.Encode(), h.Checksum) {
+		return h.Shard, fmt.Errorf("shard %d checksum does not match its records: %w", h.Shard, ErrBadSnapshot)
+	}
+
+	st.KeyPair = db.keys[h.Shard]
+	var s *SignedChecksum
+	var keys []*chainKey
+	if root, ok := db.pubs[h.Shard]; ok {
+		st.PublicKey = pointOf(root)
+		if keys, err = keyChain(root, st.Keys, true); err != nil {
+			return h.Shard, fmt.Errorf("shard %d key chain: %v: %w", h.Shard, err, ErrBadSnapshot)
+		}
+	}
+	_, quorum := db.quorums[h.Shard]
+	if keys != nil || quorum {
+		if h.Statement == nil {
+			return h.Shard, fmt.Errorf("shard %d has no statement: %w", h.Shard, ErrBadSnapshot)
+		}
+		if s, err = db.vouches(keys, &h); err != nil {
+			return h.Shard, fmt.Errorf("shard %d statement: %v: %w", h.Shard, err, ErrBadSnapshot)
+		}
+	}
+	if old, ok := db.State[h.Shard]; ok {
+		for _, v := range old.Data {
+			db.relink(v, -1)
+		}
+	}
+	for _, v := range st.Data {
+		db.relink(v, 1)
+	}
+	db.State[h.Shard] = st
+	if s != nil {
+		db.accepted[h.Shard] = s
+	}
+	if quorum {
+		db.cosigned[h.Shard] = &QuorumChecksum{Statement: s, Sigs: h.CoSigs}
+	}
+	return h.Shard, nil
+}
+
+// vouches checks that a snapshot is exactly what the statement in its header
+// was signed for, by the shard's chain as of the snapshot or by a quorum of
+// its co-signers, and that the statement isn't older than the last one
+// accepted.
+func (db *Db) vouches(keys []*chainKey, h *snapshotHeader) (*SignedChecksum, error) {
+	s := &SignedChecksum{}
+	if err := s.UnmarshalBinary(h.Statement); err != nil {
+		return nil, err
+	}
+	if s.Shard != h.Shard || s.Seq != h.Version || !bytes.Equal(s.Checksum, h.Checksum) {
+		return nil, ErrMismatch
+	}
+	if _, ok := db.quorums[h.Shard]; ok {
+		return s, db.verifyQuorum(&QuorumChecksum{Statement: s, Sigs: h.CoSigs})
+	}
+	if err := verifySigned(keys, s); err != nil {
+		return nil, err
+	}
+	return s, db.checkFresh(s)
+}
+
+// Compact snapshots a shard into its WAL and deletes the log segments that
+// the snapshot makes redundant.
+func (db *Db) Compact(shard Shard) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.wal == nil {
+		return ErrNoWAL
+	}
+	return db.wal.compact(shard, func(w io.Writer) error {
+		return db.writeSnapshot(shard, w)
+	})
+}
@@ -0,0 +1,93 @@
+package shards
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// snapshots writes a snapshot of shard 1 after each of n inserts.
+func snapshots(t *testing.T, db *Db, n int) [][]byte {
+	t.Helper()
+	var snaps [][]byte
+	for i := 0; i < n; i++ {
+		if _, err := db.Insert(&DataRecord{Shard: 1}); err != nil {
+			t.Fatal(err)
+		}
+		var b bytes.Buffer
+		if err := db.WriteSnapshot(1, &b); err != nil {
+			t.Fatal(err)
+		}
+		snaps = append(snaps, b.Bytes())
+	}
+	return snaps
+}
+
+func TestSnapshotRollback(t *testing.T) {
+	writer, _ := NewDB(1, WithAlgorithm(LtHash16), WithKeyPair(1, testKey))
+	snaps := snapshots(t, writer, 2)
+	v, _ := NewVerifier(WithAlgorithm(LtHash16), WithPublicKey(1, &testKey.PublicKey))
+	if _, err := v.LoadSnapshot(bytes.NewReader(snaps[1])); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.LoadSnapshot(bytes.NewReader(snaps[0])); !errors.Is(err, ErrBadSnapshot) {
+		t.Fatalf("got %v", err)
+	}
+	if v.State[1].Version != 2 {
+		t.Fatalf("rolled back to version %d", v.State[1].Version)
+	}
+
+	// a restarted verifier still refuses it
+	again, _ := NewVerifier(WithAlgorithm(LtHash16), WithPublicKey(1, &testKey.PublicKey), WithAccepted(v.Accepted()...))
+	if _, err := again.LoadSnapshot(bytes.NewReader(snaps[0])); !errors.Is(err, ErrBadSnapshot) {
+		t.Fatalf("after a restart, got %v", err)
+	}
+	if _, err := again.LoadSnapshot(bytes.NewReader(snaps[1])); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSnapshotNeedsStatement(t *testing.T) {
+	writer, _ := NewDB(1, WithAlgorithm(LtHash16), WithKeyPair(1, testKey))
+	snap := snapshots(t, writer, 1)[0]
+	r := bytes.NewReader(snap)
+	payload, _, err := readFrame(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var h snapshotHeader
+	if err := h.UnmarshalBinary(payload); err != nil {
+		t.Fatal(err)
+	}
+	h.Statement = nil
+	var b bytes.Buffer
+	if err := writeFrame(&b, canonical(&h)); err != nil {
+		t.Fatal(err)
+	}
+	b.ReadFrom(r)
+	v, _ := NewVerifier(WithAlgorithm(LtHash16), WithPublicKey(1, &testKey.PublicKey))
+	if _, err := v.LoadSnapshot(&b); !errors.Is(err, ErrBadSnapshot) {
+		t.Fatalf("got %v", err)
+	}
+	if v.State[1] != nil {
+		t.Fatal("the snapshot was loaded")
+	}
+}
+
+func TestSnapshotAlgorithm(t *testing.T) {
+	writer, _ := NewDB(1, WithAlgorithm(LtHash16), WithKeyPair(1, testKey))
+	snap := snapshots(t, writer, 1)[0]
+	for _, opt := range []Option{WithAlgorithm(MuHash3072), WithShardAlgorithm(1, ECMHP256)} {
+		v, _ := NewVerifier(opt, WithPublicKey(1, &testKey.PublicKey))
+		if _, err := v.LoadSnapshot(bytes.NewReader(snap)); !errors.Is(err, ErrBadSnapshot) {
+			t.Fatalf("got %v", err)
+		}
+		if v.State[1] != nil {
+			t.Fatal("the shard was loaded")
+		}
+	}
+	v, _ := NewVerifier(WithAlgorithm(MuHash3072), WithShardAlgorithm(1, LtHash16), WithPublicKey(1, &testKey.PublicKey))
+	if _, err := v.LoadSnapshot(bytes.NewReader(snap)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,59 @@
+package shards
+
+import (
+	"crypto/ecdsa"
+	"math/big"
+)
+
+type Point struct {
+	X *big.Int `json:"x,omitempty"`
+	Y *big.Int `json:"y,omitempty"`
+}
+
+type State struct {
+	Data      map[Id]*DataRecord `json:"data,omitempty"`
+	KeyPair   *ecdsa.PrivateKey  `json:"-"`
+	Algorithm Algorithm          `json:"algorithm,omitempty"`
+	Checksum  MultisetHash       `json:"-"`
+	PublicKey *Point             `json:"publickey,omitempty"`
+	HighestId Id                 `json:"highestid,omitempty"`
+	// Version counts the commands applied to the shard, and is the
+	// sequence number of its signed checksums
+	Version int64 `json:"version,omitempty"`
+	// Touched is when each record was last inserted, renewed or referenced
+	Touched map[Id]int64 `json:"touched,omitempty"`
+	// Pending removals arrived before the records they remove, and
+	// count negatively in the checksum until the inserts cancel them
+	Pending map[Id]*DataRecord `json:"pending,omitempty"`
+	// Offers are open, and count in the checksum until they are accepted
+	// or withdrawn
+	Offers map[Id]*Offer `json:"offers,omitempty"`
+	// Settled offers were accepted, and count for nothing
+	Settled map[Id]*Offer `json:"settled,omitempty"`
+	// Collected is the highest id of the settled offers that never expire
+	// and were collected.  An offer that never expires needs a higher id.
+	Collected Id `json:"collected,omitempty"`
+	// Keys hand the shard from its registered writer key to its current one
+	Keys []*KeyHandoff `json:"keys,omitempty"`
+
+	// buckets are the checksums of the shard's id ranges
+	buckets *bucketTree
+	// indexes are the shard's secondary indexes that have been queried
+	indexes map[indexKey]*index
+}
+
+func newState(alg Algorithm) (*State, error) {
+	ck, err := NewMultisetHash(alg)
+	if err != nil {
+		return nil, err
+	}
+	return &State{
+		Data:      make(map[Id]*DataRecord),
+		Touched:   make(map[Id]int64),
+		Pending:   make(map[Id]*DataRecord),
+		Offers:    make(map[Id]*Offer),
+		Settled:   make(map[Id]*Offer),
+		Algorithm: alg,
+		Checksum:  ck,
+	}, nil
+}
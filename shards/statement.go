@@ -0,0 +1,241 @@
+package shards
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"fmt"
+	"sort"
+)
+
+// A SignedChecksum is a writer's statement that its shard had a checksum at
+// a version.  The version only ever goes up, so a verifier that remembers
+// the last statement it accepted for a shard can refuse an older one, even
+// though its signature is still good: a stale statement can't be replayed to
+// roll a shard back.  It is encoded like a record, with its own kind:
+//
+//  1 shard, 2 algorithm, 3 encoded checksum, 4 seq, 5 time, 6 key id,
+//  7 and 8 the r and s of the signature
+//
+// The signature is over the SHA-256 of the encoding without it.
+
+type SignedChecksum struct {
+	Shard     Shard     `json:"shard,omitempty"`
+	Algorithm Algorithm `json:"algorithm,omitempty"`
+	// Checksum is the encoded multiset hash
+	Checksum []byte `json:"checksum,omitempty"`
+	// Seq is the shard's version when it was signed
+	Seq int64 `json:"seq,omitempty"`
+	// Time is when it was signed, on the writer's clock
+	Time int64 `json:"time,omitempty"`
+	// KeyId is the SHA-256 of the signer's PKIX public key
+	KeyId []byte `json:"keyid,omitempty"`
+	Sig   Point  `json:"sig,omitempty"`
+}
+
+const kindSignedChecksum = byte(8)
+
+// SignedChecksum field tags
+const (
+	tagSignedShard     = byte(1)
+	tagSignedAlgorithm = byte(2)
+	tagSignedChecksum  = byte(3)
+	tagSignedSeq       = byte(4)
+	tagSignedTime      = byte(5)
+	tagSignedKeyId     = byte(6)
+	tagSignedSigR      = byte(7)
+	tagSignedSigS      = byte(8)
+)
+
+// MarshalBinary returns the canonical encoding of the statement.
+func (s *SignedChecksum) MarshalBinary() ([]byte, error) {
+	e := &encBuf{b: []byte{EncodingVersion, kindSignedChecksum}}
+	e.intField(tagSignedShard, int64(s.Shard))
+	e.intField(tagSignedAlgorithm, int64(s.Algorithm))
+	e.bytesField(tagSignedChecksum, s.Checksum)
+	e.intField(tagSignedSeq, s.Seq)
+	e.intField(tagSignedTime, s.Time)
+	e.bytesField(tagSignedKeyId, s.KeyId)
+	e.sigFields(tagSignedSigR, s.Sig)
+	return e.b, nil
+}
+
+// UnmarshalBinary parses a canonical encoding of a statement.
+func (s *SignedChecksum) UnmarshalBinary(b []byte) error {
+	*s = SignedChecksum{}
+	d := &decBuf{b: b}
+	d.header(kindSignedChecksum)
+	d.fields(func(tag byte, f *decBuf) bool {
+		switch tag {
+		case tagSignedShard:
+			s.Shard = Shard(f.nonZero(tag, f.i64()))
+		case tagSignedAlgorithm:
+			s.Algorithm = Algorithm(f.nonZero(tag, f.i64()))
+		case tagSignedChecksum:
+			s.Checksum, f.b = f.b, nil
+		case tagSignedSeq:
+			s.Seq = f.nonZero(tag, f.i64())
+		case tagSignedTime:
+			s.Time = f.nonZero(tag, f.i64())
+		case tagSignedKeyId:
+			s.KeyId, f.b = f.b, nil
+		case tagSignedSigR:
+			s.Sig.X = f.bigInt(tag)
+		case tagSignedSigS:
+			s.Sig.Y = f.bigInt(tag)
+		default:
+			return false
+		}
+		return true
+	})
+	return d.err
+}
+
+func (s *SignedChecksum) message() []byte {
+	unsigned := *s
+	unsigned.Sig = Point{}
+	h := sha256.Sum256(canonical(&unsigned))
+	return h[:]
+}
+
+// String renders the statement's checksum as "shard:algorithm:hex".
+func (s *SignedChecksum) String() string {
+	ck, err := DecodeMultisetHash(s.Checksum)
+	if err != nil {
+		return fmt.Sprintf("%d:%v:", s.Shard, s.Algorithm)
+	}
+	return FormatChecksum(s.Shard, ck)
+}
+
+// KeyId identifies a public key by the SHA-256 of its PKIX encoding.
+func KeyId(pub *ecdsa.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.Sum256(der)
+	return h[:], nil
+}
+
+// SignChecksum states the current checksum and version of a shard, signed
+// with its key.
+func (db *Db) SignChecksum(shard Shard) (*SignedChecksum, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return db.signChecksum(shard)
+}
+
+func (db *Db) signChecksum(shard Shard) (*SignedChecksum, error) {
+	kp, err := db.signer(shard)
+	if err != nil {
+		return nil, err
+	}
+	st := db.State[shard]
+	id, err := KeyId(&kp.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	s := &SignedChecksum{
+		Shard:     shard,
+		Algorithm: st.Algorithm,
+		Checksum:  st.Checksum.Encode(),
+		Seq:       st.Version,
+		Time:      db.clock.Now(),
+		KeyId:     id,
+	}
+	r, sig, err := ecdsa.Sign(rand.Reader, kp, s.message())
+	if err != nil {
+		return nil, err
+	}
+	s.Sig = Point{X: r, Y: sig}
+	return s, nil
+}
+
+// VerifyChecksum checks a statement against the key of its shard's chain
+// that signed for its version, and accepts it unless it is older than the
+// last statement accepted for the shard, which fails with ErrStale.  A
+// statement for the same version must have the same checksum.
+func (db *Db) VerifyChecksum(s *SignedChecksum) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if err := db.verifyChecksum(s); err != nil {
+		return err
+	}
+	db.accepted[s.Shard] = s
+	return nil
+}
+
+func (db *Db) verifyChecksum(s *SignedChecksum) error {
+	if _, ok := db.quorums[s.Shard]; ok {
+		return fmt.Errorf("shard %d is signed for by a quorum: %w", s.Shard, ErrQuorum)
+	}
+	keys, err := db.chain(s.Shard)
+	if err != nil {
+		return err
+	}
+	if err := verifySigned(keys, s); err != nil {
+		return err
+	}
+	return db.checkFresh(s)
+}
+
+// verifySigned checks a statement's signature against the key of a chain
+// that signed for its version.
+func verifySigned(keys []*chainKey, s *SignedChecksum) error {
+	var key *chainKey
+	for _, k := range keys {
+		if id := sha256.Sum256(k.der); bytes.Equal(id[:], s.KeyId) {
+			key = k
+		}
+	}
+	if key == nil || !key.signsFor(s.Seq) {
+		return fmt.Errorf("shard %d statement %d key %x: %w", s.Shard, s.Seq, s.KeyId, ErrWrongKey)
+	}
+	if s.Sig.X == nil || s.Sig.Y == nil || !ecdsa.Verify(key.pub, s.message(), s.Sig.X, s.Sig.Y) {
+		return fmt.Errorf("shard %d statement %d: %w", s.Shard, s.Seq, ErrBadSignature)
+	}
+	return nil
+}
+
+// checkFresh refuses a statement older than the last one accepted.
+func (db *Db) checkFresh(s *SignedChecksum) error {
+	if last, ok := db.accepted[s.Shard]; ok {
+		if s.Seq < last.Seq || (s.Seq == last.Seq && !bytes.Equal(s.Checksum, last.Checksum)) {
+			return fmt.Errorf("shard %d statement %d, after %d: %w", s.Shard, s.Seq, last.Seq, ErrStale)
+		}
+	}
+	return nil
+}
+
+// LastChecksum returns the last statement accepted for a shard, or nil.
+func (db *Db) LastChecksum(shard Shard) *SignedChecksum {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return db.accepted[shard]
+}
+
+// Accepted returns the last statement accepted for each shard, in shard
+// order, to be restored with WithAccepted.
+func (db *Db) Accepted() []*SignedChecksum {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	accepted := make([]*SignedChecksum, 0, len(db.accepted))
+	for _, s := range db.accepted {
+		accepted = append(accepted, s)
+	}
+	sort.Slice(accepted, func(i, j int) bool { return accepted[i].Shard < accepted[j].Shard })
+	return accepted
+}
+
+// WithAccepted restores the statements a previous run had accepted, so that
+// a restart doesn't let an older statement or snapshot through.  They were
+// verified when they were accepted, and aren't checked again.
+func WithAccepted(accepted ...*SignedChecksum) Option {
+	return func(db *Db) {
+		for _, s := range accepted {
+			db.accepted[s.Shard] = s
+		}
+	}
+}
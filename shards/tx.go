@@ -0,0 +1,145 @@
+package shards
+
+// tx journals the changes a command makes to the database, so that they can
+// be rolled back if the command can't be logged.  Every change to a State
+// goes through one of the primitives below, which record their own inverse.
+type tx struct {
+	undo []func()
+	// replay trusts commands from the log, which were checked when
+	// they were first applied
+	replay bool
+	// touches are the ActionTouch commands for records in other shards
+	// that inserts referred to
+	touches []Command
+	// cascade is every record that the cascading remove being applied
+	// removes, which may refer to one another in a cycle
+	cascade map[Reference]bool
+}
+
+func (t *tx) onUndo(f func()) {
+	t.undo = append(t.undo, f)
+}
+
+// rollback undoes everything, newest first.
+func (t *tx) rollback() {
+	for i := len(t.undo) - 1; i >= 0; i-- {
+		t.undo[i]()
+	}
+	t.undo = nil
+}
+
+func (st *State) setHighest(t *tx, id Id) {
+	old := st.HighestId
+	st.HighestId = id
+	t.onUndo(func() { st.HighestId = old })
+}
+
+// bump moves the shard to its next version.
+func (st *State) bump(t *tx) {
+	st.Version++
+	t.onUndo(func() { st.Version-- })
+}
+
+// put adds a record, whose digest is h, to the shard.
+func (st *State) put(t *tx, v *DataRecord, h []byte) {
+	st.invalidate(v.Id)
+	st.Data[v.Id] = v
+	st.index(v, true)
+	st.Checksum.Add(h)
+	t.onUndo(func() {
+		st.Checksum.Remove(h)
+		st.index(v, false)
+		delete(st.Data, v.Id)
+	})
+}
+
+// del removes a record, whose digest is h, from the shard.
+func (st *State) del(t *tx, v *DataRecord, h []byte) {
+	st.invalidate(v.Id)
+	touched, wasTouched := st.Touched[v.Id]
+	delete(st.Data, v.Id)
+	delete(st.Touched, v.Id)
+	st.index(v, false)
+	st.Checksum.Remove(h)
+	t.onUndo(func() {
+		st.Checksum.Add(h)
+		st.Data[v.Id] = v
+		st.index(v, true)
+		if wasTouched {
+			st.Touched[v.Id] = touched
+		}
+	})
+}
+
+// touch records that a record was used at time at, for the idle timeout.
+func (st *State) touch(t *tx, id Id, at int64) {
+	old, ok := st.Touched[id]
+	if ok && old >= at {
+		return
+	}
+	st.Touched[id] = at
+	t.onUndo(func() {
+		if ok {
+			st.Touched[id] = old
+		} else {
+			delete(st.Touched, id)
+		}
+	})
+}
+
+// pend records the removal of a record, whose digest is h, before its insert.
+func (st *State) pend(t *tx, v *DataRecord, h []byte) {
+	st.invalidate(v.Id)
+	st.Pending[v.Id] = v
+	st.Checksum.Remove(h)
+	t.onUndo(func() {
+		st.Checksum.Add(h)
+		delete(st.Pending, v.Id)
+	})
+}
+
+// unpend cancels a pending removal against the insert it was waiting for.
+func (st *State) unpend(t *tx, v *DataRecord, h []byte) {
+	st.invalidate(v.Id)
+	delete(st.Pending, v.Id)
+	st.Checksum.Add(h)
+	t.onUndo(func() {
+		st.Checksum.Remove(h)
+		st.Pending[v.Id] = v
+	})
+}
+
+// addHandoff extends the shard's chain of writer keys.
+func (st *State) addHandoff(t *tx, h *KeyHandoff) {
+	st.Keys = append(st.Keys, h)
+	t.onUndo(func() { st.Keys = st.Keys[:len(st.Keys)-1] })
+}
+
+// putOffer opens an offer, whose digest is h.
+func (st *State) putOffer(t *tx, o *Offer, h []byte) {
+	st.invalidate(o.Id)
+	st.Offers[o.Id] = o
+	st.Checksum.Add(h)
+	t.onUndo(func() {
+		st.Checksum.Remove(h)
+		delete(st.Offers, o.Id)
+	})
+}
+
+// delOffer closes an open offer, whose digest is h.
+func (st *State) delOffer(t *tx, o *Offer, h []byte) {
+	st.invalidate(o.Id)
+	delete(st.Offers, o.Id)
+	st.Checksum.Remove(h)
+	t.onUndo(func() {
+		st.Checksum.Add(h)
+		st.Offers[o.Id] = o
+	})
+}
+
+// settle closes an offer that was accepted, and keeps it as settled.
+func (st *State) settle(t *tx, o *Offer, h []byte) {
+	st.delOffer(t, o, h)
+	st.Settled[o.Id] = o
+	t.onUndo(func() { delete(st.Settled, o.Id) })
+}
@@ -0,0 +1,627 @@
+package shards
+
+import (
+	"bufio"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// WAL is a write-ahead log of the commands applied to each shard.  Every shard
+// has its own directory of append-only segment files, and a command is only
+// acknowledged by Do once its frame has been fsync'd.  Replaying the log in
+// order rebuilds each shard exactly, because commands are logged after they
+// are applied, with the ids that were assigned to them.
+//
+// A batch that touches more than one shard is logged in each of their logs
+// under a random id, and only committed once its id is appended to
+// dir/commits.log.  A crash or a failed write can leave it in some of the
+// logs and not others, so replay skips the ones that were never committed.
+type WAL struct {
+	dir   string
+	lock  sync.Mutex
+	files map[Shard]*os.File
+	// commits is the open commit log, and committed the ids in it when
+	// the log was replayed
+	commits   *os.File
+	committed map[string]bool
+}
+
+// A logged batch is a cross-shard batch in the log of each of its shards.
+const kindLoggedBatch = byte(11)
+
+// Logged batch field tags
+const (
+	tagLoggedBatchId    = byte(1)
+	tagLoggedBatchBatch = byte(2)
+)
+
+// batchIdSize is the size of the random id of a logged batch.
+const batchIdSize = 16
+
+var ErrCorruptLog = errors.New("log is corrupt")
+
+// OpenWAL opens (or creates) a log in dir.  Replay it before appending.
+func OpenWAL(dir string) (*WAL, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &WAL{
+		dir:   dir,
+		files: make(map[Shard]*os.File),
+	}, nil
+}
+
+func (w *WAL) commitsName() string {
+	return filepath.Join(w.dir, "commits.log")
+}
+
+func (w *WAL) shardDir(shard Shard) string {
+	return filepath.Join(w.dir, strconv.FormatInt(int64(shard), 10))
+}
+
+func segmentName(seq uint64) string {
+	return fmt.Sprintf("%020d.log", seq)
+}
+
+func snapshotName(seq uint64) string {
+	return fmt.Sprintf("%020d.snap", seq)
+}
+
+// list returns the sequence numbers of a shard's files named by name, in order.
+func (w *WAL) list(shard Shard, name func(uint64) string) ([]uint64, error) {
+	infos, err := ioutil.ReadDir(w.shardDir(shard))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var seqs []uint64
+	for _, info := range infos {
+		n := info.Name()
+		if i := strings.IndexByte(n, '.'); i > 0 {
+			seq, err := strconv.ParseUint(n[:i], 10, 64)
+			if err == nil && n == name(seq) {
+				seqs = append(seqs, seq)
+			}
+		}
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+// segments lists the segment numbers of a shard in order.
+func (w *WAL) segments(shard Shard) ([]uint64, error) {
+	return w.list(shard, segmentName)
+}
+
+// snapshots lists the snapshot numbers of a shard in order.  A snapshot
+// numbered n covers everything logged before segment n.
+func (w *WAL) snapshots(shard Shard) ([]uint64, error) {
+	return w.list(shard, snapshotName)
+}
+
+// shards lists the shards that have a log directory.
+func (w *WAL) shards() ([]Shard, error) {
+	infos, err := ioutil.ReadDir(w.dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []Shard
+	for _, info := range infos {
+		n, err := strconv.ParseInt(info.Name(), 10, 64)
+		if err == nil && info.IsDir() && strconv.FormatInt(n, 10) == info.Name() {
+			ids = append(ids, Shard(n))
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// file returns the open tail segment of a shard.
+func (w *WAL) file(shard Shard) (*os.File, error) {
+	if f, ok := w.files[shard]; ok {
+		return f, nil
+	}
+	dir := w.shardDir(shard)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	seqs, err := w.segments(shard)
+	if err != nil {
+		return nil, err
+	}
+	seq := uint64(0)
+	if len(seqs) > 0 {
+		seq = seqs[len(seqs)-1]
+	}
+	f, err := os.OpenFile(filepath.Join(dir, segmentName(seq)), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syncDir(dir); err != nil {
+		f.Close()
+		return nil, err
+	}
+	w.files[shard] = f
+	return f, nil
+}
+
+// Append durably logs a command against its shard.
+func (w *WAL) Append(cmd Command) error {
+	shard, ok := cmd.shard()
+	if !ok {
+		return ErrNoRecord
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	_, err := w.write([]Shard{shard}, canonical(&cmd))
+	return err
+}
+
+// AppendBatch durably logs a batch as one frame in the log of every shard
+// that it touches.  Replaying a shard applies its part of the batch.  A batch
+// across shards is only logged once it is committed, so replay either applies
+// it to all of them or to none.
+func (w *WAL) AppendBatch(b Batch) error {
+	return w.appendBatch(b, b.shards())
+}
+
+func (w *WAL) appendBatch(b Batch, shards []Shard) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if len(shards) < 2 {
+		_, err := w.write(shards, canonical(&b))
+		return err
+	}
+	id := make([]byte, batchIdSize)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	e := &encBuf{b: []byte{EncodingVersion, kindLoggedBatch}}
+	e.bytesField(tagLoggedBatchId, id)
+	e.bytesField(tagLoggedBatchBatch, canonical(&b))
+	written, err := w.write(shards, e.b)
+	if err != nil {
+		return err
+	}
+	if err := w.commit(id); err != nil {
+		unwrite(written)
+		return err
+	}
+	return nil
+}
+
+// frameAt is where a frame was appended to a file.
+type frameAt struct {
+	f   *os.File
+	off int64
+}
+
+// appendFrame durably appends a frame to f.  If it can't, it truncates
+// whatever part of the frame it wrote.
+func appendFrame(f *os.File, payload []byte) (frameAt, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return frameAt{}, err
+	}
+	at := frameAt{f: f, off: info.Size()}
+	if err = writeFrame(f, payload); err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		unwrite([]frameAt{at})
+		return frameAt{}, err
+	}
+	return at, nil
+}
+
+// unwrite truncates frames away, as far as it can.  A logged batch that
+// can't be truncated is never committed, so replay skips it anyway.
+func unwrite(written []frameAt) {
+	for _, at := range written {
+		if at.f.Truncate(at.off) == nil {
+			at.f.Sync()
+		}
+	}
+}
+
+// write durably appends a frame to the log of every shard, or else to none
+// of them.
+func (w *WAL) write(shards []Shard, payload []byte) ([]frameAt, error) {
+	var written []frameAt
+	for _, shard := range shards {
+		f, err := w.file(shard)
+		if err != nil {
+			unwrite(written)
+			return nil, err
+		}
+		at, err := appendFrame(f, payload)
+		if err != nil {
+			unwrite(written)
+			return nil, err
+		}
+		written = append(written, at)
+	}
+	return written, nil
+}
+
+// commit durably appends the id of a logged batch to the commit log.
+func (w *WAL) commit(id []byte) error {
+	if w.commits == nil {
+		f, err := os.OpenFile(w.commitsName(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		if err := syncDir(w.dir); err != nil {
+			f.Close()
+			return err
+		}
+		w.commits = f
+	}
+	_, err := appendFrame(w.commits, id)
+	return err
+}
+
+// Close the open segments.
+func (w *WAL) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	var err error
+	for shard, f := range w.files {
+		if e := f.Close(); e != nil && err == nil {
+			err = e
+		}
+		delete(w.files, shard)
+	}
+	if w.commits != nil {
+		if e := w.commits.Close(); e != nil && err == nil {
+			err = e
+		}
+		w.commits = nil
+	}
+	return err
+}
+
+// replay rebuilds every shard: load is called with the shard's latest
+// snapshot, if it has one, then f with every command or batch logged since,
+// in order.  Of a batch, f only gets the commands for the shard being
+// replayed, and a batch across shards only if it was committed.
+// A torn frame at the end of a shard's last segment is a write that never
+// completed, so it is truncated away.  Anywhere else it is corruption.
+func (w *WAL) replay(load func(shard Shard, r io.Reader) error, f func(cmds []Command) error) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if err := w.readCommits(); err != nil {
+		return fmt.Errorf("commits: %w", err)
+	}
+	ids, err := w.shards()
+	if err != nil {
+		return err
+	}
+	// seen are the committed batches still in the logs
+	seen := make(map[string]bool)
+	for _, shard := range ids {
+		snaps, err := w.snapshots(shard)
+		if err != nil {
+			return err
+		}
+		from := uint64(0)
+		if len(snaps) > 0 {
+			from = snaps[len(snaps)-1]
+			if err := w.loadSnapshot(shard, from, load); err != nil {
+				return fmt.Errorf("shard %d snapshot %d: %w", shard, from, err)
+			}
+		}
+		seqs, err := w.segments(shard)
+		if err != nil {
+			return err
+		}
+		for i, seq := range seqs {
+			if seq < from {
+				continue
+			}
+			last := i == len(seqs)-1
+			name := filepath.Join(w.shardDir(shard), segmentName(seq))
+			if err := w.replaySegment(shard, name, last, seen, f); err != nil {
+				return fmt.Errorf("shard %d segment %d: %w", shard, seq, err)
+			}
+		}
+	}
+	return w.pruneCommits(seen)
+}
+
+// readCommits reads the ids of the committed batches.  Like the tail of a
+// shard's log, a torn frame at the end of the commit log is truncated away.
+func (w *WAL) readCommits() error {
+	w.committed = make(map[string]bool)
+	file, err := os.Open(w.commitsName())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	r := bufio.NewReader(file)
+	good := int64(0)
+	for {
+		id, n, err := readFrame(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err == errTornFrame {
+			if _, e := r.Peek(1); e != io.EOF {
+				return fmt.Errorf("torn frame at offset %d: %w", good, ErrCorruptLog)
+			}
+			return w.truncate(w.commitsName(), good)
+		}
+		if len(id) != batchIdSize {
+			return fmt.Errorf("offset %d: batch id of %d bytes: %w", good, len(id), ErrCorruptLog)
+		}
+		w.committed[string(id)] = true
+		good += n
+	}
+}
+
+// pruneCommits rewrites the commit log with just the batches that are still
+// in some shard's log, once compaction has dropped the others.
+func (w *WAL) pruneCommits(seen map[string]bool) error {
+	if len(seen) == len(w.committed) {
+		return nil
+	}
+	if w.commits != nil {
+		w.commits.Close()
+		w.commits = nil
+	}
+	ids := make([]string, 0, len(seen))
+	for id := range seen {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	tmp := w.commitsName() + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(f)
+	for _, id := range ids {
+		if err == nil {
+			err = writeFrame(bw, []byte(id))
+		}
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp, w.commitsName())
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	w.committed = seen
+	return syncDir(w.dir)
+}
+
+func (w *WAL) loadSnapshot(shard Shard, seq uint64, load func(shard Shard, r io.Reader) error) error {
+	f, err := os.Open(filepath.Join(w.shardDir(shard), snapshotName(seq)))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return load(shard, bufio.NewReader(f))
+}
+
+// compact starts a new segment for a shard, and writes a snapshot numbered
+// after it with write.  Once the snapshot is safely in place, the segments and
+// snapshots it supersedes are deleted.
+func (w *WAL) compact(shard Shard, write func(w io.Writer) error) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	seq, err := w.roll(shard)
+	if err != nil {
+		return err
+	}
+	dir := w.shardDir(shard)
+	tmp := filepath.Join(dir, snapshotName(seq)+".tmp")
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(f)
+	err = write(bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, snapshotName(seq))); err != nil {
+		return err
+	}
+	if err := syncDir(dir); err != nil {
+		return err
+	}
+	return w.prune(shard, seq)
+}
+
+// roll closes the tail segment of a shard and starts the next one.
+func (w *WAL) roll(shard Shard) (uint64, error) {
+	if _, err := w.file(shard); err != nil {
+		return 0, err
+	}
+	w.files[shard].Close()
+	delete(w.files, shard)
+	seqs, err := w.segments(shard)
+	if err != nil {
+		return 0, err
+	}
+	seq := seqs[len(seqs)-1] + 1
+	dir := w.shardDir(shard)
+	f, err := os.OpenFile(filepath.Join(dir, segmentName(seq)), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return 0, err
+	}
+	if err := syncDir(dir); err != nil {
+		f.Close()
+		return 0, err
+	}
+	w.files[shard] = f
+	return seq, nil
+}
+
+// prune deletes the segments and snapshots of a shard from before seq.
+func (w *WAL) prune(shard Shard, seq uint64) error {
+	for _, name := range []func(uint64) string{segmentName, snapshotName} {
+		seqs, err := w.list(shard, name)
+		if err != nil {
+			return err
+		}
+		for _, s := range seqs {
+			if s < seq {
+				if err := os.Remove(filepath.Join(w.shardDir(shard), name(s))); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return syncDir(w.shardDir(shard))
+}
+
+func (w *WAL) replaySegment(shard Shard, name string, last bool, seen map[string]bool, f func(cmds []Command) error) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	r := bufio.NewReader(file)
+	good := int64(0)
+	for {
+		payload, n, err := readFrame(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err == errTornFrame {
+			// only the tail can be torn, and only if nothing follows it
+			if _, e := r.Peek(1); !last || e != io.EOF {
+				return fmt.Errorf("torn frame at offset %d: %w", good, ErrCorruptLog)
+			}
+			return w.truncate(name, good)
+		}
+		cmds, id, err := decodeEntry(shard, payload)
+		if err != nil {
+			return fmt.Errorf("offset %d: %v: %w", good, err, ErrCorruptLog)
+		}
+		if id != "" {
+			if !w.committed[id] {
+				// a failed write or a crash left it uncommitted
+				good += n
+				continue
+			}
+			seen[id] = true
+		}
+		if err := f(cmds); err != nil {
+			return fmt.Errorf("offset %d: %w", good, err)
+		}
+		good += n
+	}
+}
+
+// decodeEntry decodes a command or batch, keeping the commands for shard.
+// For a logged batch, it also returns the batch's id.
+func decodeEntry(shard Shard, payload []byte) ([]Command, string, error) {
+	if len(payload) > 1 && payload[1] == kindBatch {
+		cmds, err := decodeBatch(shard, payload)
+		return cmds, "", err
+	}
+	if len(payload) > 1 && payload[1] == kindLoggedBatch {
+		var id, batch []byte
+		d := &decBuf{b: payload}
+		d.header(kindLoggedBatch)
+		d.fields(func(tag byte, f *decBuf) bool {
+			switch tag {
+			case tagLoggedBatchId:
+				if id, f.b = f.b, nil; len(id) != batchIdSize {
+					f.fail("batch id of %d bytes", len(id))
+				}
+			case tagLoggedBatchBatch:
+				batch, f.b = f.b, nil
+			default:
+				return false
+			}
+			return true
+		})
+		if id == nil || batch == nil {
+			d.fail("logged batch without an id or batch")
+		}
+		if d.err != nil {
+			return nil, "", d.err
+		}
+		cmds, err := decodeBatch(shard, batch)
+		return cmds, string(id), err
+	}
+	var cmd Command
+	if err := cmd.UnmarshalBinary(payload); err != nil {
+		return nil, "", err
+	}
+	return []Command{cmd}, "", nil
+}
+
+// decodeBatch decodes a batch, keeping the commands for shard.
+func decodeBatch(shard Shard, payload []byte) ([]Command, error) {
+	var b Batch
+	if err := b.UnmarshalBinary(payload); err != nil {
+		return nil, err
+	}
+	var cmds []Command
+	for _, cmd := range b.Commands {
+		if s, ok := cmd.shard(); ok && s == shard {
+			cmds = append(cmds, cmd)
+		}
+	}
+	return cmds, nil
+}
+
+func (w *WAL) truncate(name string, size int64) error {
+	f, err := os.OpenFile(name, os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Truncate(size); err != nil {
+		return err
+	}
+	return f.Sync()
+}
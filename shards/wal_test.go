@@ -0,0 +1,212 @@
+package shards
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testKey is shard 1's writer key, so that a reopened database can verify
+// its own snapshots.
+var testKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+// testDb opens a database on a WAL in dir, replaying whatever is there.
+func testDb(t *testing.T, dir string, opts ...Option) (*Db, *WAL) {
+	t.Helper()
+	wal, err := OpenWAL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewDB(1, append([]Option{WithAlgorithm(LtHash16), WithWAL(wal), WithKeyPair(1, testKey)}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Replay(wal); err != nil {
+		t.Fatal(err)
+	}
+	return db, wal
+}
+
+// sameShard fails unless two databases hold the same shard.
+func sameShard(t *testing.T, a, b *Db, shard Shard) {
+	t.Helper()
+	if a.Checksum(shard) != b.Checksum(shard) {
+		t.Fatalf("shard %d checksum %s, expected %s", shard, b.Checksum(shard), a.Checksum(shard))
+	}
+	sa, sb := a.State[shard], b.State[shard]
+	if sa == nil || sb == nil {
+		return
+	}
+	if len(sa.Data) != len(sb.Data) || sa.HighestId != sb.HighestId || sa.Version != sb.Version {
+		t.Fatalf("shard %d has %d records, highest %d, version %d; expected %d, %d, %d",
+			shard, len(sb.Data), sb.HighestId, sb.Version, len(sa.Data), sa.HighestId, sa.Version)
+	}
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "shards")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestWALReplay(t *testing.T) {
+	dir := tempDir(t)
+	db, wal := testDb(t, dir)
+	for i := 0; i < 10; i++ {
+		if _, err := db.Insert(&DataRecord{Shard: 1, Ints: map[string]int64{"i": int64(i)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Remove(db.Get(1, 3)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Insert(&DataRecord{Shard: 1, Id: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Insert(&DataRecord{Shard: 1, Id: 3}); !errors.Is(err, ErrExists) {
+		t.Fatalf("got %v", err)
+	}
+	wal.Close()
+
+	again, wal := testDb(t, dir)
+	defer wal.Close()
+	sameShard(t, db, again, 1)
+	if v := again.Get(1, 10); v == nil || v.Ints["i"] != 9 {
+		t.Fatalf("record 10 is %+v", v)
+	}
+	// appends after a replay go on the end of the log
+	if _, err := again.Insert(&DataRecord{Shard: 1}); err != nil {
+		t.Fatal(err)
+	}
+	wal.Close()
+	third, wal := testDb(t, dir)
+	defer wal.Close()
+	sameShard(t, again, third, 1)
+}
+
+func TestWALTornTail(t *testing.T) {
+	dir := tempDir(t)
+	db, wal := testDb(t, dir)
+	for i := 0; i < 3; i++ {
+		db.Insert(&DataRecord{Shard: 1})
+	}
+	wal.Close()
+	name := filepath.Join(dir, "1", segmentName(0))
+	info, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	good := info.Size()
+	// a write that was cut short by a crash
+	f, _ := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0600)
+	f.Write([]byte{0, 0, 0, 50, 1, 2, 3, 4, 1, 2})
+	f.Close()
+
+	again, wal := testDb(t, dir)
+	sameShard(t, db, again, 1)
+	if info, _ := os.Stat(name); info.Size() != good {
+		t.Fatalf("torn tail left %d bytes, expected %d", info.Size(), good)
+	}
+	if _, err := again.Insert(&DataRecord{Shard: 1}); err != nil {
+		t.Fatal(err)
+	}
+	wal.Close()
+	third, wal := testDb(t, dir)
+	wal.Close()
+	if third.Get(1, 4) == nil {
+		t.Fatal("the insert after truncation was lost")
+	}
+}
+
+func TestWALRotation(t *testing.T) {
+	dir := tempDir(t)
+	db, wal := testDb(t, dir)
+	for i := 0; i < 5; i++ {
+		db.Insert(&DataRecord{Shard: 1})
+	}
+	if err := db.Compact(1); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		db.Insert(&DataRecord{Shard: 1})
+	}
+	db.Remove(db.Get(1, 2))
+	if err := db.Compact(1); err != nil {
+		t.Fatal(err)
+	}
+	db.Insert(&DataRecord{Shard: 1})
+	wal.Close()
+
+	segs, _ := wal.segments(1)
+	snaps, _ := wal.snapshots(1)
+	if len(segs) != 1 || segs[0] != 2 || len(snaps) != 1 || snaps[0] != 2 {
+		t.Fatalf("segments %v and snapshots %v, expected just 2", segs, snaps)
+	}
+	again, wal := testDb(t, dir)
+	defer wal.Close()
+	sameShard(t, db, again, 1)
+}
+
+func TestNegativeIdsRefused(t *testing.T) {
+	dir := tempDir(t)
+	db, wal := testDb(t, dir)
+	if _, err := db.Insert(&DataRecord{Shard: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Insert(&DataRecord{Shard: 1, Id: -5}); !errors.Is(err, ErrNoRecord) {
+		t.Fatalf("got %v", err)
+	}
+	b := Batch{Commands: []Command{{Record: &DataRecord{Shard: 1}}, {Record: &DataRecord{Shard: 1, Id: -1}}}}
+	if _, err := db.DoBatch(b); !errors.Is(err, ErrNoRecord) {
+		t.Fatalf("in a batch, got %v", err)
+	}
+	o, _ := testOffer(t, 1, 0)
+	o.Commands[0].Record.Id = -3
+	if err := db.Offer(o); !errors.Is(err, ErrNoRecord) {
+		t.Fatalf("in an offer, got %v", err)
+	}
+	o.Id = -1
+	if err := db.Offer(o); !errors.Is(err, ErrNoRecord) {
+		t.Fatalf("an offer with a negative id, got %v", err)
+	}
+	if err := db.Compact(1); err != nil {
+		t.Fatal(err)
+	}
+	wal.Close()
+
+	// the snapshot only holds what it can load
+	again, wal := testDb(t, dir)
+	defer wal.Close()
+	sameShard(t, db, again, 1)
+	if len(again.State[1].Data) != 1 {
+		t.Fatalf("%d records after a replay", len(again.State[1].Data))
+	}
+}
+
+func TestWALCorruptMiddle(t *testing.T) {
+	dir := tempDir(t)
+	db, wal := testDb(t, dir)
+	for i := 0; i < 3; i++ {
+		db.Insert(&DataRecord{Shard: 1})
+	}
+	wal.Close()
+	name := filepath.Join(dir, "1", segmentName(0))
+	b, _ := ioutil.ReadFile(name)
+	b[frameHeader+2] ^= 1
+	ioutil.WriteFile(name, b, 0600)
+
+	wal, _ = OpenWAL(dir)
+	defer wal.Close()
+	again, _ := NewDB(1, WithAlgorithm(LtHash16), WithWAL(wal))
+	if err := again.Replay(wal); !errors.Is(err, ErrCorruptLog) {
+		t.Fatalf("got %v", err)
+	}
+}
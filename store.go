@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/rfielding/bc/shards"
+)
+
+// A store is a directory holding a database on disk:
+//
+//  wal/            the write-ahead log and snapshots of every shard
+//  keys/N.pem      the private key of each shard N that the store writes
+//  pubkeys.pem     the public keys it trusts, as shards.ExportPublicKeys
+//  accepted.json   the last statement it accepted for each shard, so that
+//                  an older one is still refused after a restart
+//
+// A store without private keys is a verifier.
+type store struct {
+	dir string
+	db  *shards.Db
+	wal *shards.WAL
+	// writes are the shards the store has the keys of
+	writes map[shards.Shard]bool
+}
+
+func (s *store) keysDir() string      { return filepath.Join(s.dir, "keys") }
+func (s *store) pubsFile() string     { return filepath.Join(s.dir, "pubkeys.pem") }
+func (s *store) acceptedFile() string { return filepath.Join(s.dir, "accepted.json") }
+
+// initStore creates a store in dir with a new key for each shard.
+func initStore(dir string, ids []shards.Shard) error {
+	s := &store{dir: dir}
+	if err := os.MkdirAll(s.keysDir(), 0700); err != nil {
+		return err
+	}
+	for _, shard := range ids {
+		name := filepath.Join(s.keysDir(), fmt.Sprintf("%d.pem", shard))
+		if _, err := os.Stat(name); err == nil {
+			return fmt.Errorf("shard %d: %s: %w", shard, name, shards.ErrExists)
+		}
+		kp, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+		if err != nil {
+			return err
+		}
+		b, err := shards.MarshalPrivateKeyPEM(kp)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(name, b, 0600); err != nil {
+			return err
+		}
+	}
+	if err := s.open(); err != nil {
+		return err
+	}
+	defer s.close()
+	return s.savePublicKeys()
+}
+
+// openStore opens the store in dir and replays its log.
+func openStore(dir string) (*store, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, fmt.Errorf("no store in %s (run init): %w", dir, err)
+	}
+	s := &store{dir: dir}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *store) open() error {
+	wal, err := shards.OpenWAL(filepath.Join(s.dir, "wal"))
+	if err != nil {
+		return err
+	}
+	if err := s.load(wal); err != nil {
+		wal.Close()
+		return err
+	}
+	s.wal = wal
+	return nil
+}
+
+// load makes the store's database on wal, with its keys and the statements
+// it accepted, and replays the log.
+func (s *store) load(wal *shards.WAL) error {
+	opts := []shards.Option{shards.WithWAL(wal)}
+	s.writes = make(map[shards.Shard]bool)
+	var ids []shards.Shard
+	names, err := filepath.Glob(filepath.Join(s.keysDir(), "*.pem"))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		n, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(name), ".pem"), 10, 64)
+		if err != nil {
+			continue
+		}
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		kp, err := shards.ParsePrivateKeyPEM(b)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		ids = append(ids, shards.Shard(n))
+		s.writes[shards.Shard(n)] = true
+		opts = append(opts, shards.WithKeyPair(shards.Shard(n), kp))
+	}
+	if b, err := ioutil.ReadFile(s.acceptedFile()); err == nil {
+		var accepted []*shards.SignedChecksum
+		if err := json.Unmarshal(b, &accepted); err != nil {
+			return fmt.Errorf("%s: %w", s.acceptedFile(), err)
+		}
+		opts = append(opts, shards.WithAccepted(accepted...))
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if len(ids) > 0 {
+		s.db, err = shards.NewDB(ids[0], opts...)
+	} else {
+		s.db, err = shards.NewVerifier(opts...)
+	}
+	if err != nil {
+		return err
+	}
+	if b, err := ioutil.ReadFile(s.pubsFile()); err == nil {
+		if err := s.db.ImportPublicKeys(bytes.NewReader(b)); err != nil {
+			return fmt.Errorf("%s: %w", s.pubsFile(), err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return s.db.Replay(wal)
+}
+
+// savePublicKeys writes the trusted public keys back to the store.
+func (s *store) savePublicKeys() error {
+	var b bytes.Buffer
+	if err := s.db.ExportPublicKeys(&b); err != nil {
+		return err
+	}
+	tmp := s.pubsFile() + ".tmp"
+	if err := ioutil.WriteFile(tmp, b.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.pubsFile())
+}
+
+// saveAccepted writes the statements the database has accepted back to the
+// store.
+func (s *store) saveAccepted() error {
+	b, err := json.MarshalIndent(s.db.Accepted(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.acceptedFile() + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.acceptedFile())
+}
+
+func (s *store) close() error {
+	if s.wal == nil {
+		return nil
+	}
+	return s.wal.Close()
+}